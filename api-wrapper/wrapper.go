@@ -4,15 +4,22 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"0xKowalski1/container-orchestrator/models"
 )
 
 const BaseURL = "http://localhost:8080"
 
+// ErrConflict is returned when a conditional update was made against a stale resource version
+var ErrConflict = errors.New("resource was modified concurrently")
+
 // Client represents the API client
 type WrapperClient struct {
 	HTTPClient *http.Client
@@ -65,6 +72,12 @@ func (c *WrapperClient) CreateContainer(req models.CreateContainerRequest) (*mod
 
 // UpdateContainer updates an existing container's configuration.
 func (c *WrapperClient) UpdateContainer(containerID string, req models.UpdateContainerRequest) (*models.Container, error) {
+	return c.UpdateContainerIfMatch(containerID, req, 0)
+}
+
+// UpdateContainerIfMatch updates a container only if it is still at resourceVersion, returning ErrConflict otherwise.
+// A resource version of 0 sends an unconditional update.
+func (c *WrapperClient) UpdateContainerIfMatch(containerID string, req models.UpdateContainerRequest, resourceVersion int64) (*models.Container, error) {
 	requestBody, err := json.Marshal(req)
 	if err != nil {
 		return nil, err
@@ -76,6 +89,9 @@ func (c *WrapperClient) UpdateContainer(containerID string, req models.UpdateCon
 		return nil, err
 	}
 	request.Header.Set("Content-Type", "application/json")
+	if resourceVersion != 0 {
+		request.Header.Set("If-Match", strconv.Quote(strconv.FormatInt(resourceVersion, 10)))
+	}
 
 	response, err := c.HTTPClient.Do(request)
 	if err != nil {
@@ -83,6 +99,10 @@ func (c *WrapperClient) UpdateContainer(containerID string, req models.UpdateCon
 	}
 	defer response.Body.Close()
 
+	if response.StatusCode == http.StatusConflict {
+		return nil, ErrConflict
+	}
+
 	if response.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("API request failed with status code %d", response.StatusCode)
 	}
@@ -140,6 +160,50 @@ func (c *WrapperClient) GetContainer(containerID string) (*models.Container, err
 	return &resp, nil // Return the container
 }
 
+// GetContainerEvents returns the container's recorded history, oldest first
+func (c *WrapperClient) GetContainerEvents(containerID string) ([]models.ContainerEvent, error) {
+	url := fmt.Sprintf("%s/containers/%s/events", c.BaseURL, containerID)
+	response, err := c.HTTPClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API request failed with status code %d", response.StatusCode)
+	}
+
+	var resp struct {
+		Events []models.ContainerEvent `json:"events"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+
+	return resp.Events, nil
+}
+
+// RecordEvent adds an event to a container's history
+func (c *WrapperClient) RecordEvent(req models.RecordContainerEventRequest) error {
+	requestBody, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/events", c.BaseURL)
+	response, err := c.HTTPClient.Post(url, "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated {
+		return fmt.Errorf("API request failed with status code %d", response.StatusCode)
+	}
+
+	return nil
+}
+
 func (c *WrapperClient) DeleteContainer(containerID string) error {
 	url := fmt.Sprintf("%s/containers/%s", c.BaseURL, containerID)
 	req, err := http.NewRequest("DELETE", url, nil)
@@ -251,32 +315,289 @@ func (c *WrapperClient) ListNodes() ([]models.Node, error) {
 	return resp.Nodes, nil
 }
 
-func (c *WrapperClient) WatchContainer(containerID string, handleData func(string)) error {
+// UpdateNode replaces a node's labels and/or taints
+func (c *WrapperClient) UpdateNode(nodeID string, req models.UpdateNodeRequest) error {
+	requestBody, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/nodes/%s", c.BaseURL, nodeID)
+	request, err := http.NewRequest(http.MethodPatch, url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := c.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("API request failed with status code %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+// CordonNode marks a node unschedulable
+func (c *WrapperClient) CordonNode(nodeID string) error {
+	return c.postNodeAction(nodeID, "cordon", http.StatusOK)
+}
+
+// UncordonNode makes a cordoned node schedulable again
+func (c *WrapperClient) UncordonNode(nodeID string) error {
+	return c.postNodeAction(nodeID, "uncordon", http.StatusOK)
+}
+
+// DrainNode cordons a node and reschedules its containers, the drain continues in the background on the control node
+func (c *WrapperClient) DrainNode(nodeID string) error {
+	return c.postNodeAction(nodeID, "drain", http.StatusAccepted)
+}
+
+func (c *WrapperClient) postNodeAction(nodeID, action string, expectedStatus int) error {
+	url := fmt.Sprintf("%s/nodes/%s/%s", c.BaseURL, nodeID, action)
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != expectedStatus {
+		return fmt.Errorf("API request failed with status code %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+// DeleteNode removes a node, force reschedules any containers still bound to it
+func (c *WrapperClient) DeleteNode(nodeID string, force bool) error {
+	url := fmt.Sprintf("%s/nodes/%s?force=%t", c.BaseURL, nodeID, force)
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("API request failed with status code %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+// Heartbeat tells the control node this worker is alive
+func (c *WrapperClient) Heartbeat(nodeID string) error {
+	url := fmt.Sprintf("%s/nodes/%s/heartbeat", c.BaseURL, nodeID)
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("API request failed with status code %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+// WatchNode streams the desired state of a node until the connection drops.
+// It returns the last revision seen so the caller can resume from it with no missed updates.
+func (c *WrapperClient) WatchNode(nodeID string, fromRevision int64, handleEvent func(models.NodeWatchEvent)) (int64, error) {
+	url := fmt.Sprintf("%s/nodes/%s/watch", c.BaseURL, nodeID)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return fromRevision, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if fromRevision > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatInt(fromRevision, 10))
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fromRevision, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fromRevision, fmt.Errorf("API request failed with status code %d", resp.StatusCode)
+	}
+
+	lastRevision := fromRevision
+	var data bytes.Buffer
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				return lastRevision, nil // Stream closed normally
+			}
+			return lastRevision, err // Stream error
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+
+		switch {
+		case len(line) == 0: // Blank line terminates an event
+			if data.Len() == 0 {
+				continue
+			}
+
+			var event models.NodeWatchEvent
+			if err := json.Unmarshal(data.Bytes(), &event); err != nil {
+				return lastRevision, fmt.Errorf("failed to decode node event: %v", err)
+			}
+			data.Reset()
+
+			handleEvent(event)
+			lastRevision = event.Revision
+		case bytes.HasPrefix(line, []byte("data:")):
+			data.Write(bytes.TrimSpace(line[len("data:"):]))
+		}
+	}
+}
+
+// WatchEvents streams cluster events matching the filter, calling handleEvent for each until the stream closes.
+// Passing a non zero fromRevision resumes after that revision. Returns the revision to resume from on reconnect.
+func (c *WrapperClient) WatchEvents(filter models.ClusterEventFilter, fromRevision int64, handleEvent func(models.ClusterEvent)) (int64, error) {
+	query := url.Values{}
+	if filter.ContainerID != "" {
+		query.Set("containerId", filter.ContainerID)
+	}
+	if filter.NodeID != "" {
+		query.Set("nodeId", filter.NodeID)
+	}
+	if len(filter.Types) > 0 {
+		query.Set("type", strings.Join(filter.Types, ","))
+	}
+
+	requestURL := fmt.Sprintf("%s/events?%s", c.BaseURL, query.Encode())
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return fromRevision, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if fromRevision > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatInt(fromRevision, 10))
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fromRevision, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fromRevision, fmt.Errorf("API request failed with status code %d", resp.StatusCode)
+	}
+
+	// Only advanced from id lines, which the server sends once every event at a revision has been sent
+	lastRevision := fromRevision
+	eventRevision := int64(0)
+	var data bytes.Buffer
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				return lastRevision, nil // Stream closed normally
+			}
+			return lastRevision, err // Stream error
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+
+		switch {
+		case len(line) == 0: // Blank line terminates an event
+			if data.Len() == 0 {
+				continue
+			}
+
+			var event models.ClusterEvent
+			if err := json.Unmarshal(data.Bytes(), &event); err != nil {
+				return lastRevision, fmt.Errorf("failed to decode cluster event: %v", err)
+			}
+			data.Reset()
+
+			handleEvent(event)
+			if eventRevision != 0 {
+				lastRevision = eventRevision
+				eventRevision = 0
+			}
+		case bytes.HasPrefix(line, []byte("id:")):
+			eventRevision, err = strconv.ParseInt(string(bytes.TrimSpace(line[len("id:"):])), 10, 64)
+			if err != nil {
+				return lastRevision, fmt.Errorf("invalid event id: %v", err)
+			}
+		case bytes.HasPrefix(line, []byte("data:")):
+			data.Write(bytes.TrimSpace(line[len("data:"):]))
+		}
+	}
+}
+
+// WatchContainer calls handleEvent each time the container's status, desired status or node changes,
+// returning once the container is deleted or the stream closes
+func (c *WrapperClient) WatchContainer(containerID string, handleEvent func(models.ContainerStatusEvent)) error {
 	url := fmt.Sprintf("%s/containers/%s/watch", c.BaseURL, containerID)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return err
 	}
+	req.Header.Set("Accept", "text/event-stream")
+
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("API request failed with status code %d", resp.StatusCode)
+	}
+
 	reader := bufio.NewReader(resp.Body)
 	for {
 		line, err := reader.ReadBytes('\n')
 		if err != nil {
 			if err == io.EOF {
-				break // Stream closed normally
+				return nil // Stream closed normally
 			}
 			return err // Stream error
 		}
 
-		handleData(string(line))
-	}
+		line = bytes.TrimRight(line, "\r\n")
+		if !bytes.HasPrefix(line, []byte("data:")) {
+			continue // Heartbeats and blank lines
+		}
 
-	return nil
+		var event models.ContainerStatusEvent
+		if err := json.Unmarshal(bytes.TrimSpace(line[len("data:"):]), &event); err != nil {
+			return fmt.Errorf("failed to decode container status event: %v", err)
+		}
+
+		handleEvent(event)
+	}
 }
 
 func (c *WrapperClient) StreamContainerLogs(containerID string, handleData func(string)) error {
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"sync"
 
 	"0xKowalski1/container-orchestrator/config"
 	controlnode "0xKowalski1/container-orchestrator/control-node"
@@ -20,15 +22,20 @@ func main() {
 		fmt.Printf("Error loading config: %v", err)
 		os.Exit(1)
 	}
+	if err := controlnode.ValidateSchedulingStrategy(cfg.SchedulingStrategy); err != nil {
+		fmt.Printf("Error loading config: %v", err)
+		os.Exit(1)
+	}
 
 	e := echo.New()
 
-	// Etcd
-	etcdClient, err := controlnode.NewEtcdClient()
+	// Etcd, waits for etcd to come up rather than exiting
+	etcdClient, err := controlnode.ConnectEtcd(context.Background(), cfg.Etcd)
 	if err != nil {
 		fmt.Printf("Error creating Etcd Client: %v", err)
 		os.Exit(1)
 	}
+	defer etcdClient.Close()
 
 	// Services
 	containerService := controlnode.NewContainerService(cfg, etcdClient)
@@ -44,19 +51,55 @@ func main() {
 	// Cors
 	e.Use(echomiddleware.CORSWithConfig(echomiddleware.CORSConfig{
 		AllowOrigins: []string{"*"},
-		AllowMethods: []string{echo.GET, echo.POST, echo.PUT, echo.DELETE},
-		AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept},
+		AllowMethods: []string{echo.GET, echo.POST, echo.PUT, echo.PATCH, echo.DELETE},
+		AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, "If-Match"},
+		// The panel reads ETag to send it back as If-Match on updates
+		ExposeHeaders: []string{"ETag"},
 	}))
 
+	// Typed container and node events from etcd, shared by everything that reacts to changes
+	eventBus := controlnode.NewEventBus(cfg, etcdClient)
+	go eventBus.Run(context.Background())
+
 	// New Schedular
-	controlnode.NewSchedular(etcdClient, containerService, nodeService)
+	schedular := controlnode.NewSchedular(cfg, etcdClient, eventBus, containerService, nodeService)
+	schedularHandler := controlnode.NewSchedularHandler(schedular, containerService)
+
+	// Reschedules containers off failed nodes
+	nodeController := controlnode.NewNodeController(cfg, containerService, nodeService)
+
+	// Every replica serves the API, only the elected leader runs the schedular and controllers
+	leaderElector := controlnode.NewLeaderElector(cfg, etcdClient)
+	go leaderElector.Run(context.Background(), func(ctx context.Context) {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			schedular.Run(ctx)
+		}()
+		go func() {
+			defer wg.Done()
+			nodeController.Run(ctx)
+		}()
+		wg.Wait()
+	})
+	healthHandler := controlnode.NewHealthHandler(leaderElector)
+	eventHandler := controlnode.NewEventHandler(eventBus, containerService)
 
 	// Routes
+	e.GET("/healthz", healthHandler.Healthz)
 
 	/// Nodes
 	e.GET("/nodes", nodeHandler.GetNodes)
 	e.GET("/nodes/:id", nodeHandler.GetNode)
 	e.POST("/nodes", nodeHandler.JoinCluster)
+	e.GET("/nodes/:id/watch", nodeHandler.WatchNode)
+	e.POST("/nodes/:id/heartbeat", nodeHandler.Heartbeat)
+	e.POST("/nodes/:id/cordon", nodeHandler.CordonNode)
+	e.POST("/nodes/:id/uncordon", nodeHandler.UncordonNode)
+	e.POST("/nodes/:id/drain", nodeHandler.DrainNode)
+	e.DELETE("/nodes/:id", nodeHandler.DeleteNode)
+	e.PATCH("/nodes/:id", nodeHandler.UpdateNode)
 
 	// Containers
 	e.GET("/containers", containerHandler.GetContainers)
@@ -68,6 +111,14 @@ func main() {
 	e.POST("/containers/:id/stop", containerHandler.StopContainer)
 	e.GET("/containers/:id/logs", containerHandler.StreamContainerLogs)
 	e.GET("/containers/:id/watch", containerHandler.GetContainerStatus)
+	e.GET("/containers/:id/events", containerHandler.GetContainerEvents)
+
+	// Schedular
+	e.POST("/scheduler/simulate", schedularHandler.Simulate)
+
+	// Events
+	e.GET("/events", eventHandler.WatchEvents)
+	e.POST("/events", eventHandler.RecordEvent)
 
 	fmt.Printf("Listening on :%d", 8080)
 	e.Logger.Fatal(e.Start(fmt.Sprintf(":%d", 8080)))
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -28,6 +30,20 @@ func main() {
 		os.Exit(1)
 	}
 
+	apiClient := api.NewApiWrapper(cfg.ControlNodeIp)
+
+	// Should do self discovery/cfg for this
+	nodeConfig := models.CreateNodeRequest{
+		ID:           "node-1",
+		MemoryLimit:  16,
+		CpuLimit:     4,
+		StorageLimit: 10,
+		NodeIp:       cfg.NodeIp,
+	}
+
+	// Container history on the control node, e.g. exits and OOM kills
+	events := workernode.NewEventRecorder(apiClient, nodeConfig.ID)
+
 	runtime, err := workernode.NewContainerdRuntime(cfg)
 
 	if err != nil {
@@ -35,65 +51,151 @@ func main() {
 		os.Exit(1)
 	}
 
-	storage := workernode.NewStorageManager(cfg, &utils.FileOps{}, &utils.CmdRunner{})
+	containers := workernode.NewContainerManager(cfg, runtime, apiClient, events)
+	go containers.Run(context.Background())
+
+	storage := workernode.NewStorageManager(cfg, &utils.FileOps{}, &utils.CmdRunner{}, events)
 
-	networking := workernode.NewNetworkingManager(cfg, &utils.CmdRunner{})
+	networking := workernode.NewNetworkingManager(cfg, &utils.CmdRunner{}, events)
 
 	metricsApi := workernode.NewMetricsApi(cfg)
 
 	go metricsApi.Start()
 
-	apiClient := api.NewApiWrapper(cfg.ControlNodeIp)
+	joinCluster(apiClient, nodeConfig)
 
-	// Should do self discovery/cfg for this
-	nodeConfig := models.CreateNodeRequest{
-		ID:           "node-1",
-		MemoryLimit:  16,
-		CpuLimit:     4,
-		StorageLimit: 10,
-		NodeIp:       cfg.NodeIp,
-	}
+	// If node already exists and it isnt use, then auth should catch it
 
-	// Check if node exists
-	_, err = apiClient.GetNode(nodeConfig.ID)
-	if err != nil {
-		// If it does not (or not authed, which will fail) try and Join Cluster
-		_, err := apiClient.JoinCluster(nodeConfig)
-		if err != nil {
-			log.Printf("Error joining cluster: %v", err)
-			panic(err) // Probably want to retry & log
-		}
-	}
+	go sendHeartbeats(apiClient, nodeConfig.ID, time.Duration(cfg.NodeHeartbeatInterval)*time.Second)
 
-	// If node already exists and it isnt use, then auth should catch it
+	// Desired state is pushed from the control node, only the latest state matters so the channel holds one
+	desiredState := make(chan *models.Node, 1)
+	go watchDesiredState(apiClient, nodeConfig.ID, desiredState)
 
-	ticker := time.NewTicker(5 * time.Second) // Switch to SSE instead of polling at some point
+	// Slow periodic resync in case the watch misses something or the actual state drifts
+	ticker := time.NewTicker(resyncInterval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		node, err := apiClient.GetNode(nodeConfig.ID)
-		if err != nil {
-			log.Printf("Error checking for nodes desired state: %v", err)
-			continue
+	var node *models.Node
+	for {
+		select {
+		case node = <-desiredState:
+		case <-containers.Resync():
+			// A crashed container is due to be restarted, the desired state has not changed
+			if node == nil {
+				continue
+			}
+		case <-ticker.C:
+			latest, err := apiClient.GetNode(nodeConfig.ID)
+			if err != nil {
+				log.Printf("Error checking for nodes desired state: %v", err)
+				continue
+			}
+			node = latest
 		}
 
+		// A container whose volume or network could not be set up is skipped, every other container is still reconciled
+		skip := make(map[string]error)
+
 		err = storage.SyncStorage(node.Containers)
 		if err != nil {
 			log.Printf("Error syncing storage: %v", err)
-			continue
+			skipFailed(skip, err)
 		}
 
 		err = networking.SyncNetworking(node.Containers)
 		if err != nil {
 			log.Printf("Error syncing network: %v", err)
-			continue
+			skipFailed(skip, err)
 		}
 
-		err = runtime.SyncContainers(node.Containers)
+		err = containers.SyncContainersExcept(node.Containers, skip)
 		if err != nil {
 			log.Printf("Error syncing containers: %v", err)
 			continue
 		}
+	}
+}
+
+// skipFailed adds the containers a sync failed for to skip. A failure that is not tied to containers, e.g. listing
+// volumes, skips nothing, the containers it affects fail to be created and are retried with backoff.
+func skipFailed(skip map[string]error, err error) {
+	var syncErr *workernode.SyncError
+	if !errors.As(err, &syncErr) {
+		return
+	}
+
+	for containerID, containerErr := range syncErr.Containers {
+		skip[containerID] = containerErr
+	}
+}
+
+const (
+	resyncInterval       = 60 * time.Second
+	watchRetryMinBackoff = 1 * time.Second
+	watchRetryMaxBackoff = 30 * time.Second
+)
+
+// joinCluster joins the node to the cluster if it is not already part of it, retrying with backoff until it succeeds
+func joinCluster(apiClient *api.WrapperClient, nodeConfig models.CreateNodeRequest) {
+	backoff := watchRetryMinBackoff
+
+	for {
+		// Check if node exists
+		if _, err := apiClient.GetNode(nodeConfig.ID); err == nil {
+			return
+		}
+
+		// If it does not (or not authed, which will fail) try and Join Cluster
+		_, err := apiClient.JoinCluster(nodeConfig)
+		if err == nil {
+			return
+		}
+
+		log.Printf("Error joining cluster, retrying in %s: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, watchRetryMaxBackoff)
+	}
+}
+
+// sendHeartbeats keeps the node's lease alive on the control node so it is scheduled to
+func sendHeartbeats(apiClient *api.WrapperClient, nodeID string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for ; true; <-ticker.C {
+		if err := apiClient.Heartbeat(nodeID); err != nil {
+			log.Printf("Error sending heartbeat: %v", err)
+		}
+	}
+}
+
+// watchDesiredState keeps a watch open on the control node, reconnecting with backoff and resuming
+// from the last seen revision so no update is lost while disconnected.
+func watchDesiredState(apiClient *api.WrapperClient, nodeID string, desiredState chan *models.Node) {
+	var revision int64
+	backoff := watchRetryMinBackoff
+
+	for {
+		lastRevision, err := apiClient.WatchNode(nodeID, revision, func(event models.NodeWatchEvent) {
+			node := event.Node
+
+			// Replace any state the sync loop has not picked up yet
+			select {
+			case <-desiredState:
+			default:
+			}
+			desiredState <- &node
+
+			backoff = watchRetryMinBackoff
+		})
+		revision = lastRevision
+
+		if err != nil {
+			log.Printf("Error watching nodes desired state: %v", err)
+		}
 
+		time.Sleep(backoff)
+		backoff = min(backoff*2, watchRetryMaxBackoff)
 	}
 }
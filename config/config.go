@@ -5,6 +5,37 @@ import (
 	"os"
 )
 
+// PortRange is an inclusive range of host ports
+type PortRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+func (r PortRange) Size() int {
+	if r.Max < r.Min {
+		return 0
+	}
+	return r.Max - r.Min + 1
+}
+
+// EtcdConfig is how the control node connects to etcd
+type EtcdConfig struct {
+	Endpoints   []string `json:"endpoints"`
+	DialTimeout int      `json:"dialTimeout"` // Seconds
+
+	Username string `json:"username"` // Leave empty when etcd auth is disabled
+	Password string `json:"password"`
+
+	CertFile string `json:"certFile"` // Client certificate and key for mutual TLS
+	KeyFile  string `json:"keyFile"`
+	CAFile   string `json:"caFile"` // CA the etcd server certificates are verified against, TLS is used if any file is set
+}
+
+// TLSEnabled reports whether any TLS file is configured
+func (c EtcdConfig) TLSEnabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.CAFile != ""
+}
+
 type Config struct {
 	Namespace            string `json:"namespace"` // Production, Development or Test
 	NodeIp               string `json:"nodeIp"`    // Worker node accesible ip
@@ -19,6 +50,21 @@ type Config struct {
 	NetworkNamespacePath  string `json:"networkNamespacePath"`
 
 	LogPath string `json:"logPath"`
+
+	NodeHeartbeatInterval int `json:"nodeHeartbeatInterval"` // Seconds between worker heartbeats
+	NodeHeartbeatTimeout  int `json:"nodeHeartbeatTimeout"`  // Seconds without a heartbeat before a node is NotReady
+
+	NodeFailureGracePeriod int `json:"nodeFailureGracePeriod"` // Seconds a node can be NotReady before its containers are rescheduled
+
+	SchedulingStrategy string `json:"schedulingStrategy"` // binpack, spread (least-allocated) or random
+
+	HostPortRanges map[string]PortRange `json:"hostPortRanges"` // Protocol (tcp or udp) -> ports the schedular may assign
+
+	Etcd EtcdConfig `json:"etcd"`
+
+	LeaderElectionTTL int `json:"leaderElectionTTL"` // Seconds before a control node that stopped responding loses leadership
+
+	EventTTL int `json:"eventTTL"` // Seconds container events are kept before etcd expires them
 }
 
 func LoadConfig(configFile string) (*Config, error) {
@@ -35,5 +81,41 @@ func LoadConfig(configFile string) (*Config, error) {
 		return nil, err
 	}
 
+	setDefaults(&config)
+
 	return &config, nil
 }
+
+// setDefaults fills in optional values that were left out of the config file
+func setDefaults(config *Config) {
+	if config.NodeHeartbeatInterval <= 0 {
+		config.NodeHeartbeatInterval = 10
+	}
+	if config.NodeHeartbeatTimeout <= 0 {
+		config.NodeHeartbeatTimeout = 30
+	}
+	if config.NodeFailureGracePeriod <= 0 {
+		config.NodeFailureGracePeriod = 300
+	}
+	if config.SchedulingStrategy == "" {
+		config.SchedulingStrategy = "spread"
+	}
+	if config.HostPortRanges == nil {
+		config.HostPortRanges = map[string]PortRange{
+			"tcp": {Min: 30000, Max: 32767},
+			"udp": {Min: 30000, Max: 32767},
+		}
+	}
+	if len(config.Etcd.Endpoints) == 0 {
+		config.Etcd.Endpoints = []string{"localhost:2379"}
+	}
+	if config.Etcd.DialTimeout <= 0 {
+		config.Etcd.DialTimeout = 5
+	}
+	if config.LeaderElectionTTL <= 0 {
+		config.LeaderElectionTTL = 15
+	}
+	if config.EventTTL <= 0 {
+		config.EventTTL = 3600
+	}
+}
@@ -1,11 +1,15 @@
 package controlnode
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"0xKowalski1/container-orchestrator/models"
@@ -41,7 +45,43 @@ func (handler *ContainerHandler) CreateContainer(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request"})
 	}
 
+	// Anything other than keep-pinned would quietly mean reschedule, losing the node local volume
+	switch req.ReschedulePolicy {
+	case "", models.ReschedulePolicyReschedule, models.ReschedulePolicyKeepPinned:
+	default:
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": fmt.Sprintf("Unknown reschedule policy %q", req.ReschedulePolicy)})
+	}
+
+	if req.SchedulingStrategy != "" && ValidateSchedulingStrategy(req.SchedulingStrategy) != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": fmt.Sprintf("Unknown scheduling strategy %q", req.SchedulingStrategy)})
+	}
+
+	// The worker treats anything it does not know as Always, a typo of Never would restart forever
+	switch req.RestartPolicy {
+	case "", models.RestartPolicyAlways, models.RestartPolicyOnFailure, models.RestartPolicyNever:
+	default:
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": fmt.Sprintf("Unknown restart policy %q", req.RestartPolicy)})
+	}
+
+	if req.MaxRestarts < 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "maxRestarts cannot be negative"})
+	}
+
+	if req.ReadinessProbe != nil {
+		if err := req.ReadinessProbe.Validate(req.Ports); err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": fmt.Sprintf("Invalid readiness probe: %v", err)})
+		}
+	}
+	if req.LivenessProbe != nil {
+		if err := req.LivenessProbe.Validate(req.Ports); err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": fmt.Sprintf("Invalid liveness probe: %v", err)})
+		}
+	}
+
 	createdContainer, err := handler.ContainerService.CreateContainer(req)
+	if errors.Is(err, ErrConflict) {
+		return c.JSON(http.StatusConflict, echo.Map{"error": "Container already exists"})
+	}
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
 	}
@@ -59,7 +99,19 @@ func (handler *ContainerHandler) UpdateContainer(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request"})
 	}
 
-	err := handler.ContainerService.UpdateContainer(containerID, req)
+	resourceVersion, err := ifMatchVersion(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	if resourceVersion != 0 {
+		err = handler.ContainerService.UpdateContainerIfMatch(c.Request().Context(), containerID, req, resourceVersion)
+	} else {
+		err = handler.ContainerService.UpdateContainer(c.Request().Context(), containerID, req)
+	}
+	if errors.Is(err, ErrConflict) {
+		return c.JSON(http.StatusConflict, echo.Map{"error": "Container was modified, fetch it again and retry"})
+	}
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
 	}
@@ -78,13 +130,40 @@ func (handler *ContainerHandler) GetContainer(c echo.Context) error {
 		return c.JSON(http.StatusNotFound, echo.Map{"error": "Container not found"})
 	}
 
+	setETag(c, container.ResourceVersion)
 	return c.JSON(http.StatusOK, container)
 }
 
+// GetContainerEvents handles GET /containers/:id/events
+// Events outlive the container until they expire, so a deleted container still has its history
+func (handler *ContainerHandler) GetContainerEvents(c echo.Context) error {
+	containerID := c.Param("id")
+
+	events, err := handler.ContainerService.GetEvents(containerID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"events": events})
+}
+
 // DeleteContainer handles DELETE /containers/:id
 func (handler *ContainerHandler) DeleteContainer(c echo.Context) error {
 	containerID := c.Param("id")
-	err := handler.ContainerService.DeleteContainer(containerID, handler.NodeService)
+
+	resourceVersion, err := ifMatchVersion(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	if resourceVersion != 0 {
+		err = handler.ContainerService.DeleteContainerIfMatch(containerID, handler.NodeService, resourceVersion)
+	} else {
+		err = handler.ContainerService.DeleteContainer(containerID, handler.NodeService)
+	}
+	if errors.Is(err, ErrConflict) {
+		return c.JSON(http.StatusConflict, echo.Map{"error": "Container was modified, fetch it again and retry"})
+	}
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
 	}
@@ -97,7 +176,7 @@ func (handler *ContainerHandler) StartContainer(c echo.Context) error {
 	containerID := c.Param("id")
 	desiredStatus := "running"
 
-	err := handler.ContainerService.UpdateContainer(containerID, models.UpdateContainerRequest{
+	err := handler.ContainerService.UpdateContainer(c.Request().Context(), containerID, models.UpdateContainerRequest{
 		DesiredStatus: &desiredStatus,
 	})
 
@@ -113,7 +192,7 @@ func (handler *ContainerHandler) StopContainer(c echo.Context) error {
 	containerID := c.Param("id")
 	desiredStatus := "stopped"
 
-	err := handler.ContainerService.UpdateContainer(containerID, models.UpdateContainerRequest{
+	err := handler.ContainerService.UpdateContainer(c.Request().Context(), containerID, models.UpdateContainerRequest{
 		DesiredStatus: &desiredStatus,
 	})
 
@@ -156,14 +235,16 @@ func (handler *ContainerHandler) StreamContainerLogs(c echo.Context) error {
 	return nil
 }
 
+// GetContainerStatus streams the container's status, desired status and node as JSON events whenever one of them changes
 func (handler *ContainerHandler) GetContainerStatus(c echo.Context) error {
 	containerID := c.Param("id")
 
-	c.Response().Header().Set("Content-Type", "text/event-stream")
-	c.Response().Header().Set("Cache-Control", "no-cache")
-	c.Response().Header().Set("Connection", "keep-alive")
-	c.Response().Header().Set("Transfer-Encoding", "chunked")
-	c.Response().WriteHeader(http.StatusOK)
+	// Subscribe before writing headers so a missing container is still a 404
+	statusChan, err := handler.ContainerService.SubscribeToStatus(containerID)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Container not found"})
+	}
+	defer handler.ContainerService.UnsubscribeFromStatus(containerID, statusChan)
 
 	// Flusher to ensure data is sent to the client immediately
 	flusher, ok := c.Response().Writer.(http.Flusher)
@@ -171,23 +252,34 @@ func (handler *ContainerHandler) GetContainerStatus(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "streaming unsupported"})
 	}
 
-	statusChan, err := handler.ContainerService.SubscribeToStatus(containerID)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to subscribe to container status"})
-	}
-	defer handler.ContainerService.UnsubscribeFromStatus(containerID, statusChan)
+	c.Response().Header().Set("Content-Type", "text/event-stream")
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	c.Response().Header().Set("Connection", "keep-alive")
+	c.Response().Header().Set("Transfer-Encoding", "chunked")
+	c.Response().WriteHeader(http.StatusOK)
+	flusher.Flush()
 
 	heartbeatTicker := time.NewTicker(30 * time.Second)
 	defer heartbeatTicker.Stop()
 
 	for {
 		select {
-		case status, ok := <-statusChan:
+		case event, ok := <-statusChan:
 			if !ok {
 				return nil
 			}
-			fmt.Fprintf(c.Response(), "data: %s\n\n", status)
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(c.Response(), "data: %s\n\n", data)
 			flusher.Flush()
+
+			// Nothing more will change once the container is gone
+			if event.Type == models.ContainerStatusEventDeleted {
+				return nil
+			}
 		case <-heartbeatTicker.C:
 			fmt.Fprintf(c.Response(), ":heartbeat\n\n")
 			flusher.Flush()
@@ -196,3 +288,23 @@ func (handler *ContainerHandler) GetContainerStatus(c echo.Context) error {
 		}
 	}
 }
+
+// ifMatchVersion reads the resource version from the If-Match header, 0 if it is absent
+func ifMatchVersion(c echo.Context) (int64, error) {
+	header := c.Request().Header.Get("If-Match")
+	if header == "" {
+		return 0, nil
+	}
+
+	value := strings.Trim(strings.TrimPrefix(header, "W/"), `"`)
+	resourceVersion, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || resourceVersion <= 0 {
+		return 0, fmt.Errorf("invalid If-Match header %q", header)
+	}
+
+	return resourceVersion, nil
+}
+
+func setETag(c echo.Context, resourceVersion int64) {
+	c.Response().Header().Set("ETag", strconv.Quote(strconv.FormatInt(resourceVersion, 10)))
+}
@@ -3,32 +3,55 @@ package controlnode
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"math/rand"
+	"sync"
 	"time"
 
 	"0xKowalski1/container-orchestrator/config"
 	"0xKowalski1/container-orchestrator/models"
-
-	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 // ContainerService handles operations related to containers
 type ContainerService struct {
-	cfg        *config.Config
-	etcdClient *EtcdClient
+	cfg   *config.Config
+	store Store
+
+	statusWatches map[string]*statusWatch // ContainerID -> watch shared by its status subscribers
+	mu            sync.Mutex
+
+	eventLeaseID      int64 // Lease shared by events recorded within the same window
+	eventLeaseGranted time.Time
+	leaseMu           sync.Mutex
 }
 
 // NewContainerService creates a new ContainerService
-func NewContainerService(cfg *config.Config, etcdClient *EtcdClient) *ContainerService {
+func NewContainerService(cfg *config.Config, store Store) *ContainerService {
 	return &ContainerService{
-		cfg:        cfg,
-		etcdClient: etcdClient,
+		cfg:           cfg,
+		store:         store,
+		statusWatches: make(map[string]*statusWatch),
 	}
 }
 
 // AddContainer adds a new container to a namespace
 func (cs *ContainerService) CreateContainer(containerRequest models.CreateContainerRequest) (*models.Container, error) {
-	container := models.Container{
+	container := cs.NewContainer(containerRequest)
+
+	// A resource version of 0 only succeeds if the container does not exist yet
+	err := updateEntity(context.Background(), cs.store, container, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &container, nil
+}
+
+// NewContainer builds a container from a request without storing it
+func (cs *ContainerService) NewContainer(containerRequest models.CreateContainerRequest) models.Container {
+	return models.Container{
 		ID:            containerRequest.ID,
 		Image:         containerRequest.Image,
 		Env:           containerRequest.Env,
@@ -39,42 +62,64 @@ func (cs *ContainerService) CreateContainer(containerRequest models.CreateContai
 		NamespaceID:   cs.cfg.Namespace, // Ensure the container knows its namespaceID
 		DesiredStatus: "running",
 		Ports:         containerRequest.Ports,
-	}
 
-	err := cs.etcdClient.SaveEntity(container)
-	if err != nil {
-		return nil, err
-	}
+		ReschedulePolicy:   containerRequest.ReschedulePolicy,
+		SchedulingStrategy: containerRequest.SchedulingStrategy,
 
-	cs.etcdClient.emit(Event{Type: ContainerAdded, Data: container})
+		RestartPolicy: containerRequest.RestartPolicy,
+		MaxRestarts:   containerRequest.MaxRestarts,
 
-	return &container, nil
+		ReadinessProbe: containerRequest.ReadinessProbe,
+		LivenessProbe:  containerRequest.LivenessProbe,
+
+		NodeSelector: containerRequest.NodeSelector,
+		NodeAffinity: containerRequest.NodeAffinity,
+		Tolerations:  containerRequest.Tolerations,
+
+		Labels:         containerRequest.Labels,
+		AntiAffinity:   containerRequest.AntiAffinity,
+		TopologySpread: containerRequest.TopologySpread,
+
+		Priority:     containerRequest.Priority,
+		NeverPreempt: containerRequest.NeverPreempt,
+	}
 }
 
-// RemoveContainer removes a container from a namespace by its ID
+// DeleteContainer deletes the container and removes it from its node, retrying if either is modified concurrently
 func (cs *ContainerService) DeleteContainer(containerID string, nodeService *NodeService) error {
-	namespaceID := cs.cfg.Namespace
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	err := nodeService.RemoveContainerFromNode(containerID)
+	return retryOnConflict(func() error {
+		return cs.DeleteContainerIfMatch(containerID, nodeService, 0)
+	})
+}
 
+// DeleteContainerIfMatch deletes the container and removes it from its node in a single transaction, only if the
+// container is still at resourceVersion, returning ErrConflict otherwise. A resource version of 0 deletes whichever
+// version is read.
+func (cs *ContainerService) DeleteContainerIfMatch(containerID string, nodeService *NodeService, resourceVersion int64) error {
+	container, err := cs.GetContainer(containerID)
 	if err != nil {
-		fmt.Printf("Failed to remove container from node: %v", err)
-
 		return err
 	}
 
-	key := "/namespaces/" + namespaceID + "/containers/" + containerID
-	_, err = cs.etcdClient.Client.Delete(ctx, key)
-	if err != nil {
-		fmt.Printf("Failed to delete container: %v", err)
-		return err
+	if resourceVersion != 0 && container.ResourceVersion != resourceVersion {
+		return ErrConflict
 	}
 
-	cs.etcdClient.emit(Event{Type: ContainerRemoved, Data: containerID})
+	updates := []VersionedEntity{{Entity: *container, ResourceVersion: container.ResourceVersion, Delete: true}}
 
-	return nil
+	if container.NodeID != "" {
+		node, err := nodeService.GetNode(container.NodeID)
+		if err != nil {
+			return err
+		}
+
+		// A node that is already gone has nothing to remove it from
+		if node != nil && removeContainer(node, containerID) {
+			updates = append(updates, VersionedEntity{Entity: node, ResourceVersion: node.ResourceVersion})
+		}
+	}
+
+	return updateEntities(context.Background(), cs.store, updates...)
 }
 
 // GetContainer retrieves a container by its ID and namespaceID
@@ -84,7 +129,7 @@ func (cs *ContainerService) GetContainer(containerID string) (*models.Container,
 	defer cancel()
 
 	key := "/namespaces/" + namespaceID + "/containers/" + containerID
-	resp, err := cs.etcdClient.Client.Get(ctx, key)
+	resp, err := cs.store.Get(ctx, key)
 	if err != nil {
 		return nil, err
 	}
@@ -98,6 +143,7 @@ func (cs *ContainerService) GetContainer(containerID string) (*models.Container,
 	if err != nil {
 		return nil, err
 	}
+	container.ResourceVersion = resp.Kvs[0].ModRevision
 
 	return &container, nil
 }
@@ -109,7 +155,7 @@ func (cs *ContainerService) GetContainers() ([]models.Container, error) {
 	defer cancel()
 
 	prefix := "/namespaces/" + namespaceID + "/containers/"
-	resp, err := cs.etcdClient.Client.Get(ctx, prefix, clientv3.WithPrefix())
+	resp, err := cs.store.Get(ctx, prefix, WithPrefix())
 	if err != nil {
 		return nil, err
 	}
@@ -120,6 +166,7 @@ func (cs *ContainerService) GetContainers() ([]models.Container, error) {
 		if err := json.Unmarshal(kv.Value, &container); err != nil {
 			continue
 		}
+		container.ResourceVersion = kv.ModRevision
 		containers = append(containers, container)
 	}
 
@@ -144,16 +191,46 @@ func (cs *ContainerService) GetUnscheduledContainers() ([]models.Container, erro
 	return unscheduledContainers, nil
 }
 
-// PatchContainer updates specific fields of a container in a namespace.
-func (cs *ContainerService) UpdateContainer(containerID string, patch models.UpdateContainerRequest) error {
+// PatchContainer updates specific fields of a container in a namespace, retrying if it is modified concurrently.
+func (cs *ContainerService) UpdateContainer(ctx context.Context, containerID string, patch models.UpdateContainerRequest) error {
+	return retryOnConflict(func() error {
+		return cs.UpdateContainerIfMatch(ctx, containerID, patch, 0)
+	})
+}
+
+// UpdateContainerIfMatch applies the patch only if the container is still at resourceVersion, returning ErrConflict otherwise.
+// A resource version of 0 applies the patch to whichever version is read.
+func (cs *ContainerService) UpdateContainerIfMatch(ctx context.Context, containerID string, patch models.UpdateContainerRequest, resourceVersion int64) error {
 	container, err := cs.GetContainer(containerID)
 	if err != nil {
 		return err
 	}
 
-	// Apply the patch
+	if resourceVersion != 0 && container.ResourceVersion != resourceVersion {
+		return ErrConflict
+	}
+
+	restartCount := container.RestartCount
+	applyContainerPatch(container, patch)
+
+	if err := updateEntity(ctx, cs.store, *container, container.ResourceVersion); err != nil {
+		return err
+	}
+
+	if container.RestartCount > restartCount {
+		message := fmt.Sprintf("Restarted after its last run ended with %s (exit code %d), restart %d", container.ExitReason, *container.ExitCode, container.RestartCount)
+		if err := cs.RecordEvent(containerID, models.EventReasonRestarted, message); err != nil {
+			log.Printf("Failed to record event for container %s: %v", containerID, err)
+		}
+	}
+
+	return nil
+}
+
+func applyContainerPatch(container *models.Container, patch models.UpdateContainerRequest) {
 	if patch.DesiredStatus != nil {
 		container.DesiredStatus = *patch.DesiredStatus
+		container.PreemptedDesiredStatus = "" // Whoever set it now decides, whether or not it is still being preempted
 	}
 	if patch.NodeID != nil {
 		container.NodeID = *patch.NodeID
@@ -161,62 +238,347 @@ func (cs *ContainerService) UpdateContainer(containerID string, patch models.Upd
 	if patch.Status != nil {
 		container.Status = *patch.Status
 	}
+	if patch.SchedulingMessage != nil {
+		container.SchedulingMessage = *patch.SchedulingMessage
+	}
+	if patch.ExitCode != nil {
+		applyExit(container, patch)
+	}
+	if patch.StartedAt != nil {
+		applyStart(container, *patch.StartedAt)
+	}
+	if patch.NextRestartAt != nil {
+		container.NextRestartAt = patch.NextRestartAt
+	}
+	for _, condition := range patch.Conditions {
+		setCondition(container, condition)
+	}
+	if patch.ServerInfo != nil {
+		container.ServerInfo = patch.ServerInfo
+	}
+}
+
+// setCondition replaces the container's condition of the same type, keeping its transition time if the status did not change
+func setCondition(container *models.Container, condition models.ContainerCondition) {
+	existing := container.Condition(condition.Type)
+	if existing == nil {
+		container.Conditions = append(container.Conditions, condition)
+		return
+	}
+
+	if existing.Status == condition.Status {
+		condition.LastTransitionTime = existing.LastTransitionTime
+	}
+	*existing = condition
+}
+
+// applyExit records how the last run ended, judged against what the container was meant to be doing at the time
+func applyExit(container *models.Container, patch models.UpdateContainerRequest) {
+	container.ExitCode = patch.ExitCode
+	container.ExitedAt = patch.ExitedAt
+	container.OOMKilled = patch.OOMKilled != nil && *patch.OOMKilled
+	container.NextRestartAt = nil // Set again by the same patch if the worker is backing off
+	container.ServerInfo = nil    // Nothing is answering queries any more
+
+	switch {
+	case container.OOMKilled:
+		container.ExitReason = models.ExitReasonOOMKilled
+	case container.DesiredStatus != "running" || container.NodeID == "":
+		container.ExitReason = models.ExitReasonStopped
+	case *container.ExitCode != 0:
+		container.ExitReason = models.ExitReasonError
+	default:
+		container.ExitReason = models.ExitReasonCompleted
+	}
+}
+
+// applyStart records a new run, counting it as a restart if the previous run ended without being stopped on purpose
+func applyStart(container *models.Container, startedAt time.Time) {
+	// Starts are reported once per run, but a repeated report must not count twice
+	exitedSinceStart := container.ExitedAt != nil && (container.StartedAt == nil || container.ExitedAt.After(*container.StartedAt))
+	if exitedSinceStart && container.ExitReason != models.ExitReasonStopped && startedAt.After(*container.ExitedAt) {
+		container.RestartCount++
+	}
 
-	return cs.etcdClient.SaveEntity(*container)
+	container.StartedAt = &startedAt
+	container.NextRestartAt = nil
+}
+
+// eventLeaseWindow is how long one lease is shared by newly recorded events, so each event does not need its own lease.
+// Events live between EventTTL and EventTTL plus the window.
+const eventLeaseWindow = time.Minute
+
+// RecordEvent stores an event in the container's history
+func (cs *ContainerService) RecordEvent(containerID, reason, message string) error {
+	return cs.SaveEvent(models.ContainerEvent{
+		ContainerID: containerID,
+		Reason:      reason,
+		Message:     message,
+		Source:      "control-node",
+	})
+}
+
+// SaveEvent stores an event recorded by any component, it expires after the configured event TTL
+func (cs *ContainerService) SaveEvent(event models.ContainerEvent) error {
+	event.NamespaceID = cs.cfg.Namespace
+	event.ReceivedAt = time.Now().UTC()
+	event.ID = fmt.Sprintf("%08x", rand.Uint32())
+	if event.Time.IsZero() {
+		event.Time = event.ReceivedAt
+	}
+
+	value, err := event.Value()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	leaseID, err := cs.eventLease(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = cs.store.Put(ctx, event.Key(), value, WithLease(leaseID))
+	if errors.Is(err, ErrLeaseNotFound) {
+		// The lease was revoked or expired early, grant a fresh one and try again
+		cs.leaseMu.Lock()
+		cs.eventLeaseID = 0
+		cs.leaseMu.Unlock()
+
+		if leaseID, err = cs.eventLease(ctx); err != nil {
+			return err
+		}
+		err = cs.store.Put(ctx, event.Key(), value, WithLease(leaseID))
+	}
+
+	return err
+}
+
+// eventLease returns the lease newly recorded events are attached to, granting a new one once the window has passed
+func (cs *ContainerService) eventLease(ctx context.Context) (int64, error) {
+	cs.leaseMu.Lock()
+	defer cs.leaseMu.Unlock()
+
+	if cs.eventLeaseID != 0 && time.Since(cs.eventLeaseGranted) < eventLeaseWindow {
+		return cs.eventLeaseID, nil
+	}
+
+	ttl := int64(cs.cfg.EventTTL) + int64(eventLeaseWindow/time.Second)
+	leaseID, err := cs.store.Grant(ctx, ttl)
+	if err != nil {
+		return 0, err
+	}
+
+	cs.eventLeaseID = leaseID
+	cs.eventLeaseGranted = time.Now()
+
+	return leaseID, nil
+}
+
+// GetEvents returns the container's recorded events, oldest first
+func (cs *ContainerService) GetEvents(containerID string) ([]models.ContainerEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	prefix := "/namespaces/" + cs.cfg.Namespace + "/events/" + containerID + "/"
+	resp, err := cs.store.Get(ctx, prefix, WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]models.ContainerEvent, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var event models.ContainerEvent
+		if err := json.Unmarshal(kv.Value, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// statusSubscriberBuffer is how many events a slow status subscriber can fall behind before events are dropped for it
+const statusSubscriberBuffer = 16
+
+// statusWatch is a single etcd watch on a container shared by all of its status subscribers
+type statusWatch struct {
+	cancel      context.CancelFunc
+	subscribers map[chan models.ContainerStatusEvent]struct{}
 }
 
 // SubscribeToStatus subscribes to status updates for a container
-func (cs *ContainerService) SubscribeToStatus(containerID string) (chan string, error) {
-	cs.etcdClient.mu.Lock()
-	defer cs.etcdClient.mu.Unlock()
+func (cs *ContainerService) SubscribeToStatus(containerID string) (chan models.ContainerStatusEvent, error) {
+	container, err := cs.GetContainer(containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
 
 	// Create a new channel for this subscription
-	statusChan := make(chan string)
+	statusChan := make(chan models.ContainerStatusEvent, statusSubscriberBuffer)
+
+	watch, ok := cs.statusWatches[containerID]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		watch = &statusWatch{
+			cancel:      cancel,
+			subscribers: make(map[chan models.ContainerStatusEvent]struct{}),
+		}
+		cs.statusWatches[containerID] = watch
 
-	if _, ok := cs.etcdClient.subscriptions[containerID]; !ok {
-		cs.etcdClient.subscriptions[containerID] = make(map[chan string]struct{})
-		// Start watching etcd for changes to this container's status
-		go cs.watchStatus(containerID)
+		// Start watching etcd for changes to this container's status, from just after the version we read
+		// so no change between subscribing and the watch starting is missed
+		go cs.watchStatus(ctx, containerID, container.ResourceVersion+1, watch)
 	}
 
-	cs.etcdClient.subscriptions[containerID][statusChan] = struct{}{}
+	watch.subscribers[statusChan] = struct{}{}
 
 	return statusChan, nil
 }
 
 // UnsubscribeFromStatus unsubscribes from status updates for a container
-func (cs *ContainerService) UnsubscribeFromStatus(containerID string, statusChan chan string) {
-	cs.etcdClient.mu.Lock()
-	defer cs.etcdClient.mu.Unlock()
+func (cs *ContainerService) UnsubscribeFromStatus(containerID string, statusChan chan models.ContainerStatusEvent) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
 
-	subscribers, ok := cs.etcdClient.subscriptions[containerID]
+	watch, ok := cs.statusWatches[containerID]
 	if !ok {
 		return
 	}
 
+	if _, ok := watch.subscribers[statusChan]; !ok {
+		return
+	}
+
 	// Remove the channel from the subscribers
-	delete(subscribers, statusChan)
+	delete(watch.subscribers, statusChan)
 	close(statusChan)
 
 	// If there are no more subscribers, stop watching this container's status
-	if len(subscribers) == 0 {
-		delete(cs.etcdClient.subscriptions, containerID)
+	if len(watch.subscribers) == 0 {
+		watch.cancel()
+		delete(cs.statusWatches, containerID)
 	}
 }
 
-// watchStatus watches the status of a container for changes
-func (cs *ContainerService) watchStatus(containerID string) {
-	ctx := context.Background()
-	watchChan := cs.etcdClient.Watch(ctx, "/namespaces/"+cs.cfg.Namespace+"/containers/"+containerID)
+// watchStatus watches a container and fans out changes to its status, desired status or node until the watch is cancelled.
+// A failed watch is reopened after the last revision seen. If that revision was compacted the changes in between are
+// lost, so every subscriber's channel is closed instead and they subscribe again for the current state.
+func (cs *ContainerService) watchStatus(ctx context.Context, containerID string, startRevision int64, watch *statusWatch) {
+	key := "/namespaces/" + cs.cfg.Namespace + "/containers/" + containerID
+	nextRevision := startRevision
+
+	for ctx.Err() == nil {
+		watchCtx, cancel := context.WithCancel(ctx)
+		for watchResp := range cs.store.Watch(watchCtx, key, WithPrevKV(), WithRev(nextRevision)) {
+			if watchResp.CompactRevision != 0 {
+				log.Printf("Status watch for container %s missed changes, revision %d was compacted", containerID, nextRevision)
+				cancel()
+				cs.closeStatusWatch(containerID, watch)
+				return
+			}
+
+			if watchResp.Err != nil {
+				log.Printf("Status watch for container %s failed: %v", containerID, watchResp.Err)
+				break
+			}
 
-	for watchResp := range watchChan {
-		for _, event := range watchResp.Events {
-			cs.etcdClient.mu.Lock()
-			containerData := string(event.Kv.Value)
-			for subscriberChan := range cs.etcdClient.subscriptions[containerID] {
-				subscriberChan <- containerData
+			for _, watchEvent := range watchResp.Events {
+				nextRevision = watchEvent.Kv.ModRevision + 1
+
+				event, changed := statusEvent(containerID, watchEvent)
+				if !changed {
+					continue
+				}
+
+				cs.mu.Lock()
+				for subscriberChan := range watch.subscribers {
+					// Never block the watch on a slow subscriber
+					select {
+					case subscriberChan <- event:
+					default:
+						log.Printf("Dropped status event for container %s, subscriber is not keeping up", containerID)
+					}
+				}
+				cs.mu.Unlock()
 			}
-			cs.etcdClient.mu.Unlock()
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// closeStatusWatch stops a watch and closes the channel of every subscriber still on it
+func (cs *ContainerService) closeStatusWatch(containerID string, watch *statusWatch) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	watch.cancel()
+	for subscriberChan := range watch.subscribers {
+		close(subscriberChan)
+	}
+	watch.subscribers = nil
+
+	if cs.statusWatches[containerID] == watch {
+		delete(cs.statusWatches, containerID)
+	}
+}
+
+// statusEvent diffs a container write against its previous value, reporting false if nothing subscribers care about changed
+func statusEvent(containerID string, watchEvent WatchEvent) (models.ContainerStatusEvent, bool) {
+	event := models.ContainerStatusEvent{
+		ContainerID: containerID,
+		Revision:    watchEvent.Kv.ModRevision,
+	}
+
+	var previous, current *models.Container
+	if watchEvent.PrevKv != nil && len(watchEvent.PrevKv.Value) > 0 {
+		previous = &models.Container{}
+		if err := json.Unmarshal(watchEvent.PrevKv.Value, previous); err != nil {
+			previous = nil
 		}
 	}
+
+	if watchEvent.Type == EventTypeDelete {
+		event.Type = models.ContainerStatusEventDeleted
+		if previous != nil {
+			event.Status = previous.Status
+			event.DesiredStatus = previous.DesiredStatus
+			event.NodeID = previous.NodeID
+		}
+		return event, true
+	}
+
+	current = &models.Container{}
+	if err := json.Unmarshal(watchEvent.Kv.Value, current); err != nil {
+		log.Printf("Failed to decode container %s: %v", containerID, err)
+		return event, false
+	}
+
+	event.Type = models.ContainerStatusEventChanged
+	event.Status = current.Status
+	event.DesiredStatus = current.DesiredStatus
+	event.NodeID = current.NodeID
+
+	// A container that was just created counts as every field changing
+	if previous == nil || previous.Status != current.Status {
+		event.Changed = append(event.Changed, "status")
+	}
+	if previous == nil || previous.DesiredStatus != current.DesiredStatus {
+		event.Changed = append(event.Changed, "desiredStatus")
+	}
+	if previous == nil || previous.NodeID != current.NodeID {
+		event.Changed = append(event.Changed, "nodeId")
+	}
+
+	return event, len(event.Changed) > 0
 }
@@ -0,0 +1,117 @@
+package controlnode
+
+import (
+	"0xKowalski1/container-orchestrator/models"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type EventHandler struct {
+	EventBus         *EventBus
+	ContainerService *ContainerService
+}
+
+func NewEventHandler(eventBus *EventBus, containerService *ContainerService) *EventHandler {
+	return &EventHandler{
+		EventBus:         eventBus,
+		ContainerService: containerService,
+	}
+}
+
+// RecordEvent handles POST /events
+// Workers record what happened to their containers, e.g. an exit or OOM kill, in the container's history
+func (handler *EventHandler) RecordEvent(c echo.Context) error {
+	var req models.RecordContainerEventRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request"})
+	}
+
+	if req.ContainerID == "" || req.Reason == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "containerId and reason are required"})
+	}
+
+	// The ID is part of the event key, a slash would file the event under another container's history
+	if strings.Contains(req.ContainerID, "/") {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid containerId"})
+	}
+
+	event := models.ContainerEvent{
+		ContainerID: req.ContainerID,
+		Reason:      req.Reason,
+		Message:     req.Message,
+		Source:      req.Source,
+		Time:        req.Time.UTC(),
+	}
+	if err := handler.ContainerService.SaveEvent(event); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusCreated, echo.Map{"success": "true"})
+}
+
+// WatchEvents handles GET /events
+// Streams cluster events as SSE, filtered by ?containerId=, ?nodeId= and ?type= (comma separated).
+// The event id is the etcd revision, it is only set once every event at that revision has been sent so Last-Event-ID resumes without gaps.
+func (handler *EventHandler) WatchEvents(c echo.Context) error {
+	filter := models.ClusterEventFilter{
+		ContainerID: c.QueryParam("containerId"),
+		NodeID:      c.QueryParam("nodeId"),
+	}
+	if types := c.QueryParam("type"); types != "" {
+		filter.Types = strings.Split(types, ",")
+	}
+
+	var fromRevision int64
+	if lastEventID := c.Request().Header.Get("Last-Event-ID"); lastEventID != "" {
+		revision, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid Last-Event-ID"})
+		}
+		fromRevision = revision
+	}
+
+	ctx := c.Request().Context()
+	batches := handler.EventBus.WatchClusterEvents(ctx, fromRevision, filter)
+
+	c.Response().Header().Set("Content-Type", "text/event-stream")
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	c.Response().Header().Set("Connection", "keep-alive")
+	c.Response().WriteHeader(http.StatusOK)
+	c.Response().Flush()
+
+	heartbeatTicker := time.NewTicker(30 * time.Second)
+	defer heartbeatTicker.Stop()
+
+	for {
+		select {
+		case batch, ok := <-batches:
+			if !ok {
+				return nil
+			}
+
+			for i, event := range batch {
+				data, err := json.Marshal(event)
+				if err != nil {
+					return err
+				}
+
+				if i == len(batch)-1 {
+					fmt.Fprintf(c.Response(), "id: %d\n", event.Revision)
+				}
+				fmt.Fprintf(c.Response(), "event: %s\ndata: %s\n\n", event.Type, data)
+			}
+			c.Response().Flush()
+		case <-heartbeatTicker.C:
+			fmt.Fprintf(c.Response(), ":heartbeat\n\n")
+			c.Response().Flush()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
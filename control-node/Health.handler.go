@@ -0,0 +1,43 @@
+package controlnode
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type HealthHandler struct {
+	LeaderElector *LeaderElector
+}
+
+func NewHealthHandler(leaderElector *LeaderElector) *HealthHandler {
+	return &HealthHandler{
+		LeaderElector: leaderElector,
+	}
+}
+
+// Healthz handles GET /healthz
+// Every replica serves the API so this is healthy whether or not it is leader, as long as etcd can be reached.
+func (handler *HealthHandler) Healthz(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), 2*time.Second)
+	defer cancel()
+
+	leaderID, err := handler.LeaderElector.Leader(ctx)
+	if err != nil {
+		return c.JSON(http.StatusServiceUnavailable, echo.Map{
+			"status": "unavailable",
+			"id":     handler.LeaderElector.ID(),
+			"leader": false,
+			"error":  err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"status":   "ok",
+		"id":       handler.LeaderElector.ID(),
+		"leader":   handler.LeaderElector.IsLeader(),
+		"leaderId": leaderID,
+	})
+}
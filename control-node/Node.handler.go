@@ -2,7 +2,14 @@ package controlnode
 
 import (
 	"0xKowalski1/container-orchestrator/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
@@ -47,6 +54,7 @@ func (handler *NodeHandler) GetNode(c echo.Context) error {
 		})
 	}
 
+	setETag(c, node.ResourceVersion)
 	return c.JSON(http.StatusOK, echo.Map{
 		"node": node,
 	})
@@ -60,6 +68,10 @@ func (handler *NodeHandler) JoinCluster(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid node data"})
 	}
 
+	if err := validateTaints(newNode.Taints); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
 	existingNode, err := handler.NodeService.GetNode(newNode.ID)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to check if node exists"})
@@ -70,9 +82,214 @@ func (handler *NodeHandler) JoinCluster(c echo.Context) error {
 	}
 
 	err = handler.NodeService.CreateNode(newNode)
+	if errors.Is(err, ErrConflict) {
+		return c.JSON(http.StatusConflict, echo.Map{"error": "Node already exists"})
+	}
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to add node"})
 	}
 
 	return c.JSON(http.StatusOK, echo.Map{"status": "Node added successfully"})
 }
+
+// UpdateNode handles PATCH /nodes/:id
+func (handler *NodeHandler) UpdateNode(c echo.Context) error {
+	nodeID := c.Param("id")
+	var req models.UpdateNodeRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request"})
+	}
+
+	if err := validateTaints(derefTaints(req.Taints)); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	resourceVersion, err := ifMatchVersion(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	if resourceVersion != 0 {
+		err = handler.NodeService.UpdateNodeIfMatch(nodeID, req, resourceVersion)
+	} else {
+		err = handler.NodeService.UpdateNode(nodeID, req)
+	}
+	if errors.Is(err, ErrNodeNotFound) {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Node not found"})
+	}
+	if errors.Is(err, ErrConflict) {
+		return c.JSON(http.StatusConflict, echo.Map{"error": "Node was modified, fetch it again and retry"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"success": true})
+}
+
+func validateTaints(taints []models.Taint) error {
+	for _, taint := range taints {
+		if taint.Key == "" || (taint.Effect != models.TaintEffectNoSchedule && taint.Effect != models.TaintEffectPreferNoSchedule) {
+			return errors.New("Taints need a key and a NoSchedule or PreferNoSchedule effect")
+		}
+	}
+	return nil
+}
+
+func derefTaints(taints *[]models.Taint) []models.Taint {
+	if taints == nil {
+		return nil
+	}
+	return *taints
+}
+
+// CordonNode handles POST /nodes/:id/cordon
+func (handler *NodeHandler) CordonNode(c echo.Context) error {
+	return handler.setUnschedulable(c, true)
+}
+
+// UncordonNode handles POST /nodes/:id/uncordon
+func (handler *NodeHandler) UncordonNode(c echo.Context) error {
+	return handler.setUnschedulable(c, false)
+}
+
+func (handler *NodeHandler) setUnschedulable(c echo.Context, unschedulable bool) error {
+	nodeID := c.Param("id")
+
+	err := handler.NodeService.SetUnschedulable(nodeID, unschedulable)
+	if errors.Is(err, ErrNodeNotFound) {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Node not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"success": true})
+}
+
+// DrainNode handles POST /nodes/:id/drain
+// Draining waits on every container to stop, so it runs in the background and the request returns straight away.
+func (handler *NodeHandler) DrainNode(c echo.Context) error {
+	nodeID := c.Param("id")
+
+	node, err := handler.NodeService.GetNode(nodeID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Something went wrong."})
+	}
+
+	if node == nil {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Node not found"})
+	}
+
+	go func() {
+		if err := handler.NodeService.DrainNode(context.Background(), nodeID); err != nil {
+			log.Printf("Error draining node %s: %v", nodeID, err)
+			return
+		}
+		log.Printf("Node %s drained", nodeID)
+	}()
+
+	return c.JSON(http.StatusAccepted, echo.Map{"message": "Node draining"})
+}
+
+// DeleteNode handles DELETE /nodes/:id
+// Refuses while containers are bound to the node unless ?force=true, in which case they are rescheduled.
+func (handler *NodeHandler) DeleteNode(c echo.Context) error {
+	nodeID := c.Param("id")
+	force := c.QueryParam("force") == "true"
+
+	err := handler.NodeService.DeleteNode(nodeID, force)
+	if errors.Is(err, ErrNodeNotFound) {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Node not found"})
+	}
+	if errors.Is(err, ErrNodeNotEmpty) {
+		return c.JSON(http.StatusConflict, echo.Map{"error": "Node still has containers, drain it first or force the delete"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"success": true})
+}
+
+// Heartbeat handles POST /nodes/:id/heartbeat
+func (handler *NodeHandler) Heartbeat(c echo.Context) error {
+	nodeID := c.Param("id")
+
+	node, err := handler.NodeService.GetNode(nodeID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Something went wrong."})
+	}
+
+	if node == nil {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Node not found"})
+	}
+
+	if err := handler.NodeService.Heartbeat(nodeID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to record heartbeat"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"success": true})
+}
+
+// WatchNode handles GET /nodes/:id/watch
+// Streams the node's desired state as server sent events, the event id is the etcd revision and can be sent back
+// as Last-Event-ID to resume after a reconnect.
+func (handler *NodeHandler) WatchNode(c echo.Context) error {
+	nodeID := c.Param("id")
+
+	var fromRevision int64
+	if lastEventID := c.Request().Header.Get("Last-Event-ID"); lastEventID != "" {
+		revision, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid Last-Event-ID"})
+		}
+		fromRevision = revision
+	}
+
+	node, err := handler.NodeService.GetNode(nodeID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Something went wrong."})
+	}
+
+	if node == nil {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Node not found"})
+	}
+
+	ctx := c.Request().Context()
+	events, err := handler.NodeService.WatchNode(ctx, nodeID, fromRevision)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to watch node"})
+	}
+
+	c.Response().Header().Set("Content-Type", "text/event-stream")
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	c.Response().Header().Set("Connection", "keep-alive")
+	c.Response().WriteHeader(http.StatusOK)
+	c.Response().Flush()
+
+	heartbeatTicker := time.NewTicker(30 * time.Second)
+	defer heartbeatTicker.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(c.Response(), "id: %d\ndata: %s\n\n", event.Revision, data)
+			c.Response().Flush()
+		case <-heartbeatTicker.C:
+			fmt.Fprintf(c.Response(), ":heartbeat\n\n")
+			c.Response().Flush()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -5,22 +5,31 @@ import (
 	"0xKowalski1/container-orchestrator/models"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"sync"
 	"time"
+)
 
-	clientv3 "go.etcd.io/etcd/client/v3"
+var (
+	ErrNodeNotFound = errors.New("node not found")
+	ErrNodeNotEmpty = errors.New("node still has containers")
 )
 
+// Extra time given to the worker to notice and act on a stop, on top of the container's StopTimeout
+const evictionStopMargin = 30 * time.Second
+
 type NodeService struct {
 	cfg              *config.Config
-	etcdClient       *EtcdClient
+	store            Store
 	containerService *ContainerService
 }
 
-func NewNodeService(cfg *config.Config, etcdClient *EtcdClient, containerService *ContainerService) *NodeService {
+func NewNodeService(cfg *config.Config, store Store, containerService *ContainerService) *NodeService {
 	return &NodeService{
 		cfg:              cfg,
-		etcdClient:       etcdClient,
+		store:            store,
 		containerService: containerService,
 	}
 }
@@ -33,18 +42,230 @@ func (service *NodeService) CreateNode(newNode models.CreateNodeRequest) error {
 		CpuLimit:     newNode.CpuLimit,
 		StorageLimit: newNode.StorageLimit,
 		NodeIp:       newNode.NodeIp,
+		Labels:       newNode.Labels,
+		Taints:       newNode.Taints,
 	}
-	return service.etcdClient.SaveEntity(node)
+
+	// A resource version of 0 only succeeds if the node does not exist yet
+	return updateEntity(context.Background(), service.store, node, 0)
 }
 
 // RemoveNode removes a node from the cluster by its ID
-func (service *NodeService) DeleteNode(nodeID string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// A node with containers bound to it is only removed when forced, its containers are then rescheduled.
+func (service *NodeService) DeleteNode(nodeID string, force bool) error {
+	return retryOnConflict(func() error {
+		node, err := service.GetNode(nodeID)
+		if err != nil {
+			return err
+		}
 
-	key := "/nodes/" + nodeID
-	_, err := service.etcdClient.Delete(ctx, key)
-	return err
+		if node == nil {
+			return ErrNodeNotFound
+		}
+
+		if len(node.Containers) > 0 {
+			if !force {
+				return ErrNodeNotEmpty
+			}
+
+			for _, container := range node.Containers {
+				if err := service.UnassignContainer(context.Background(), container.ID); err != nil {
+					return err
+				}
+			}
+
+			// Unassigning rewrote the node, read it again
+			return ErrConflict
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// Only delete if nothing was assigned to the node since it was read
+		heartbeat := models.NodeHeartbeat{NodeID: nodeID}
+		resp, err := service.store.Txn(ctx,
+			[]Cmp{CompareModRevision(node.Key(), node.ResourceVersion)},
+			[]Op{
+				OpDelete(node.Key()),
+				OpDelete(heartbeat.Key()),
+				OpDelete(heartbeat.LeaseKey()),
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		if !resp.Succeeded {
+			return ErrConflict
+		}
+
+		return nil
+	})
+}
+
+// SetUnschedulable cordons or uncordons a node
+func (service *NodeService) SetUnschedulable(nodeID string, unschedulable bool) error {
+	return retryOnConflict(func() error {
+		return service.updateNode(nodeID, 0, func(node *models.Node) {
+			node.Unschedulable = unschedulable
+		})
+	})
+}
+
+// UpdateNode replaces a node's labels and/or taints, retrying if it is modified concurrently
+func (service *NodeService) UpdateNode(nodeID string, patch models.UpdateNodeRequest) error {
+	return retryOnConflict(func() error {
+		return service.UpdateNodeIfMatch(nodeID, patch, 0)
+	})
+}
+
+// UpdateNodeIfMatch replaces a node's labels and/or taints only if the node is still at resourceVersion.
+// A resource version of 0 applies the patch to whichever version is read.
+func (service *NodeService) UpdateNodeIfMatch(nodeID string, patch models.UpdateNodeRequest, resourceVersion int64) error {
+	return service.updateNode(nodeID, resourceVersion, func(node *models.Node) {
+		if patch.Labels != nil {
+			node.Labels = *patch.Labels
+		}
+		if patch.Taints != nil {
+			node.Taints = *patch.Taints
+		}
+	})
+}
+
+// updateNode reads the node, applies mutate and writes it back, returning ErrConflict if it changed in between
+func (service *NodeService) updateNode(nodeID string, resourceVersion int64, mutate func(node *models.Node)) error {
+	node, err := service.GetNode(nodeID)
+	if err != nil {
+		return err
+	}
+
+	if node == nil {
+		return ErrNodeNotFound
+	}
+
+	if resourceVersion != 0 && node.ResourceVersion != resourceVersion {
+		return ErrConflict
+	}
+
+	mutate(node)
+
+	return updateEntity(context.Background(), service.store, node, node.ResourceVersion)
+}
+
+// DrainNode cordons a node then gracefully stops each of its containers and reschedules them elsewhere
+func (service *NodeService) DrainNode(ctx context.Context, nodeID string) error {
+	if err := service.SetUnschedulable(nodeID, true); err != nil {
+		return err
+	}
+
+	node, err := service.GetNode(nodeID)
+	if err != nil {
+		return err
+	}
+
+	if node == nil {
+		return ErrNodeNotFound
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(node.Containers))
+
+	for i, container := range node.Containers {
+		wg.Add(1)
+		go func(i int, container models.Container) {
+			defer wg.Done()
+			errs[i] = service.EvictContainer(ctx, container)
+		}(i, container)
+	}
+
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// EvictContainer stops a container on its node, waiting up to its StopTimeout, then unbinds it for rescheduling.
+// The container keeps its desired status so it comes back up wherever it is scheduled next.
+// It gives up as soon as ctx is cancelled, leaving the container stopped on its node.
+func (service *NodeService) EvictContainer(ctx context.Context, container models.Container) error {
+	desiredStatus := container.DesiredStatus
+	if container.PreemptedDesiredStatus != "" {
+		desiredStatus = container.PreemptedDesiredStatus // Already stopping for a preemption, it comes back up elsewhere
+	}
+
+	if container.DesiredStatus != "stopped" {
+		stopped := "stopped"
+		if err := service.containerService.UpdateContainer(ctx, container.ID, models.UpdateContainerRequest{DesiredStatus: &stopped}); err != nil {
+			return err
+		}
+
+		deadline := time.Now().Add(time.Duration(container.StopTimeout)*time.Second + evictionStopMargin)
+		for {
+			current, err := service.containerService.GetContainer(container.ID)
+			if err != nil {
+				return err
+			}
+
+			if current.Status == "stopped" {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				log.Printf("Container %s did not stop on node %s in time, evicting anyway", container.ID, container.NodeID)
+				break
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Second):
+			}
+		}
+	}
+
+	if err := service.unassignContainer(ctx, container.ID, models.UpdateContainerRequest{DesiredStatus: &desiredStatus}); err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("Evicted from node %s", container.NodeID)
+	if err := service.containerService.RecordEvent(container.ID, models.EventReasonEvicted, message); err != nil {
+		log.Printf("Failed to record event for container %s: %v", container.ID, err)
+	}
+
+	return nil
+}
+
+// PreemptContainers stops containers on a node in a single transaction, making room for a higher priority container.
+// They stay bound, holding their resources and host ports, until the worker reports them stopped and
+// ReleasePreemptedContainer unbinds them.
+func (service *NodeService) PreemptContainers(ctx context.Context, nodeID string, containerIDs []string) error {
+	return retryOnConflict(func() error {
+		updates := make([]VersionedEntity, 0, len(containerIDs))
+		for _, containerID := range containerIDs {
+			container, err := service.containerService.GetContainer(containerID)
+			if err != nil {
+				return err
+			}
+
+			if container.NodeID != nodeID {
+				return fmt.Errorf("container %s is no longer on node %s", containerID, nodeID)
+			}
+
+			if container.PreemptedDesiredStatus == "" {
+				container.PreemptedDesiredStatus = container.DesiredStatus
+			}
+			container.DesiredStatus = "stopped"
+			updates = append(updates, VersionedEntity{Entity: *container, ResourceVersion: container.ResourceVersion})
+		}
+
+		return updateEntities(ctx, service.store, updates...)
+	})
+}
+
+// ReleasePreemptedContainer unbinds a preempted container and gives it back the desired status it had before it was
+// preempted, so it is scheduled again like any other container
+func (service *NodeService) ReleasePreemptedContainer(ctx context.Context, container models.Container) error {
+	desiredStatus := container.PreemptedDesiredStatus
+	return service.unassignContainer(ctx, container.ID, models.UpdateContainerRequest{DesiredStatus: &desiredStatus})
 }
 
 // GetNode retrieves a node by its ID
@@ -53,7 +274,7 @@ func (service *NodeService) GetNode(nodeID string) (*models.Node, error) {
 	defer cancel()
 
 	key := "/nodes/" + nodeID
-	resp, err := service.etcdClient.Get(ctx, key)
+	resp, err := service.store.Get(ctx, key)
 	if err != nil {
 		return nil, err
 	}
@@ -68,6 +289,8 @@ func (service *NodeService) GetNode(nodeID string) (*models.Node, error) {
 	if err != nil {
 		return nil, err
 	}
+	node.ResourceVersion = resp.Kvs[0].ModRevision
+
 	populatedContainers := make([]models.Container, 0, len(node.Containers))
 	for _, container := range node.Containers {
 		container, err := service.containerService.GetContainer(container.ID)
@@ -85,6 +308,10 @@ func (service *NodeService) GetNode(nodeID string) (*models.Node, error) {
 	node.Containers = populatedContainers
 	fmt.Printf("NodeIP: %s", node.NodeIp)
 
+	if err := service.populateNodeStatus(ctx, &node); err != nil {
+		return nil, err
+	}
+
 	return &node, nil
 }
 
@@ -92,7 +319,7 @@ func (service *NodeService) GetNodes() ([]models.Node, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	resp, err := service.etcdClient.Get(ctx, "/nodes/", clientv3.WithPrefix())
+	resp, err := service.store.Get(ctx, "/nodes/", WithPrefix())
 	if err != nil {
 		return nil, err
 	}
@@ -104,6 +331,7 @@ func (service *NodeService) GetNodes() ([]models.Node, error) {
 			// Handle or log the error
 			continue
 		}
+		node.ResourceVersion = kv.ModRevision
 
 		populatedContainers := make([]models.Container, 0, len(node.Containers))
 		for _, container := range node.Containers {
@@ -121,47 +349,144 @@ func (service *NodeService) GetNodes() ([]models.Node, error) {
 		}
 		node.Containers = populatedContainers
 
+		if err := service.populateNodeStatus(ctx, &node); err != nil {
+			log.Printf("Failed to populate status for node %s: %v", node.ID, err)
+			node.Status = models.NodeStatusUnknown
+		}
+
 		nodes = append(nodes, node)
 	}
 
 	return nodes, nil
 }
 
-func (service *NodeService) AssignContainerToNode(containerID, nodeID string) error {
-	node, err := service.GetNode(nodeID)
+// populateNodeStatus derives the node's status from its heartbeat lease and record
+func (service *NodeService) populateNodeStatus(ctx context.Context, node *models.Node) error {
+	heartbeat := models.NodeHeartbeat{NodeID: node.ID}
+
+	resp, err := service.store.Txn(ctx, nil, []Op{
+		OpGet(heartbeat.Key()),
+		OpGet(heartbeat.LeaseKey(), WithCountOnly()),
+	})
 	if err != nil {
 		return err
 	}
 
-	container, err := service.containerService.GetContainer(containerID)
+	recordResp := resp.Responses[0]
+	leaseResp := resp.Responses[1]
 
-	if err != nil {
-		return err
+	if len(recordResp.Kvs) == 0 {
+		node.Status = models.NodeStatusUnknown
+		return nil
 	}
 
-	containerPatch := models.UpdateContainerRequest{NodeID: &nodeID}
-	if err := service.containerService.UpdateContainer(containerID, containerPatch); err != nil {
+	if err := json.Unmarshal(recordResp.Kvs[0].Value, &heartbeat); err != nil {
 		return err
 	}
+	node.LastHeartbeat = heartbeat.Time
 
-	node.Containers = append(node.Containers, models.Container{ID: container.ID, NamespaceID: container.NamespaceID}) // Other data is fetched in getNodes/listNodes
+	if leaseResp.Count > 0 {
+		node.Status = models.NodeStatusReady
+	} else {
+		node.Status = models.NodeStatusNotReady
+	}
 
-	return service.etcdClient.SaveEntity(node)
+	return nil
 }
 
-func (service *NodeService) RemoveContainerFromNode(containerID string) error {
-	container, err := service.containerService.GetContainer(containerID)
+// Heartbeat records that a node is alive and renews its lease, the node becomes NotReady once the lease expires
+func (service *NodeService) Heartbeat(nodeID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	heartbeat := models.NodeHeartbeat{NodeID: nodeID, Time: time.Now().UTC()}
+
+	// Reuse the existing lease while it is still alive so we are not granting a new lease every heartbeat
+	var leaseID int64
+	resp, err := service.store.Get(ctx, heartbeat.LeaseKey())
 	if err != nil {
 		return err
 	}
+	if len(resp.Kvs) > 0 && resp.Kvs[0].Lease != 0 {
+		if err := service.store.KeepAliveOnce(ctx, resp.Kvs[0].Lease); err == nil {
+			leaseID = resp.Kvs[0].Lease
+		}
+	}
 
-	nodeID := container.NodeID
+	if leaseID == 0 {
+		leaseID, err = service.store.Grant(ctx, int64(service.cfg.NodeHeartbeatTimeout))
+		if err != nil {
+			return err
+		}
+	}
 
-	node, err := service.GetNode(nodeID)
+	value, err := heartbeat.Value()
 	if err != nil {
 		return err
 	}
 
+	_, err = service.store.Txn(ctx, nil, []Op{
+		OpPut(heartbeat.Key(), value),
+		OpPut(heartbeat.LeaseKey(), value, WithLease(leaseID)),
+	})
+	return err
+}
+
+// ErrHostPortInUse is returned when a container is assigned host ports another container on the node already has
+var ErrHostPortInUse = errors.New("host port already in use")
+
+// AssignContainerToNode binds a container to a node along with its resolved host ports.
+// The container and node are written in a single transaction so the port allocation lands with the binding.
+// The ports are checked against the node as read in the transaction and the write only succeeds if the node has not
+// changed since, so two schedulers can never hand out the same port even if they allocated from a stale view.
+func (service *NodeService) AssignContainerToNode(ctx context.Context, containerID, nodeID string, ports []models.Port) error {
+	return retryOnConflict(func() error {
+		node, err := service.GetNode(nodeID)
+		if err != nil {
+			return err
+		}
+
+		if node == nil {
+			return ErrNodeNotFound
+		}
+
+		container, err := service.containerService.GetContainer(containerID)
+
+		if err != nil {
+			return err
+		}
+
+		if container.NodeID != "" && container.NodeID != nodeID {
+			return fmt.Errorf("container %s is already assigned to node %s", containerID, container.NodeID)
+		}
+
+		// Reassigning to the same node must not collide with the container's own ports
+		usedPorts := usedHostPorts(withoutContainers(*node, []models.Container{*container}))
+		for _, port := range ports {
+			if usedPorts[hostPortKey{port.Protocol, port.HostPort}] {
+				return fmt.Errorf("%w: %s port %d on node %s", ErrHostPortInUse, port.Protocol, port.HostPort, nodeID)
+			}
+		}
+
+		container.Ports = ports
+		container.SchedulingMessage = ""
+
+		// Reassigning to the same node only updates the ports
+		if container.NodeID != nodeID {
+			node.Containers = append(node.Containers, models.Container{ID: container.ID, NamespaceID: container.NamespaceID}) // Other data is fetched in getNodes/listNodes
+		}
+
+		container.NodeID = nodeID
+
+		return updateEntities(ctx, service.store,
+			VersionedEntity{Entity: *container, ResourceVersion: container.ResourceVersion},
+			VersionedEntity{Entity: node, ResourceVersion: node.ResourceVersion},
+		)
+	})
+}
+
+// removeContainer drops the container from the node's list, reporting whether it was there
+func removeContainer(node *models.Node, containerID string) bool {
 	// Check if the container is indeed assigned to this node and get its index
 	containerIndex := -1
 	for i, container := range node.Containers {
@@ -171,13 +496,178 @@ func (service *NodeService) RemoveContainerFromNode(containerID string) error {
 		}
 	}
 
-	// If the container wasn't found on the node, return an error
 	if containerIndex == -1 {
-		return fmt.Errorf("container %s not found on node %s", containerID, nodeID)
+		return false
 	}
 
 	node.Containers[containerIndex] = node.Containers[len(node.Containers)-1]
 	node.Containers = node.Containers[:len(node.Containers)-1]
 
-	return service.etcdClient.SaveEntity(node)
+	return true
+}
+
+// WatchNode streams the desired state of a node whenever the node or any container bound to it changes.
+// Passing a non zero fromRevision resumes the watch after that etcd revision so no change is missed across reconnects.
+func (service *NodeService) WatchNode(ctx context.Context, nodeID string, fromRevision int64) (<-chan models.NodeWatchEvent, error) {
+	nodeKey := "/nodes/" + nodeID
+	containersPrefix := "/namespaces/" + service.cfg.Namespace + "/containers/"
+
+	startRevision := fromRevision + 1
+	if fromRevision == 0 {
+		getCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		resp, err := service.store.Get(getCtx, nodeKey)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		startRevision = resp.Revision + 1
+	}
+
+	watchCtx, cancelWatch := context.WithCancel(ctx)
+	nodeWatch := service.store.Watch(watchCtx, nodeKey, WithRev(startRevision), WithProgressNotify())
+	containerWatch := service.store.Watch(watchCtx, containersPrefix, WithPrefix(), WithPrevKV(), WithRev(startRevision), WithProgressNotify())
+
+	events := make(chan models.NodeWatchEvent)
+
+	go func() {
+		defer cancelWatch()
+		defer close(events)
+
+		// Each watch progresses independently, so only the lowest revision seen by both is safe to resume from.
+		nodeRevision, containerRevision := startRevision-1, startRevision-1
+
+		send := func(revision int64) bool {
+			node, err := service.GetNode(nodeID)
+			if err != nil || node == nil {
+				log.Printf("Failed to get node %s for watch: %v", nodeID, err)
+				return false
+			}
+
+			select {
+			case events <- models.NodeWatchEvent{Revision: revision, Node: *node}:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		// Always start with the current state, a resumed watcher may have missed the final state before disconnecting.
+		if !send(startRevision - 1) {
+			return
+		}
+
+		progressTicker := time.NewTicker(30 * time.Second)
+		defer progressTicker.Stop()
+
+		for {
+			var watchResp WatchResponse
+			var ok bool
+
+			select {
+			case watchResp, ok = <-nodeWatch:
+				if ok {
+					nodeRevision = watchResp.Revision
+				}
+			case watchResp, ok = <-containerWatch:
+				if ok {
+					containerRevision = watchResp.Revision
+				}
+			case <-progressTicker.C:
+				// Keeps quiet watches moving forward so the resume revision does not lag behind
+				if err := service.store.RequestProgress(watchCtx); err != nil {
+					log.Printf("Failed to request watch progress for node %s: %v", nodeID, err)
+				}
+				continue
+			case <-ctx.Done():
+				return
+			}
+
+			if !ok {
+				return
+			}
+
+			if watchResp.CompactRevision != 0 {
+				// The requested revision has been compacted away, hand back the latest state and let the client reconnect from here
+				send(watchResp.Revision)
+				return
+			}
+
+			if err := watchResp.Err; err != nil {
+				log.Printf("Watch for node %s failed: %v", nodeID, err)
+				return
+			}
+
+			relevant := false
+			for _, event := range watchResp.Events {
+				if event.Kv.Key == nodeKey || service.isContainerEventForNode(event, nodeID) {
+					relevant = true
+					break
+				}
+			}
+
+			if relevant && !send(min(nodeRevision, containerRevision)) {
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// isContainerEventForNode reports whether a container watch event concerns a container bound, or previously bound, to the node.
+func (service *NodeService) isContainerEventForNode(event WatchEvent, nodeID string) bool {
+	for _, kv := range []*KeyValue{&event.Kv, event.PrevKv} {
+		if kv == nil || len(kv.Value) == 0 {
+			continue
+		}
+
+		var container models.Container
+		if err := json.Unmarshal(kv.Value, &container); err != nil {
+			continue
+		}
+
+		if container.NodeID == nodeID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UnassignContainer unbinds a container from its node so the schedular places it again
+func (service *NodeService) UnassignContainer(ctx context.Context, containerID string) error {
+	return service.unassignContainer(ctx, containerID, models.UpdateContainerRequest{})
+}
+
+// unassignContainer unbinds a container, applying any extra patch in the same transaction
+func (service *NodeService) unassignContainer(ctx context.Context, containerID string, containerPatch models.UpdateContainerRequest) error {
+	nodeID := ""
+	status := ""
+	containerPatch.NodeID = &nodeID
+	containerPatch.Status = &status
+
+	return retryOnConflict(func() error {
+		container, err := service.containerService.GetContainer(containerID)
+		if err != nil {
+			return err
+		}
+
+		updates := []VersionedEntity{}
+
+		if container.NodeID != "" {
+			node, err := service.GetNode(container.NodeID)
+			if err != nil {
+				return err
+			}
+
+			if node != nil && removeContainer(node, containerID) {
+				updates = append(updates, VersionedEntity{Entity: node, ResourceVersion: node.ResourceVersion})
+			}
+		}
+
+		applyContainerPatch(container, containerPatch)
+		updates = append(updates, VersionedEntity{Entity: *container, ResourceVersion: container.ResourceVersion})
+
+		return updateEntities(ctx, service.store, updates...)
+	})
 }
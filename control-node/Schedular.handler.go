@@ -0,0 +1,56 @@
+package controlnode
+
+import (
+	"0xKowalski1/container-orchestrator/models"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type SchedularHandler struct {
+	Schedular        *Schedular
+	ContainerService *ContainerService
+}
+
+func NewSchedularHandler(schedular *Schedular, containerService *ContainerService) *SchedularHandler {
+	return &SchedularHandler{
+		Schedular:        schedular,
+		ContainerService: containerService,
+	}
+}
+
+// Simulate handles POST /scheduler/simulate
+// Takes either an existing container ID or a container request and explains where it would be scheduled.
+func (handler *SchedularHandler) Simulate(c echo.Context) error {
+	var req models.SimulateSchedulingRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request"})
+	}
+
+	var container models.Container
+	switch {
+	case req.ContainerID != "":
+		existing, err := handler.ContainerService.GetContainer(req.ContainerID)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, echo.Map{"error": "Container not found"})
+		}
+		container = *existing
+	case req.Container != nil:
+		if req.Container.SchedulingStrategy != "" && ValidateSchedulingStrategy(req.Container.SchedulingStrategy) != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": fmt.Sprintf("Unknown scheduling strategy %q", req.Container.SchedulingStrategy)})
+		}
+		container = handler.ContainerService.NewContainer(*req.Container)
+	default:
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Either containerId or container is required"})
+	}
+
+	simulation, err := handler.Schedular.Simulate(container)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"simulation": simulation,
+	})
+}
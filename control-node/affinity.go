@@ -0,0 +1,214 @@
+package controlnode
+
+import (
+	"0xKowalski1/container-orchestrator/models"
+	"fmt"
+	"slices"
+)
+
+func (s *Schedular) doesNodeMatchSelector(container models.Container, node models.Node) error {
+	for key, value := range container.NodeSelector {
+		if node.Labels[key] != value {
+			return fmt.Errorf("node label %s is not %q", key, value)
+		}
+	}
+	return nil
+}
+
+func (s *Schedular) doesNodeMatchAffinity(container models.Container, node models.Node) error {
+	if container.NodeAffinity == nil || len(container.NodeAffinity.Required) == 0 {
+		return nil
+	}
+
+	for _, term := range container.NodeAffinity.Required {
+		if matchesNodeSelectorTerm(term, node.Labels) {
+			return nil
+		}
+	}
+	return fmt.Errorf("node labels match none of the required affinity terms")
+}
+
+func (s *Schedular) doesContainerTolerateTaints(container models.Container, node models.Node) error {
+	for _, taint := range node.Taints {
+		if taint.Effect == models.TaintEffectNoSchedule && !toleratesTaint(container.Tolerations, taint) {
+			return fmt.Errorf("untolerated taint %s=%s:%s", taint.Key, taint.Value, taint.Effect)
+		}
+	}
+	return nil
+}
+
+// preferenceScore rewards nodes matching the container's preferred affinity and penalises untolerated
+// PreferNoSchedule taints, both from 0 to 1 so neither outweighs the strategy score on its own.
+func (s *Schedular) preferenceScore(container models.Container, node models.Node) float64 {
+	score := 0.0
+
+	if container.NodeAffinity != nil {
+		totalWeight, matchedWeight := 0, 0
+		for _, preferred := range container.NodeAffinity.Preferred {
+			totalWeight += preferred.Weight
+			if matchesNodeSelectorTerm(preferred.Preference, node.Labels) {
+				matchedWeight += preferred.Weight
+			}
+		}
+		if totalWeight > 0 {
+			score += float64(matchedWeight) / float64(totalWeight)
+		}
+	}
+
+	preferNoSchedule, untolerated := 0, 0
+	for _, taint := range node.Taints {
+		if taint.Effect != models.TaintEffectPreferNoSchedule {
+			continue
+		}
+		preferNoSchedule++
+		if !toleratesTaint(container.Tolerations, taint) {
+			untolerated++
+		}
+	}
+	if preferNoSchedule > 0 {
+		score -= float64(untolerated) / float64(preferNoSchedule)
+	}
+
+	return score
+}
+
+func matchesNodeSelectorTerm(term models.NodeSelectorTerm, labels map[string]string) bool {
+	for _, requirement := range term.MatchExpressions {
+		value, exists := labels[requirement.Key]
+
+		switch requirement.Operator {
+		case models.SelectorOpIn:
+			if !exists || !slices.Contains(requirement.Values, value) {
+				return false
+			}
+		case models.SelectorOpNotIn:
+			if exists && slices.Contains(requirement.Values, value) {
+				return false
+			}
+		case models.SelectorOpExists:
+			if !exists {
+				return false
+			}
+		case models.SelectorOpDoesNotExist:
+			if exists {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func toleratesTaint(tolerations []models.Toleration, taint models.Taint) bool {
+	for _, toleration := range tolerations {
+		if toleration.Effect != "" && toleration.Effect != taint.Effect {
+			continue
+		}
+
+		if toleration.Operator == models.TolerationOpExists {
+			if toleration.Key == "" || toleration.Key == taint.Key {
+				return true
+			}
+			continue
+		}
+
+		if toleration.Key == taint.Key && toleration.Value == taint.Value {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schedular) doesNodeSatisfyAntiAffinity(container models.Container, node models.Node) error {
+	for _, rule := range container.AntiAffinity {
+		selector := selectorOrOwnLabels(rule.LabelSelector, container)
+		if len(selector) == 0 {
+			continue
+		}
+
+		for _, c := range node.Containers {
+			if c.ID != container.ID && matchesLabels(selector, c.Labels) {
+				return fmt.Errorf("node already runs container %s matching anti-affinity", c.ID)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schedular) doesNodeSatisfyTopologySpread(container models.Container, node models.Node, nodes []models.Node) error {
+	for _, constraint := range container.TopologySpread {
+		selector := selectorOrOwnLabels(constraint.LabelSelector, container)
+		if len(selector) == 0 {
+			continue
+		}
+
+		domain, ok := node.Labels[constraint.TopologyKey]
+		if !ok {
+			return fmt.Errorf("node has no %s label", constraint.TopologyKey)
+		}
+
+		// Count matching containers in every domain. Only domains with a node the container could use take part in
+		// the minimum, an empty domain on nodes it can never run on would otherwise hold the minimum at 0 and refuse
+		// it everywhere once the rest reach maxSkew.
+		counts := make(map[string]int)
+		domains := make(map[string]bool)
+		for _, n := range nodes {
+			nodeDomain, ok := n.Labels[constraint.TopologyKey]
+			if !ok {
+				continue
+			}
+
+			if s.canNodeJoinSpread(container, n) {
+				domains[nodeDomain] = true
+			}
+			for _, c := range n.Containers {
+				if c.ID != container.ID && matchesLabels(selector, c.Labels) {
+					counts[nodeDomain]++
+				}
+			}
+		}
+
+		minCount := -1
+		for nodeDomain := range domains {
+			if minCount == -1 || counts[nodeDomain] < minCount {
+				minCount = counts[nodeDomain]
+			}
+		}
+		minCount = max(minCount, 0)
+
+		maxSkew := max(constraint.MaxSkew, 1)
+		if skew := counts[domain] + 1 - minCount; skew > maxSkew {
+			return fmt.Errorf("placing in %s=%s would skew the spread to %d, max is %d", constraint.TopologyKey, domain, skew, maxSkew)
+		}
+	}
+	return nil
+}
+
+// canNodeJoinSpread reports whether a node's domain counts towards topology spread, the node must be one the container
+// could be placed on if it had room
+func (s *Schedular) canNodeJoinSpread(container models.Container, node models.Node) bool {
+	return s.isNodeReady(container, node) == nil &&
+		s.isNodeSchedulable(container, node) == nil &&
+		s.doesNodeMatchSelector(container, node) == nil &&
+		s.doesNodeMatchAffinity(container, node) == nil &&
+		s.doesContainerTolerateTaints(container, node) == nil
+}
+
+// selectorOrOwnLabels falls back to the container's own labels, so rules without a selector apply to its siblings
+func selectorOrOwnLabels(selector map[string]string, container models.Container) map[string]string {
+	if len(selector) > 0 {
+		return selector
+	}
+	return container.Labels
+}
+
+// matchesLabels reports whether labels contain every key and value in the selector
+func matchesLabels(selector, labels map[string]string) bool {
+	for key, value := range selector {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
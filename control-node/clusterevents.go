@@ -0,0 +1,320 @@
+package controlnode
+
+import (
+	"0xKowalski1/container-orchestrator/models"
+	"context"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clusterEventHistory is how many cluster events are kept for clients resuming with Last-Event-ID, a client that was
+// gone for longer is sent a Resync
+const clusterEventHistory = 1000
+
+// clusterFeed fans the cluster events from the bus' watches out to every client, keeping the latest to replay
+type clusterFeed struct {
+	mu          sync.Mutex
+	history     []models.ClusterEvent // Every event after start, in revision order
+	start       int64                 // History is complete from the revision after this one
+	subscribers map[*clusterSubscriber]struct{}
+}
+
+// clusterSubscriber queues events for a client. Pending only ever holds whole revisions, so every batch sent
+// is complete up to the revision of its last event.
+type clusterSubscriber struct {
+	filter  models.ClusterEventFilter
+	after   int64 // The client has everything up to this revision
+	pending []models.ClusterEvent
+	notify  chan struct{}
+}
+
+// WatchClusterEvents streams cluster events matching the filter in batches until ctx is cancelled.
+// Passing a non zero fromRevision replays the events after it, or sends a Resync first if they are no longer kept.
+// Every batch is complete up to the revision of its last event, so that is the revision to resume from.
+func (bus *EventBus) WatchClusterEvents(ctx context.Context, fromRevision int64, filter models.ClusterEventFilter) <-chan []models.ClusterEvent {
+	feed := &bus.cluster
+	sub := &clusterSubscriber{
+		filter: filter,
+		after:  fromRevision,
+		notify: make(chan struct{}, 1),
+	}
+
+	// Replaying and subscribing under one lock means no event is missed or sent twice in between
+	feed.mu.Lock()
+	if fromRevision != 0 {
+		if fromRevision < feed.start {
+			sub.pending = append(sub.pending, models.ClusterEvent{Type: models.ClusterEventResync, Revision: feed.start})
+		}
+		for _, event := range feed.history {
+			if event.Revision > fromRevision && filter.Matches(event) {
+				sub.pending = append(sub.pending, event)
+			}
+		}
+	}
+	feed.subscribers[sub] = struct{}{}
+	feed.mu.Unlock()
+
+	batches := make(chan []models.ClusterEvent)
+
+	go func() {
+		defer close(batches)
+		defer func() {
+			feed.mu.Lock()
+			delete(feed.subscribers, sub)
+			feed.mu.Unlock()
+		}()
+
+		for {
+			feed.mu.Lock()
+			batch := sub.pending
+			sub.pending = nil
+			feed.mu.Unlock()
+
+			if len(batch) > 0 {
+				select {
+				case batches <- batch:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-sub.notify:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return batches
+}
+
+// publish adds the events of one revision range to the history and queues them for every matching client
+func (feed *clusterFeed) publish(events []models.ClusterEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	feed.history = append(feed.history, events...)
+	if over := len(feed.history) - clusterEventHistory; over > 0 {
+		// Only drop whole revisions, a partly kept revision cannot be resumed from
+		feed.start = feed.history[over-1].Revision
+		for over < len(feed.history) && feed.history[over].Revision <= feed.start {
+			over++
+		}
+		feed.history = feed.history[over:]
+	}
+
+	revision := events[len(events)-1].Revision
+	for sub := range feed.subscribers {
+		queued := len(sub.pending)
+		for _, event := range events {
+			if event.Revision > sub.after && sub.filter.Matches(event) {
+				sub.pending = append(sub.pending, event)
+			}
+		}
+
+		// A client that stopped reading would otherwise hold every event since in memory
+		if len(sub.pending) > SubscriberQueueLimit {
+			log.Printf("Cluster event client fell %d events behind at revision %d, sending a resync", len(sub.pending), revision)
+			sub.pending = []models.ClusterEvent{{Type: models.ClusterEventResync, Revision: revision}}
+		} else if len(sub.pending) == queued {
+			continue
+		}
+
+		select {
+		case sub.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// reset forgets the history when the watch missed events, every client is sent a Resync
+func (feed *clusterFeed) reset(revision int64) {
+	feed.mu.Lock()
+	feed.history = nil
+	feed.start = revision
+	feed.mu.Unlock()
+
+	feed.publish([]models.ClusterEvent{{Type: models.ClusterEventResync, Revision: revision}})
+}
+
+// watchCluster publishes cluster events from startRevision until ctx is cancelled, rewatching from where it left off
+// if a watch fails. The watches are shared by every client.
+func (bus *EventBus) watchCluster(ctx context.Context, startRevision int64) {
+	nextRevision := startRevision
+	for ctx.Err() == nil {
+		nextRevision = bus.watchClusterFrom(ctx, nextRevision)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// watchClusterFrom watches nodes, containers and node leases from startRevision, returning the revision to rewatch
+// from once a watch fails. Only the prefixes cluster events come from are watched, one watch each, so events are held
+// back until every watch has passed their revision and published in revision order, which resuming relies on.
+func (bus *EventBus) watchClusterFrom(ctx context.Context, startRevision int64) int64 {
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	prefixes := bus.prefixes()
+	watches := []WatchChan{
+		bus.store.Watch(watchCtx, prefixes[0], WithPrefix(), WithPrevKV(), WithRev(startRevision), WithProgressNotify()),
+		bus.store.Watch(watchCtx, prefixes[1], WithPrefix(), WithPrevKV(), WithRev(startRevision), WithProgressNotify()),
+		// Only a lease being created or deleted is an event, renewals carry nothing worth the previous value
+		bus.store.Watch(watchCtx, models.NodeHeartbeat{}.LeaseKey(), WithPrefix(), WithRev(startRevision), WithProgressNotify()),
+	}
+
+	progress := make([]int64, len(watches)) // Every change up to this revision has been received from the watch
+	for i := range progress {
+		progress[i] = startRevision - 1
+	}
+	var pending []WatchEvent // Received but not yet known to be in order
+
+	progressTicker := time.NewTicker(time.Second)
+	defer progressTicker.Stop()
+
+	for {
+		var watchResp WatchResponse
+		var ok bool
+		var watch int
+
+		select {
+		case watchResp, ok = <-watches[0]:
+			watch = 0
+		case watchResp, ok = <-watches[1]:
+			watch = 1
+		case watchResp, ok = <-watches[2]:
+			watch = 2
+		case <-progressTicker.C:
+			// Moves quiet watches past the events held back
+			if len(pending) > 0 {
+				if err := bus.store.RequestProgress(watchCtx); err != nil {
+					log.Printf("Failed to request cluster event watch progress: %v", err)
+				}
+			}
+			continue
+		case <-ctx.Done():
+			return slices.Min(progress) + 1
+		}
+
+		if !ok {
+			return slices.Min(progress) + 1
+		}
+
+		if watchResp.CompactRevision != 0 {
+			log.Printf("Cluster event watch missed changes, revision %d was compacted", slices.Min(progress)+1)
+			bus.cluster.reset(watchResp.CompactRevision - 1)
+			return watchResp.CompactRevision
+		}
+
+		if err := watchResp.Err; err != nil {
+			log.Printf("Cluster event watch failed: %v", err)
+			return slices.Min(progress) + 1
+		}
+
+		pending = append(pending, watchResp.Events...)
+		progress[watch] = max(progress[watch], watchResp.Revision)
+		if len(watchResp.Events) > 0 {
+			progress[watch] = max(progress[watch], watchResp.Events[len(watchResp.Events)-1].Kv.ModRevision)
+		}
+
+		// Publish everything every watch has reached, the rest waits for the others to catch up
+		safe := slices.Min(progress)
+		sort.SliceStable(pending, func(i, j int) bool {
+			return pending[i].Kv.ModRevision < pending[j].Kv.ModRevision
+		})
+		ready := sort.Search(len(pending), func(i int) bool {
+			return pending[i].Kv.ModRevision > safe
+		})
+
+		var events []models.ClusterEvent
+		for _, watchEvent := range pending[:ready] {
+			events = append(events, bus.clusterEvents(watchEvent)...)
+		}
+		bus.cluster.publish(events)
+		pending = slices.Clone(pending[ready:])
+
+		if len(pending) > 0 {
+			if err := bus.store.RequestProgress(watchCtx); err != nil {
+				log.Printf("Failed to request cluster event watch progress: %v", err)
+			}
+		}
+	}
+}
+
+// clusterEvents translates a raw store change into the cluster events clients care about, a change can be several
+// events at once or none at all
+func (bus *EventBus) clusterEvents(watchEvent WatchEvent) []models.ClusterEvent {
+	revision := watchEvent.Kv.ModRevision
+
+	leasesPrefix := models.NodeHeartbeat{}.LeaseKey()
+	if strings.HasPrefix(watchEvent.Kv.Key, leasesPrefix) {
+		nodeID := strings.TrimPrefix(watchEvent.Kv.Key, leasesPrefix)
+		switch {
+		case watchEvent.Type == EventTypeDelete:
+			return []models.ClusterEvent{{Type: models.ClusterEventNodeLost, Revision: revision, NodeID: nodeID}}
+		case watchEvent.IsCreate():
+			return []models.ClusterEvent{{Type: models.ClusterEventNodeReady, Revision: revision, NodeID: nodeID}}
+		}
+		return nil // Lease renewal
+	}
+
+	event, ok := bus.decodeEvent(watchEvent)
+	if !ok {
+		return nil
+	}
+
+	switch event.Type {
+	case NodeAdded:
+		return []models.ClusterEvent{{Type: models.ClusterEventNodeJoined, Revision: revision, NodeID: event.Node.ID, Node: event.Node}}
+	case NodeRemoved:
+		return []models.ClusterEvent{{Type: models.ClusterEventNodeRemoved, Revision: revision, NodeID: event.OldNode.ID, Node: event.OldNode}}
+	case ContainerAdded:
+		return []models.ClusterEvent{containerClusterEvent(models.ClusterEventContainerCreated, revision, event.Container, nil)}
+	case ContainerRemoved:
+		return []models.ClusterEvent{containerClusterEvent(models.ClusterEventContainerDeleted, revision, event.OldContainer, nil)}
+	case ContainerUpdated:
+		previous, current := event.OldContainer, event.Container
+		if previous == nil {
+			return nil
+		}
+
+		var events []models.ClusterEvent
+		if previous.NodeID != current.NodeID {
+			if previous.NodeID != "" {
+				events = append(events, containerClusterEvent(models.ClusterEventContainerUnscheduled, revision, current, previous))
+			}
+			if current.NodeID != "" {
+				events = append(events, containerClusterEvent(models.ClusterEventContainerScheduled, revision, current, previous))
+			}
+		}
+		if previous.Status != current.Status || previous.DesiredStatus != current.DesiredStatus {
+			events = append(events, containerClusterEvent(models.ClusterEventContainerStatusChanged, revision, current, previous))
+		}
+		return events
+	}
+
+	return nil
+}
+
+func containerClusterEvent(eventType string, revision int64, container, previous *models.Container) models.ClusterEvent {
+	return models.ClusterEvent{
+		Type:        eventType,
+		Revision:    revision,
+		ContainerID: container.ID,
+		NodeID:      container.NodeID,
+		Container:   container,
+		Previous:    previous,
+	}
+}
@@ -2,84 +2,285 @@ package controlnode
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"sync"
+	"log"
+	"os"
 	"time"
 
+	"0xKowalski1/container-orchestrator/config"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
+// EtcdClient is the etcd backed Store
 type EtcdClient struct {
-	*clientv3.Client
-	listeners     []Listener
-	subscriptions map[string]map[chan string]struct{} // ContainerID -> Set of Subscriber Channels
-	mu            sync.Mutex
+	Client *clientv3.Client
+}
+
+const (
+	etcdConnectMinBackoff = time.Second
+	etcdConnectMaxBackoff = 30 * time.Second
+)
+
+// ConnectEtcd connects to etcd, retrying with exponential backoff until it succeeds or ctx is cancelled.
+// Misconfigured TLS files are not retried since they will never succeed.
+func ConnectEtcd(ctx context.Context, cfg config.EtcdConfig) (*EtcdClient, error) {
+	tlsConfig, err := etcdTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	backoff := etcdConnectMinBackoff
+	for {
+		client, err := NewEtcdClient(ctx, cfg, tlsConfig)
+		if err == nil {
+			return client, nil
+		}
+
+		log.Printf("Failed to connect to etcd at %v, retrying in %s: %v", cfg.Endpoints, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, etcdConnectMaxBackoff)
+	}
 }
 
-func NewEtcdClient() (*EtcdClient, error) {
+// NewEtcdClient makes a single attempt to connect to etcd, checking that at least one endpoint answers
+func NewEtcdClient(ctx context.Context, cfg config.EtcdConfig, tlsConfig *tls.Config) (*EtcdClient, error) {
+	dialTimeout := time.Duration(cfg.DialTimeout) * time.Second
+
 	client, err := clientv3.New(clientv3.Config{
-		Endpoints:   []string{"localhost:2379"},
-		DialTimeout: 5 * time.Second,
+		Endpoints:   cfg.Endpoints,
+		DialTimeout: dialTimeout,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+		TLS:         tlsConfig,
+		Context:     ctx,
 	})
-
 	if err != nil {
 		return nil, fmt.Errorf("Failed to connect to etcd: %v", err)
 	}
 
-	return &EtcdClient{Client: client}, nil
-}
+	// The client dials lazily, so ask for a status to find out if etcd is actually reachable
+	var statusErr error
+	for _, endpoint := range cfg.Endpoints {
+		statusCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+		_, statusErr = client.Status(statusCtx, endpoint)
+		cancel()
+
+		if statusErr == nil {
+			return &EtcdClient{Client: client}, nil
+		}
+	}
 
-// All Storable models will implement this interface
-type Storable interface {
-	Key() string            // Generates a unique etcd key for the entity.
-	Value() (string, error) // Serializes the entity to a string for storage.
+	client.Close()
+	return nil, fmt.Errorf("Failed to reach etcd: %v", statusErr)
 }
 
-func (ec *EtcdClient) SaveEntity(entity Storable) error {
-	key := entity.Key()
+// etcdTLSConfig builds the client TLS config from the configured files, nil if TLS is not configured
+func etcdTLSConfig(cfg config.EtcdConfig) (*tls.Config, error) {
+	if !cfg.TLSEnabled() {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load etcd client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.CAFile != "" {
+		caPEM, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read etcd CA file: %v", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("No certificates found in etcd CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
 
-	valueStr, err := entity.Value()
+func (ec *EtcdClient) Get(ctx context.Context, key string, opts ...OpOption) (*GetResponse, error) {
+	resp, err := ec.Client.Get(ctx, key, newOpOptions(opts).etcd()...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	return fromEtcdRange(resp), nil
+}
+
+func (ec *EtcdClient) Put(ctx context.Context, key, value string, opts ...OpOption) error {
+	_, err := ec.Client.Put(ctx, key, value, newOpOptions(opts).etcd()...)
+	return fromEtcdErr(err)
+}
 
-	_, err = ec.Put(ctx, key, valueStr)
+func (ec *EtcdClient) Delete(ctx context.Context, key string, opts ...OpOption) error {
+	_, err := ec.Client.Delete(ctx, key, newOpOptions(opts).etcd()...)
 	return err
 }
 
-func (ec *EtcdClient) Close() error {
-	return ec.Client.Close()
+func (ec *EtcdClient) Txn(ctx context.Context, cmps []Cmp, ops []Op) (*TxnResponse, error) {
+	etcdCmps := make([]clientv3.Cmp, 0, len(cmps))
+	for _, cmp := range cmps {
+		etcdCmps = append(etcdCmps, clientv3.Compare(clientv3.ModRevision(cmp.Key), "=", cmp.ModRevision))
+	}
+
+	etcdOps := make([]clientv3.Op, 0, len(ops))
+	for _, op := range ops {
+		switch op.Type {
+		case OpTypeGet:
+			etcdOps = append(etcdOps, clientv3.OpGet(op.Key, op.options.etcd()...))
+		case OpTypePut:
+			etcdOps = append(etcdOps, clientv3.OpPut(op.Key, op.Value, op.options.etcd()...))
+		case OpTypeDelete:
+			etcdOps = append(etcdOps, clientv3.OpDelete(op.Key, op.options.etcd()...))
+		}
+	}
+
+	resp, err := ec.Client.Txn(ctx).If(etcdCmps...).Then(etcdOps...).Commit()
+	if err != nil {
+		return nil, fromEtcdErr(err)
+	}
+
+	txnResp := &TxnResponse{
+		Succeeded: resp.Succeeded,
+		Revision:  resp.Header.Revision,
+		Responses: make([]*GetResponse, len(resp.Responses)),
+	}
+	for i, opResp := range resp.Responses {
+		if rangeResp := opResp.GetResponseRange(); rangeResp != nil {
+			txnResp.Responses[i] = fromEtcdRange((*clientv3.GetResponse)(rangeResp))
+		}
+	}
+
+	return txnResp, nil
 }
 
-// Events
-type EventType string
+// Watch requires the etcd member to have a leader, so watches on a partitioned member fail instead of going quiet
+func (ec *EtcdClient) Watch(ctx context.Context, key string, opts ...OpOption) WatchChan {
+	watchChan := make(chan WatchResponse)
 
-const (
-	NodeAdded        EventType = "NodeAdded"
-	NodeRemoved      EventType = "NodeRemoved"
-	NamespaceAdded   EventType = "NamespaceAdded"
-	NamespaceRemoved EventType = "NamespaceRemoved"
-	ContainerAdded   EventType = "ContainerAdded"
-	ContainerRemoved EventType = "ContainerRemoved"
-)
+	go func() {
+		defer close(watchChan)
+
+		for etcdResp := range ec.Client.Watch(clientv3.WithRequireLeader(ctx), key, newOpOptions(opts).etcd()...) {
+			watchResp := WatchResponse{
+				Revision:        etcdResp.Header.Revision,
+				CompactRevision: etcdResp.CompactRevision,
+				Err:             etcdResp.Err(),
+				Events:          make([]WatchEvent, 0, len(etcdResp.Events)),
+			}
+
+			for _, event := range etcdResp.Events {
+				watchEvent := WatchEvent{Type: EventTypePut, Kv: fromEtcdKv(event.Kv)}
+				if event.Type == clientv3.EventTypeDelete {
+					watchEvent.Type = EventTypeDelete
+				}
+				if event.PrevKv != nil {
+					prevKv := fromEtcdKv(event.PrevKv)
+					watchEvent.PrevKv = &prevKv
+				}
+				watchResp.Events = append(watchResp.Events, watchEvent)
+			}
+
+			select {
+			case watchChan <- watchResp:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return watchChan
+}
+
+func (ec *EtcdClient) RequestProgress(ctx context.Context) error {
+	return ec.Client.RequestProgress(ctx)
+}
+
+func (ec *EtcdClient) Grant(ctx context.Context, ttl int64) (int64, error) {
+	lease, err := ec.Client.Grant(ctx, ttl)
+	if err != nil {
+		return 0, err
+	}
+	return int64(lease.ID), nil
+}
+
+func (ec *EtcdClient) KeepAliveOnce(ctx context.Context, leaseID int64) error {
+	_, err := ec.Client.KeepAliveOnce(ctx, clientv3.LeaseID(leaseID))
+	return fromEtcdErr(err)
+}
 
-type Event struct {
-	Type EventType
-	Data interface{}
+// fromEtcdErr maps etcd errors that callers handle to the Store's own
+func fromEtcdErr(err error) error {
+	if err == rpctypes.ErrLeaseNotFound {
+		return ErrLeaseNotFound
+	}
+	return err
+}
+
+func (ec *EtcdClient) Close() error {
+	return ec.Client.Close()
 }
 
-type Listener func(Event)
+func (o opOptions) etcd() []clientv3.OpOption {
+	var opts []clientv3.OpOption
+	if o.prefix {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	if o.countOnly {
+		opts = append(opts, clientv3.WithCountOnly())
+	}
+	if o.prevKV {
+		opts = append(opts, clientv3.WithPrevKV())
+	}
+	if o.progressNotify {
+		opts = append(opts, clientv3.WithProgressNotify())
+	}
+	if o.revision != 0 {
+		opts = append(opts, clientv3.WithRev(o.revision))
+	}
+	if o.lease != 0 {
+		opts = append(opts, clientv3.WithLease(clientv3.LeaseID(o.lease)))
+	}
+	return opts
+}
 
-func (ec *EtcdClient) Subscribe(listener Listener) {
-	ec.listeners = append(ec.listeners, listener)
+func fromEtcdRange(resp *clientv3.GetResponse) *GetResponse {
+	getResp := &GetResponse{
+		Kvs:      make([]KeyValue, 0, len(resp.Kvs)),
+		Count:    resp.Count,
+		Revision: resp.Header.Revision,
+	}
+	for _, kv := range resp.Kvs {
+		getResp.Kvs = append(getResp.Kvs, fromEtcdKv(kv))
+	}
+	return getResp
 }
 
-// emit broadcasts an event to all subscribers.
-func (ec *EtcdClient) emit(event Event) {
-	for _, listener := range ec.listeners {
-		listener(event)
+func fromEtcdKv(kv *mvccpb.KeyValue) KeyValue {
+	return KeyValue{
+		Key:            string(kv.Key),
+		Value:          kv.Value,
+		CreateRevision: kv.CreateRevision,
+		ModRevision:    kv.ModRevision,
+		Lease:          kv.Lease,
 	}
 }
@@ -0,0 +1,328 @@
+package controlnode
+
+import (
+	"0xKowalski1/container-orchestrator/config"
+	"0xKowalski1/container-orchestrator/models"
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events
+type EventType string
+
+const (
+	ContainerAdded   EventType = "ContainerAdded"
+	ContainerUpdated EventType = "ContainerUpdated"
+	ContainerRemoved EventType = "ContainerRemoved"
+	NodeAdded        EventType = "NodeAdded"
+	NodeUpdated      EventType = "NodeUpdated"
+	NodeRemoved      EventType = "NodeRemoved"
+
+	// Resync replaces the events a subscriber fell too far behind on. It is delivered whatever types were
+	// subscribed to, anything the listener tracks from events should be rebuilt from the store.
+	Resync EventType = "Resync"
+)
+
+// SubscriberQueueLimit is how many events can wait for a listener before they are dropped for a Resync
+const SubscriberQueueLimit = 1024
+
+// Event is a change to a container or node as seen in etcd.
+// The old object is nil for adds and the new object is nil for removes, only the pair matching the type is set.
+type Event struct {
+	Type     EventType
+	Revision int64
+
+	OldContainer *models.Container
+	Container    *models.Container
+
+	OldNode *models.Node
+	Node    *models.Node
+}
+
+type Listener func(Event)
+
+// EventBus turns etcd watches on containers and nodes into typed events, so every control node replica
+// hears about every change no matter which replica, or tool, wrote it.
+type EventBus struct {
+	cfg   *config.Config
+	store Store
+
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+
+	cluster clusterFeed // Cluster events for API clients, see WatchClusterEvents
+}
+
+// subscriber queues events for its listener so a slow listener never holds up the watch
+type subscriber struct {
+	listener Listener
+	types    map[EventType]bool // Empty for every type
+	pending  []Event
+	notify   chan struct{}
+	done     chan struct{}
+}
+
+func NewEventBus(cfg *config.Config, store Store) *EventBus {
+	return &EventBus{
+		cfg:         cfg,
+		store:       store,
+		subscribers: make(map[*subscriber]struct{}),
+		cluster:     clusterFeed{subscribers: make(map[*clusterSubscriber]struct{})},
+	}
+}
+
+// Subscribe calls listener for every event of the given types, or every event if none are given.
+// Listeners are called one event at a time in revision order from their own goroutine. A listener that falls
+// SubscriberQueueLimit events behind gets a single Resync in their place. Call the returned function to unsubscribe.
+func (bus *EventBus) Subscribe(listener Listener, types ...EventType) func() {
+	sub := &subscriber{
+		listener: listener,
+		types:    make(map[EventType]bool, len(types)),
+		notify:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	for _, eventType := range types {
+		sub.types[eventType] = true
+	}
+
+	bus.mu.Lock()
+	bus.subscribers[sub] = struct{}{}
+	bus.mu.Unlock()
+
+	go bus.deliver(sub)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			bus.mu.Lock()
+			delete(bus.subscribers, sub)
+			bus.mu.Unlock()
+			close(sub.done)
+		})
+	}
+}
+
+func (bus *EventBus) deliver(sub *subscriber) {
+	for {
+		bus.mu.Lock()
+		pending := sub.pending
+		sub.pending = nil
+		bus.mu.Unlock()
+
+		for _, event := range pending {
+			select {
+			case <-sub.done:
+				return
+			default:
+			}
+			sub.listener(event)
+		}
+
+		select {
+		case <-sub.notify:
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+func (bus *EventBus) publish(event Event) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	for sub := range bus.subscribers {
+		if len(sub.types) > 0 && !sub.types[event.Type] {
+			continue
+		}
+
+		// Queueing without limit would let one stuck listener hold every event since in memory
+		if len(sub.pending) >= SubscriberQueueLimit {
+			log.Printf("Event bus subscriber fell %d events behind at revision %d, dropping them for a resync", len(sub.pending), event.Revision)
+			sub.pending = []Event{{Type: Resync, Revision: event.Revision}}
+		} else {
+			sub.pending = append(sub.pending, event)
+		}
+		select {
+		case sub.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run watches containers and nodes from the current revision, publishing events until ctx is cancelled
+func (bus *EventBus) Run(ctx context.Context) {
+	var revision int64
+	for ctx.Err() == nil {
+		getCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		resp, err := bus.store.Get(getCtx, "/nodes/", WithPrefix(), WithCountOnly())
+		cancel()
+		if err == nil {
+			revision = resp.Revision
+			break
+		}
+
+		log.Printf("Event bus failed to read the current revision: %v", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+
+	bus.RunFrom(ctx, revision)
+}
+
+// RunFrom publishes every change after fromRevision until ctx is cancelled
+func (bus *EventBus) RunFrom(ctx context.Context, fromRevision int64) {
+	// Set before watching so a client resuming from earlier is told it missed events
+	bus.cluster.mu.Lock()
+	bus.cluster.start = fromRevision
+	bus.cluster.mu.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		bus.watchCluster(ctx, fromRevision+1)
+	}()
+
+	for _, prefix := range bus.prefixes() {
+		wg.Add(1)
+		go func(prefix string) {
+			defer wg.Done()
+			bus.watch(ctx, prefix, fromRevision+1)
+		}(prefix)
+	}
+	wg.Wait()
+}
+
+// prefixes are the keys the bus watches, one watch per model
+func (bus *EventBus) prefixes() []string {
+	return []string{"/nodes/", "/namespaces/" + bus.cfg.Namespace + "/containers/"}
+}
+
+// watch publishes every change under prefix from startRevision, rewatching from where it left off if the watch fails
+func (bus *EventBus) watch(ctx context.Context, prefix string, startRevision int64) {
+	nextRevision := startRevision
+
+	for ctx.Err() == nil {
+		watchCtx, cancel := context.WithCancel(ctx)
+		for watchResp := range bus.store.Watch(watchCtx, prefix, WithPrefix(), WithPrevKV(), WithRev(nextRevision)) {
+			if watchResp.CompactRevision != 0 {
+				log.Printf("Event bus missed changes under %s, revision %d was compacted", prefix, nextRevision)
+				nextRevision = watchResp.CompactRevision
+				break
+			}
+
+			if err := watchResp.Err; err != nil {
+				log.Printf("Event bus watch on %s failed: %v", prefix, err)
+				break
+			}
+
+			for _, event := range bus.decode(watchResp) {
+				bus.publish(event)
+			}
+
+			if len(watchResp.Events) > 0 {
+				nextRevision = watchResp.Events[len(watchResp.Events)-1].Kv.ModRevision + 1
+			}
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// decode turns raw store changes into typed events, skipping keys that are not containers or nodes
+func (bus *EventBus) decode(watchResp WatchResponse) []Event {
+	events := make([]Event, 0, len(watchResp.Events))
+	for _, watchEvent := range watchResp.Events {
+		if event, ok := bus.decodeEvent(watchEvent); ok {
+			events = append(events, event)
+		}
+	}
+
+	return events
+}
+
+func (bus *EventBus) decodeEvent(watchEvent WatchEvent) (Event, bool) {
+	containersPrefix := "/namespaces/" + bus.cfg.Namespace + "/containers/"
+	event := Event{Revision: watchEvent.Kv.ModRevision}
+
+	var err error
+	switch {
+	case strings.HasPrefix(watchEvent.Kv.Key, "/nodes/"):
+		event.OldNode, event.Node, err = decodeChange[models.Node](watchEvent)
+		event.Type = changeType(watchEvent, NodeAdded, NodeUpdated, NodeRemoved)
+		setNodeVersions(event.OldNode, event.Node, watchEvent)
+	case strings.HasPrefix(watchEvent.Kv.Key, containersPrefix):
+		event.OldContainer, event.Container, err = decodeChange[models.Container](watchEvent)
+		event.Type = changeType(watchEvent, ContainerAdded, ContainerUpdated, ContainerRemoved)
+		setContainerVersions(event.OldContainer, event.Container, watchEvent)
+	default:
+		return Event{}, false
+	}
+
+	if err != nil {
+		log.Printf("Event bus failed to decode %s: %v", watchEvent.Kv.Key, err)
+		return Event{}, false
+	}
+
+	return event, true
+}
+
+// decodeChange unmarshals the previous and current value of a key, either is nil if the key did not exist
+func decodeChange[T any](watchEvent WatchEvent) (*T, *T, error) {
+	var previous, current *T
+
+	if watchEvent.PrevKv != nil && len(watchEvent.PrevKv.Value) > 0 {
+		previous = new(T)
+		if err := json.Unmarshal(watchEvent.PrevKv.Value, previous); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if watchEvent.Type == EventTypePut {
+		current = new(T)
+		if err := json.Unmarshal(watchEvent.Kv.Value, current); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return previous, current, nil
+}
+
+func changeType(watchEvent WatchEvent, added, updated, removed EventType) EventType {
+	switch {
+	case watchEvent.Type == EventTypeDelete:
+		return removed
+	case watchEvent.IsCreate():
+		return added
+	default:
+		return updated
+	}
+}
+
+func setNodeVersions(previous, current *models.Node, watchEvent WatchEvent) {
+	if previous != nil {
+		previous.ResourceVersion = watchEvent.PrevKv.ModRevision
+	}
+	if current != nil {
+		current.ResourceVersion = watchEvent.Kv.ModRevision
+	}
+}
+
+func setContainerVersions(previous, current *models.Container, watchEvent WatchEvent) {
+	if previous != nil {
+		previous.ResourceVersion = watchEvent.PrevKv.ModRevision
+	}
+	if current != nil {
+		current.ResourceVersion = watchEvent.Kv.ModRevision
+	}
+}
@@ -0,0 +1,150 @@
+package controlnode
+
+import (
+	"0xKowalski1/container-orchestrator/config"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+const (
+	leaderElectionPrefix = "/election/control-node"
+	leaderElectionRetry  = 5 * time.Second
+)
+
+type leaderFenceKey struct{}
+
+// WithLeaderFence makes every transaction written with ctx also require the election key to be unchanged since it
+// was won. A replica that lost leadership without noticing yet, a paused process or a partition, then fails its
+// writes instead of overwriting the new leader's.
+func WithLeaderFence(ctx context.Context, key string, revision int64) context.Context {
+	return context.WithValue(ctx, leaderFenceKey{}, CompareModRevision(key, revision))
+}
+
+// leaderFence returns the comparisons a transaction written with ctx must hold, none outside of leadership
+func leaderFence(ctx context.Context) []Cmp {
+	if fence, ok := ctx.Value(leaderFenceKey{}).(Cmp); ok {
+		return []Cmp{fence}
+	}
+	return nil
+}
+
+// LeaderElector campaigns for leadership among control node replicas so only one runs the schedular and controllers.
+// Leadership is tied to an etcd session lease, if this replica stops renewing it another replica takes over once it expires.
+type LeaderElector struct {
+	cfg        *config.Config
+	etcdClient *EtcdClient
+	id         string
+
+	isLeader atomic.Bool
+}
+
+func NewLeaderElector(cfg *config.Config, etcdClient *EtcdClient) *LeaderElector {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "control-node"
+	}
+
+	return &LeaderElector{
+		cfg:        cfg,
+		etcdClient: etcdClient,
+		id:         fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+	}
+}
+
+// ID identifies this replica in the election
+func (le *LeaderElector) ID() string {
+	return le.id
+}
+
+// IsLeader reports whether this replica currently holds leadership
+func (le *LeaderElector) IsLeader() bool {
+	return le.isLeader.Load()
+}
+
+// Leader returns the ID of the current leader, empty if there is none
+func (le *LeaderElector) Leader(ctx context.Context) (string, error) {
+	// The oldest key under the election prefix is the leader, same as concurrency.Election.Leader without needing a session
+	resp, err := le.etcdClient.Client.Get(ctx, leaderElectionPrefix+"/", clientv3.WithFirstCreate()...)
+	if err != nil {
+		return "", err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return "", nil
+	}
+
+	return string(resp.Kvs[0].Value), nil
+}
+
+// Run campaigns for leadership until ctx is cancelled. Each time this replica is elected, lead is called with a
+// context that is cancelled the moment leadership is lost and fences the store writes made with it, lead must
+// return before campaigning again.
+func (le *LeaderElector) Run(ctx context.Context, lead func(ctx context.Context)) {
+	for ctx.Err() == nil {
+		if err := le.campaign(ctx, lead); err != nil {
+			log.Printf("Leader election failed, retrying in %s: %v", leaderElectionRetry, err)
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(leaderElectionRetry):
+			}
+		}
+	}
+}
+
+func (le *LeaderElector) campaign(ctx context.Context, lead func(ctx context.Context)) error {
+	session, err := concurrency.NewSession(le.etcdClient.Client, concurrency.WithTTL(le.cfg.LeaderElectionTTL), concurrency.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	election := concurrency.NewElection(session, leaderElectionPrefix)
+
+	// Blocks until we are elected
+	if err := election.Campaign(ctx, le.id); err != nil {
+		return err
+	}
+
+	log.Printf("Control node %s elected leader", le.id)
+
+	le.isLeader.Store(true)
+
+	leaderCtx, cancel := context.WithCancel(WithLeaderFence(ctx, election.Key(), election.Rev()))
+	defer cancel()
+
+	leading := make(chan struct{})
+	go func() {
+		defer close(leading)
+		lead(leaderCtx)
+	}()
+
+	// Losing the session lease means another replica may already be leading
+	select {
+	case <-session.Done():
+		log.Printf("Control node %s lost leadership", le.id)
+	case <-ctx.Done():
+	}
+
+	le.isLeader.Store(false)
+	cancel()
+
+	// Step down straight away rather than making the other replicas wait for the lease to expire. The fence fails
+	// anything lead still writes, so there is no need to wait for it first.
+	resignCtx, resignCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer resignCancel()
+	if err := election.Resign(resignCtx); err != nil {
+		log.Printf("Control node %s failed to resign leadership: %v", le.id, err)
+	}
+
+	<-leading
+
+	return nil
+}
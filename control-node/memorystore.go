@@ -0,0 +1,372 @@
+package controlnode
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-memory Store with etcd style revisions, watches and leases.
+// It keeps its full history so watches can start from any past revision, which is fine for tests.
+type MemoryStore struct {
+	mu       sync.Mutex
+	revision int64
+	data     map[string]KeyValue
+	history  []WatchEvent // Every event in revision order, with PrevKv always set for puts over an existing key and deletes
+	watchers map[*memoryWatcher]struct{}
+	leases   map[int64]*memoryLease
+	leaseID  int64
+}
+
+type memoryLease struct {
+	ttl   time.Duration
+	timer *time.Timer
+	keys  map[string]struct{}
+}
+
+// memoryWatcher queues responses so the store never blocks on a slow reader
+type memoryWatcher struct {
+	key     string
+	options opOptions
+	pending []WatchResponse
+	notify  chan struct{}
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		data:     make(map[string]KeyValue),
+		watchers: make(map[*memoryWatcher]struct{}),
+		leases:   make(map[int64]*memoryLease),
+	}
+}
+
+func (ms *MemoryStore) Get(ctx context.Context, key string, opts ...OpOption) (*GetResponse, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.get(key, newOpOptions(opts)), nil
+}
+
+func (ms *MemoryStore) Put(ctx context.Context, key, value string, opts ...OpOption) error {
+	_, err := ms.Txn(ctx, nil, []Op{OpPut(key, value, opts...)})
+	return err
+}
+
+func (ms *MemoryStore) Delete(ctx context.Context, key string, opts ...OpOption) error {
+	_, err := ms.Txn(ctx, nil, []Op{OpDelete(key, opts...)})
+	return err
+}
+
+func (ms *MemoryStore) Txn(ctx context.Context, cmps []Cmp, ops []Op) (*TxnResponse, error) {
+	// Same as etcd, nothing is written once the caller has given up
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, cmp := range cmps {
+		if ms.data[cmp.Key].ModRevision != cmp.ModRevision {
+			return &TxnResponse{Succeeded: false, Revision: ms.revision}, nil
+		}
+	}
+
+	for _, op := range ops {
+		if op.Type == OpTypePut && op.options.lease != 0 && ms.leases[op.options.lease] == nil {
+			return nil, ErrLeaseNotFound
+		}
+	}
+
+	// All writes in a transaction share one revision
+	revision := ms.revision + 1
+	var events []WatchEvent
+
+	resp := &TxnResponse{Succeeded: true, Responses: make([]*GetResponse, len(ops))}
+	for i, op := range ops {
+		switch op.Type {
+		case OpTypeGet:
+			resp.Responses[i] = ms.get(op.Key, op.options)
+		case OpTypePut:
+			events = append(events, ms.put(op.Key, op.Value, op.options.lease, revision))
+		case OpTypeDelete:
+			for _, kv := range ms.matching(op.Key, op.options.prefix) {
+				events = append(events, ms.delete(kv.Key, revision))
+			}
+		}
+	}
+
+	ms.commit(events)
+	resp.Revision = ms.revision
+
+	return resp, nil
+}
+
+func (ms *MemoryStore) Watch(ctx context.Context, key string, opts ...OpOption) WatchChan {
+	watcher := &memoryWatcher{
+		key:     key,
+		options: newOpOptions(opts),
+		notify:  make(chan struct{}, 1),
+	}
+
+	ms.mu.Lock()
+	if watcher.options.revision != 0 {
+		// Replay everything from the requested revision before any live events
+		var replay []WatchEvent
+		for _, event := range ms.history {
+			if event.Kv.ModRevision >= watcher.options.revision {
+				replay = append(replay, event)
+			}
+		}
+		watcher.enqueue(replay)
+	}
+	ms.watchers[watcher] = struct{}{}
+	ms.mu.Unlock()
+
+	watchChan := make(chan WatchResponse)
+
+	go func() {
+		defer close(watchChan)
+		defer func() {
+			ms.mu.Lock()
+			delete(ms.watchers, watcher)
+			ms.mu.Unlock()
+		}()
+
+		for {
+			ms.mu.Lock()
+			pending := watcher.pending
+			watcher.pending = nil
+			ms.mu.Unlock()
+
+			for _, watchResp := range pending {
+				select {
+				case watchChan <- watchResp:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-watcher.notify:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return watchChan
+}
+
+func (ms *MemoryStore) RequestProgress(ctx context.Context) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for watcher := range ms.watchers {
+		if watcher.options.progressNotify {
+			watcher.pending = append(watcher.pending, WatchResponse{Revision: ms.revision})
+			watcher.signal()
+		}
+	}
+
+	return nil
+}
+
+func (ms *MemoryStore) Grant(ctx context.Context, ttl int64) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.leaseID++
+	leaseID := ms.leaseID
+
+	lease := &memoryLease{ttl: time.Duration(ttl) * time.Second, keys: make(map[string]struct{})}
+	lease.timer = time.AfterFunc(lease.ttl, func() { ms.Revoke(leaseID) })
+	ms.leases[leaseID] = lease
+
+	return leaseID, nil
+}
+
+func (ms *MemoryStore) KeepAliveOnce(ctx context.Context, leaseID int64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	lease, ok := ms.leases[leaseID]
+	if !ok {
+		return ErrLeaseNotFound
+	}
+
+	lease.timer.Reset(lease.ttl)
+	return nil
+}
+
+// Revoke expires a lease straight away, deleting every key attached to it
+func (ms *MemoryStore) Revoke(leaseID int64) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	lease, ok := ms.leases[leaseID]
+	if !ok {
+		return
+	}
+	lease.timer.Stop()
+	delete(ms.leases, leaseID)
+
+	keys := make([]string, 0, len(lease.keys))
+	for key := range lease.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	revision := ms.revision + 1
+	events := make([]WatchEvent, 0, len(keys))
+	for _, key := range keys {
+		events = append(events, ms.delete(key, revision))
+	}
+
+	ms.commit(events)
+}
+
+func (ms *MemoryStore) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, lease := range ms.leases {
+		lease.timer.Stop()
+	}
+
+	return nil
+}
+
+// get reads under the lock, keys come back sorted like etcd range reads
+func (ms *MemoryStore) get(key string, options opOptions) *GetResponse {
+	kvs := ms.matching(key, options.prefix)
+
+	resp := &GetResponse{Count: int64(len(kvs)), Revision: ms.revision}
+	if !options.countOnly {
+		resp.Kvs = kvs
+	}
+
+	return resp
+}
+
+func (ms *MemoryStore) matching(key string, prefix bool) []KeyValue {
+	if !prefix {
+		if kv, ok := ms.data[key]; ok {
+			return []KeyValue{kv}
+		}
+		return nil
+	}
+
+	var kvs []KeyValue
+	for k, kv := range ms.data {
+		if strings.HasPrefix(k, key) {
+			kvs = append(kvs, kv)
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+
+	return kvs
+}
+
+func (ms *MemoryStore) put(key, value string, leaseID, revision int64) WatchEvent {
+	prev, existed := ms.data[key]
+
+	kv := KeyValue{
+		Key:            key,
+		Value:          []byte(value),
+		CreateRevision: revision,
+		ModRevision:    revision,
+		Lease:          leaseID,
+	}
+	if existed {
+		kv.CreateRevision = prev.CreateRevision
+	}
+	ms.data[key] = kv
+
+	if existed && prev.Lease != 0 && prev.Lease != leaseID {
+		if lease, ok := ms.leases[prev.Lease]; ok {
+			delete(lease.keys, key)
+		}
+	}
+	if leaseID != 0 {
+		ms.leases[leaseID].keys[key] = struct{}{}
+	}
+
+	event := WatchEvent{Type: EventTypePut, Kv: kv}
+	if existed {
+		event.PrevKv = &prev
+	}
+	return event
+}
+
+func (ms *MemoryStore) delete(key string, revision int64) WatchEvent {
+	prev := ms.data[key]
+	delete(ms.data, key)
+
+	if lease, ok := ms.leases[prev.Lease]; ok {
+		delete(lease.keys, key)
+	}
+
+	return WatchEvent{
+		Type:   EventTypeDelete,
+		Kv:     KeyValue{Key: key, ModRevision: revision},
+		PrevKv: &prev,
+	}
+}
+
+// commit bumps the revision and hands the events to watchers, a transaction that wrote nothing leaves the revision alone
+func (ms *MemoryStore) commit(events []WatchEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	ms.revision++
+	ms.history = append(ms.history, events...)
+
+	for watcher := range ms.watchers {
+		watcher.enqueue(events)
+	}
+}
+
+// enqueue queues the events the watcher is interested in, one response per revision
+func (watcher *memoryWatcher) enqueue(events []WatchEvent) {
+	queued := false
+
+	for _, event := range events {
+		if !watcher.matches(event.Kv.Key) {
+			continue
+		}
+
+		if !watcher.options.prevKV {
+			event.PrevKv = nil
+		}
+
+		last := len(watcher.pending) - 1
+		if last >= 0 && watcher.pending[last].Revision == event.Kv.ModRevision && len(watcher.pending[last].Events) > 0 {
+			watcher.pending[last].Events = append(watcher.pending[last].Events, event)
+		} else {
+			watcher.pending = append(watcher.pending, WatchResponse{Revision: event.Kv.ModRevision, Events: []WatchEvent{event}})
+		}
+		queued = true
+	}
+
+	if queued {
+		watcher.signal()
+	}
+}
+
+func (watcher *memoryWatcher) matches(key string) bool {
+	if watcher.options.prefix {
+		return strings.HasPrefix(key, watcher.key)
+	}
+	return key == watcher.key
+}
+
+func (watcher *memoryWatcher) signal() {
+	select {
+	case watcher.notify <- struct{}{}:
+	default:
+	}
+}
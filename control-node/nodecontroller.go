@@ -0,0 +1,116 @@
+package controlnode
+
+import (
+	"0xKowalski1/container-orchestrator/config"
+	"0xKowalski1/container-orchestrator/models"
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+const nodeControllerInterval = 10 * time.Second
+
+// NodeController moves containers off nodes that have stopped heartbeating for longer than the grace period
+type NodeController struct {
+	cfg              *config.Config
+	containerService *ContainerService
+	nodeService      *NodeService
+
+	pinned map[string]string // ContainerID -> NodeID, pinned containers we have already recorded an event for
+}
+
+func NewNodeController(cfg *config.Config, containerService *ContainerService, nodeService *NodeService) *NodeController {
+	return &NodeController{
+		cfg:              cfg,
+		containerService: containerService,
+		nodeService:      nodeService,
+		pinned:           make(map[string]string),
+	}
+}
+
+// Run reconciles nodes periodically until ctx is cancelled
+func (nc *NodeController) Run(ctx context.Context) {
+	// Another replica may have led since we last ran, so start with no memory of pinned containers
+	nc.pinned = make(map[string]string)
+
+	ticker := time.NewTicker(nodeControllerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		nc.ReconcileNodes(ctx)
+	}
+}
+
+// ReconcileNodes evacuates nodes that are past the grace period, stopping as soon as ctx is cancelled
+func (nc *NodeController) ReconcileNodes(ctx context.Context) {
+	nodes, err := nc.nodeService.GetNodes()
+	if err != nil {
+		log.Printf("Error fetching nodes: %v", err)
+		return
+	}
+
+	gracePeriod := time.Duration(nc.cfg.NodeFailureGracePeriod) * time.Second
+
+	for _, node := range nodes {
+		if node.Status != models.NodeStatusNotReady {
+			nc.forgetPinned(node.ID)
+			continue
+		}
+
+		if time.Since(node.LastHeartbeat) < gracePeriod {
+			continue
+		}
+
+		for _, container := range node.Containers {
+			// Leadership can be lost mid pass, the new leader takes over from here
+			if ctx.Err() != nil {
+				return
+			}
+
+			nc.evacuateContainer(ctx, container, node)
+		}
+	}
+}
+
+func (nc *NodeController) evacuateContainer(ctx context.Context, container models.Container, node models.Node) {
+	if container.ReschedulePolicy == models.ReschedulePolicyKeepPinned {
+		if nc.pinned[container.ID] == node.ID {
+			return
+		}
+		nc.pinned[container.ID] = node.ID
+
+		message := fmt.Sprintf("Node %s has been NotReady since %s, keeping container pinned", node.ID, node.LastHeartbeat.Format(time.RFC3339))
+		if err := nc.containerService.RecordEvent(container.ID, models.EventReasonNodeNotReady, message); err != nil {
+			log.Printf("Failed to record event for container %s: %v", container.ID, err)
+		}
+		return
+	}
+
+	log.Printf("Node %s is NotReady, rescheduling container %s", node.ID, container.ID)
+
+	if err := nc.nodeService.UnassignContainer(ctx, container.ID); err != nil {
+		log.Printf("Failed to unassign container %s from node %s: %v", container.ID, node.ID, err)
+		return
+	}
+
+	message := fmt.Sprintf("Node %s has been NotReady since %s, unbound for rescheduling", node.ID, node.LastHeartbeat.Format(time.RFC3339))
+	if err := nc.containerService.RecordEvent(container.ID, models.EventReasonRescheduled, message); err != nil {
+		log.Printf("Failed to record event for container %s: %v", container.ID, err)
+	}
+}
+
+// forgetPinned clears pinned containers for a node once it is no longer NotReady, so a later failure is recorded again
+func (nc *NodeController) forgetPinned(nodeID string) {
+	for containerID, pinnedNodeID := range nc.pinned {
+		if pinnedNodeID == nodeID {
+			delete(nc.pinned, containerID)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package controlnode
+
+import (
+	"0xKowalski1/container-orchestrator/models"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// preemptionCandidate is a node the container fits on once the victims are removed
+type preemptionCandidate struct {
+	node    int
+	victims []models.Container
+}
+
+// errPreempting means room is being made for the container, it is placed by the next pass rather than retried with backoff
+var errPreempting = errors.New("preempting lower priority containers")
+
+// preempt finds the node where the container fits by removing the fewest, lowest priority containers, stops those
+// containers in one transaction and nominates the node for the container. Nothing waits for the victims to stop, they
+// keep their resources and host ports until the worker reports them stopped, then releasePreempted unbinds them and
+// the next pass places the container on its nominated node.
+func (s *Schedular) preempt(ctx context.Context, container models.Container, nodes []models.Node) error {
+	var best *preemptionCandidate
+	for i := range nodes {
+		candidate, ok := s.findVictims(container, nodes, i)
+		if !ok {
+			continue
+		}
+
+		if best == nil || isBetterPreemption(candidate, *best) {
+			best = &candidate
+		}
+	}
+
+	if best == nil {
+		return fmt.Errorf("failed to assign container %s, nodes at capacity and nothing to preempt", container.ID)
+	}
+
+	node := nodes[best.node]
+
+	victimIDs := make([]string, len(best.victims))
+	for i, victim := range best.victims {
+		victimIDs[i] = victim.ID
+	}
+
+	log.Printf("Preempting %s on node %s for container %s", strings.Join(victimIDs, ", "), node.ID, container.ID)
+
+	if err := s.nodeService.PreemptContainers(ctx, node.ID, victimIDs); err != nil {
+		return fmt.Errorf("failed to preempt %s on node %s: %v", strings.Join(victimIDs, ", "), node.ID, err)
+	}
+
+	s.nominated[container.ID] = node.ID
+
+	s.recordEvent(container.ID, models.EventReasonPreempting, fmt.Sprintf("Preempting %s on node %s", strings.Join(victimIDs, ", "), node.ID))
+	for _, victim := range best.victims {
+		s.recordEvent(victim.ID, models.EventReasonPreempted, fmt.Sprintf("Preempted on node %s by container %s with priority %d", node.ID, container.ID, container.Priority))
+	}
+
+	// The victims still count against the node until they are released, so nothing else takes the room
+	return errPreempting
+}
+
+// isPreempting reports whether containers preempted on the node are still stopping, their room is not free yet
+func isPreempting(nodes []models.Node, nodeID string) bool {
+	for _, node := range nodes {
+		if node.ID != nodeID {
+			continue
+		}
+
+		for _, c := range node.Containers {
+			if c.PreemptedDesiredStatus != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// releasePreempted unbinds preempted containers once they have stopped, or their node can no longer run them, and
+// requeues them with the desired status they had before. They are scheduled again like any other container.
+func (s *Schedular) releasePreempted(ctx context.Context) {
+	containers, err := s.containerService.GetContainers()
+	if err != nil {
+		log.Printf("Error fetching containers to release preempted ones: %v", err)
+		return
+	}
+
+	for _, container := range containers {
+		if container.PreemptedDesiredStatus == "" || !s.hasPreemptedContainerStopped(container) {
+			continue
+		}
+
+		if err := s.nodeService.ReleasePreemptedContainer(ctx, container); err != nil {
+			log.Printf("Failed to release preempted container %s: %v", container.ID, err)
+			continue
+		}
+
+		log.Printf("Released preempted container %s from node %s", container.ID, container.NodeID)
+	}
+}
+
+// hasPreemptedContainerStopped reports whether nothing is left running for a preempted container on its node
+func (s *Schedular) hasPreemptedContainerStopped(container models.Container) bool {
+	if container.NodeID == "" || container.Status == "stopped" {
+		return true
+	}
+
+	// Never started, the worker has nothing to stop
+	if container.Status == "" && container.StartedAt == nil {
+		return true
+	}
+
+	// A node that is gone or NotReady cannot report it stopped, nothing is placed there until it is back anyway
+	node, err := s.nodeService.GetNode(container.NodeID)
+	if err != nil {
+		log.Printf("Error fetching node %s of preempted container %s: %v", container.NodeID, container.ID, err)
+		return false
+	}
+	return node == nil || node.Status != models.NodeStatusReady
+}
+
+// findVictims removes preemptible containers from the node, lowest priority first, until the container passes every filter
+func (s *Schedular) findVictims(container models.Container, nodes []models.Node, nodeIndex int) (preemptionCandidate, bool) {
+	node := nodes[nodeIndex]
+
+	preemptible := make([]models.Container, 0, len(node.Containers))
+	for _, c := range node.Containers {
+		// Containers already being preempted are leaving, stopping them again frees nothing more
+		if c.Priority < container.Priority && !c.NeverPreempt && c.PreemptedDesiredStatus == "" {
+			preemptible = append(preemptible, c)
+		}
+	}
+
+	sort.SliceStable(preemptible, func(i, j int) bool {
+		return preemptible[i].Priority < preemptible[j].Priority
+	})
+
+	// Filters that compare nodes need to see the node without its victims too
+	simulated := make([]models.Node, len(nodes))
+	copy(simulated, nodes)
+
+	for count := 1; count <= len(preemptible); count++ {
+		victims := preemptible[:count]
+		simulated[nodeIndex] = withoutContainers(node, victims)
+
+		if s.filterNode(container, simulated[nodeIndex], simulated) == nil {
+			return preemptionCandidate{node: nodeIndex, victims: victims}, true
+		}
+	}
+
+	return preemptionCandidate{}, false
+}
+
+// isBetterPreemption prefers disrupting lower priority containers, then fewer of them
+func isBetterPreemption(a, b preemptionCandidate) bool {
+	aPriority, bPriority := highestPriority(a.victims), highestPriority(b.victims)
+	if aPriority != bPriority {
+		return aPriority < bPriority
+	}
+	return len(a.victims) < len(b.victims)
+}
+
+func highestPriority(containers []models.Container) int {
+	highest := containers[0].Priority
+	for _, c := range containers[1:] {
+		highest = max(highest, c.Priority)
+	}
+	return highest
+}
+
+// withoutContainers returns a copy of the node with the containers and their resources removed
+func withoutContainers(node models.Node, removed []models.Container) models.Node {
+	removedIDs := make(map[string]bool, len(removed))
+	for _, c := range removed {
+		removedIDs[c.ID] = true
+	}
+
+	remaining := make([]models.Container, 0, len(node.Containers))
+	for _, c := range node.Containers {
+		if removedIDs[c.ID] {
+			node.MemoryUsed -= c.MemoryLimit
+			node.CpuUsed -= c.CpuLimit
+			node.StorageUsed -= c.StorageLimit
+			continue
+		}
+		remaining = append(remaining, c)
+	}
+	node.Containers = remaining
+
+	return node
+}
@@ -1,105 +1,568 @@
 package controlnode
 
 import (
+	"0xKowalski1/container-orchestrator/config"
 	"0xKowalski1/container-orchestrator/models"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	schedulingResyncInterval = 10 * time.Second // Retry pending containers whose backoff has expired
+	schedulingMinBackoff     = 5 * time.Second
+	schedulingMaxBackoff     = 5 * time.Minute
 )
 
 type Schedular struct {
-	etcdClient       *EtcdClient
+	cfg              *config.Config
+	store            Store
+	eventBus         *EventBus
 	containerService *ContainerService
 	nodeService      *NodeService
+	filters          []nodeFilter
+	strategies       map[string]SchedulingStrategy
+
+	mu        sync.Mutex                    // Held for a whole scheduling pass so concurrent passes cannot hand out the same resources or ports
+	backoff   map[string]*schedulingBackoff // ContainerID -> retry state for containers that failed to schedule
+	nominated map[string]string             // ContainerID -> node its preemption made room on, it is placed there first
 }
 
-func NewSchedular(etcdClient *EtcdClient, containerService *ContainerService, nodeService *NodeService) *Schedular {
+type schedulingBackoff struct {
+	attempts  int
+	nextRetry time.Time
+}
+
+// nodeFilter is a hard requirement a node must meet before it is scored.
+// Most filters only look at the node itself, the full node list is there for filters that compare nodes.
+type nodeFilter struct {
+	name  string
+	check func(container models.Container, node models.Node, nodes []models.Node) error
+}
+
+// perNode adapts a filter that only needs the node being checked
+func perNode(check func(container models.Container, node models.Node) error) func(models.Container, models.Node, []models.Node) error {
+	return func(container models.Container, node models.Node, _ []models.Node) error {
+		return check(container, node)
+	}
+}
+
+func NewSchedular(cfg *config.Config, store Store, eventBus *EventBus, containerService *ContainerService, nodeService *NodeService) *Schedular {
 	schedular := &Schedular{
-		etcdClient:       etcdClient,
+		cfg:              cfg,
+		store:            store,
+		eventBus:         eventBus,
 		containerService: containerService,
 		nodeService:      nodeService,
+		backoff:          make(map[string]*schedulingBackoff),
+		nominated:        make(map[string]string),
 	}
 
-	// Run schedule once on start to handle any missed events while offline.
-	schedular.scheduleContainers()
+	portCapacity := 0
+	for _, portRange := range cfg.HostPortRanges {
+		portCapacity += portRange.Size()
+	}
+	schedular.strategies = newSchedulingStrategies(portCapacity)
+
+	schedular.filters = []nodeFilter{
+		{name: "NodeReady", check: perNode(schedular.isNodeReady)},
+		{name: "NodeSchedulable", check: perNode(schedular.isNodeSchedulable)},
+		{name: "FreeResources", check: perNode(schedular.doesNodeHaveFreeResources)},
+		{name: "PortsAvailable", check: perNode(schedular.doesNodeHavePortsAvailable)},
+		{name: "NodeSelector", check: perNode(schedular.doesNodeMatchSelector)},
+		{name: "NodeAffinity", check: perNode(schedular.doesNodeMatchAffinity)},
+		{name: "TaintToleration", check: perNode(schedular.doesContainerTolerateTaints)},
+		{name: "ContainerAntiAffinity", check: perNode(schedular.doesNodeSatisfyAntiAffinity)},
+		{name: "TopologySpread", check: schedular.doesNodeSatisfyTopologySpread},
+	}
+
+	return schedular
+}
+
+// Run schedules pending containers whenever nodes or containers change in etcd, and periodically retries
+// containers that failed to schedule with exponential backoff. Passes run one at a time until ctx is cancelled.
+func (s *Schedular) Run(ctx context.Context) {
+	// Watchers only signal, a burst of changes collapses into a single pending pass
+	trigger := make(chan struct{}, 1)
+	signal := func() {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+
+	leasesPrefix := models.NodeHeartbeat{}.LeaseKey()
+
+	// Any node change can free or add capacity
+	unsubscribeNodes := s.eventBus.Subscribe(func(event Event) {
+		s.resetBackoff()
+		signal()
+	}, NodeAdded, NodeUpdated, NodeRemoved)
+	defer unsubscribeNodes()
 
-	schedular.etcdClient.Subscribe(func(event Event) {
-		if event.Type == ContainerAdded {
-			schedular.scheduleContainers()
+	unsubscribeContainers := s.eventBus.Subscribe(func(event Event) {
+		if freesCapacity(event) {
+			s.resetBackoff()
+		}
+		signal()
+	}, ContainerAdded, ContainerUpdated, ContainerRemoved)
+	defer unsubscribeContainers()
+
+	// Leases are not a model so they are not on the event bus. Renewals are frequent and change nothing,
+	// only a node becoming Ready or NotReady matters.
+	go s.watchPrefix(ctx, leasesPrefix, func(watchResp WatchResponse) {
+		if hasCreateOrDelete(watchResp) {
+			s.resetBackoff()
+			signal()
 		}
 	})
 
-	return schedular
+	resyncTicker := time.NewTicker(schedulingResyncInterval)
+	defer resyncTicker.Stop()
+
+	// Run schedule once on start to handle any missed events while offline.
+	s.ScheduleContainers(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-resyncTicker.C:
+		case <-trigger:
+		}
+
+		s.ScheduleContainers(ctx)
+	}
+}
+
+// watchPrefix calls handle for every watch response under the prefix, rewatching if the watch closes, until ctx is cancelled
+func (s *Schedular) watchPrefix(ctx context.Context, prefix string, handle func(WatchResponse), opts ...OpOption) {
+	opts = append(opts, WithPrefix())
+
+	for ctx.Err() == nil {
+		// Cancelled on every exit so a watch we stop reading from does not linger
+		watchCtx, cancel := context.WithCancel(ctx)
+		for watchResp := range s.store.Watch(watchCtx, prefix, opts...) {
+			if err := watchResp.Err; err != nil {
+				log.Printf("Schedular watch on %s failed: %v", prefix, err)
+				break
+			}
+			handle(watchResp)
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func hasCreateOrDelete(watchResp WatchResponse) bool {
+	for _, event := range watchResp.Events {
+		if event.IsCreate() || event.Type == EventTypeDelete {
+			return true
+		}
+	}
+	return false
+}
+
+// freesCapacity reports whether a container was deleted or moved off a node
+func freesCapacity(event Event) bool {
+	switch event.Type {
+	case ContainerRemoved:
+		return true
+	case ContainerUpdated:
+		return event.OldContainer != nil && event.OldContainer.NodeID != "" && event.OldContainer.NodeID != event.Container.NodeID
+	}
+	return false
+}
+
+// resetBackoff lets every pending container be retried on the next pass
+func (s *Schedular) resetBackoff() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clear(s.backoff)
 }
 
-func (s *Schedular) scheduleContainers() {
+// ScheduleContainers runs a single scheduling pass over every unscheduled container, stopping early if ctx is cancelled
+func (s *Schedular) ScheduleContainers(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Victims that have stopped are requeued before the pass, so the containers that preempted them can take the room
+	s.releasePreempted(ctx)
+
 	unscheduledContainers, err := s.containerService.GetUnscheduledContainers()
 	if err != nil {
 		log.Printf("Error fetching unscheduled containers: %v", err)
 		return
 	}
 
+	if len(unscheduledContainers) == 0 {
+		clear(s.backoff)
+		clear(s.nominated)
+		return
+	}
+
 	nodes, err := s.nodeService.GetNodes()
 	if err != nil {
 		log.Printf("Error fetching nodes: %v", err)
 		return
 	}
 
-	log.Printf("Starting container scheduling...")
+	// Higher priority containers get first pick of the free capacity, containers that preempted others go first
+	// among their priority so the room they made is not taken by another
+	sort.SliceStable(unscheduledContainers, func(i, j int) bool {
+		a, b := unscheduledContainers[i], unscheduledContainers[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return s.nominated[a.ID] != "" && s.nominated[b.ID] == ""
+	})
+
+	now := time.Now()
+	pending := make(map[string]bool, len(unscheduledContainers))
+
 	for _, container := range unscheduledContainers {
-		err := s.scheduleContainer(container, nodes)
+		// Leadership can be lost mid pass, the new leader takes over from here
+		if ctx.Err() != nil {
+			return
+		}
+
+		pending[container.ID] = true
+
+		// Released by the next pass, placing it now would bind it stopped
+		if container.PreemptedDesiredStatus != "" {
+			continue
+		}
+
+		if backoff, ok := s.backoff[container.ID]; ok && now.Before(backoff.nextRetry) {
+			continue
+		}
+
+		err := s.scheduleContainer(ctx, container, nodes)
 		if err == nil {
 			log.Printf("Container %s scheduled successfully", container.ID)
-		} else {
-			log.Printf("Error scheduling container %s: %v", container.ID, err)
+			delete(s.backoff, container.ID)
+			delete(s.nominated, container.ID)
+			continue
+		}
+
+		if errors.Is(err, errPreempting) {
+			log.Printf("Container %s is waiting for preempted containers on node %s", container.ID, s.nominated[container.ID])
+			delete(s.backoff, container.ID)
+			continue
+		}
+
+		backoff, ok := s.backoff[container.ID]
+		if !ok {
+			backoff = &schedulingBackoff{}
+			s.backoff[container.ID] = backoff
+		}
+		backoff.attempts++
+		delay := schedulingMinBackoff
+		for i := 1; i < backoff.attempts && delay < schedulingMaxBackoff; i++ {
+			delay *= 2
+		}
+		delay = min(delay, schedulingMaxBackoff)
+		backoff.nextRetry = now.Add(delay)
+
+		log.Printf("Error scheduling container %s, retrying in %s: %v", container.ID, delay, err)
+		s.setSchedulingMessage(ctx, container, err.Error())
+	}
+
+	// Forget containers that were scheduled or deleted elsewhere
+	for containerID := range s.backoff {
+		if !pending[containerID] {
+			delete(s.backoff, containerID)
+		}
+	}
+	for containerID := range s.nominated {
+		if !pending[containerID] {
+			delete(s.nominated, containerID)
 		}
 	}
 }
 
-func (s *Schedular) scheduleContainer(container models.Container, nodes []models.Node) error {
-	for _, node := range nodes {
-		if !s.doesNodeHaveFreeResources(container, node) {
-			log.Printf("Node %s does not have resources free to schedule container %s", node.ID, container.ID)
+// setSchedulingMessage records why a container could not be scheduled, skipping the write if nothing changed
+func (s *Schedular) setSchedulingMessage(ctx context.Context, container models.Container, message string) {
+	if container.SchedulingMessage == message {
+		return
+	}
+
+	if err := s.containerService.UpdateContainer(ctx, container.ID, models.UpdateContainerRequest{SchedulingMessage: &message}); err != nil {
+		log.Printf("Failed to set scheduling message for container %s: %v", container.ID, err)
+	}
+}
+
+// recordEvent adds to the container's history, failing to record is not a reason to fail scheduling
+func (s *Schedular) recordEvent(containerID, reason, message string) {
+	if err := s.containerService.RecordEvent(containerID, reason, message); err != nil {
+		log.Printf("Failed to record %s event for container %s: %v", reason, containerID, err)
+	}
+}
+
+// scheduleContainer filters out nodes that cannot run the container, scores the rest with the container's strategy
+// and assigns it to the best node. The chosen node in nodes is updated so later placements in the same pass see it.
+func (s *Schedular) scheduleContainer(ctx context.Context, container models.Container, nodes []models.Node) error {
+	strategy := s.strategyFor(container)
+
+	best := -1
+	bestScore := 0.0
+	reasons := make([]string, 0, len(nodes))
+	for i, node := range nodes {
+		if err := s.filterNode(container, node, nodes); err != nil {
+			log.Printf("Node %s cannot run container %s: %v", node.ID, container.ID, err)
+			reasons = append(reasons, fmt.Sprintf("%s (%v)", node.ID, err))
 			continue
 		}
 
-		if !s.doesNodeHavePortsAvailable(container, node) {
-			log.Printf("Node %s does not have ports free to schedule container %s", node.ID, container.ID)
-			continue
+		// The node a preemption made room on wins outright, scoring could send the container elsewhere
+		// and leave the victims stopped for nothing
+		if node.ID == s.nominated[container.ID] {
+			return s.bindContainer(ctx, container, &nodes[i])
 		}
 
-		err := s.nodeService.AssignContainerToNode(container.ID, node.ID)
-		if err != nil {
-			log.Printf("Failed to assign container %s to node %s: %v", container.ID, node.ID, err)
-			continue
+		score := strategy.Score(container, node) + s.preferenceScore(container, node)
+		if best == -1 || score > bestScore {
+			best = i
+			bestScore = score
+		}
+	}
+
+	if best == -1 {
+		if nodeID := s.nominated[container.ID]; nodeID != "" && isPreempting(nodes, nodeID) {
+			return errPreempting // Its victims are still stopping
+		}
+
+		delete(s.nominated, container.ID) // Its room was taken after all
+		if container.Priority > 0 {
+			return s.preempt(ctx, container, nodes)
+		}
+		if len(reasons) == 0 {
+			return fmt.Errorf("no nodes in the cluster")
+		}
+		return fmt.Errorf("0/%d nodes available: %s", len(nodes), strings.Join(reasons, ", "))
+	}
+
+	return s.bindContainer(ctx, container, &nodes[best])
+}
+
+// bindContainer allocates the container's host ports on the node and assigns it, updating node to include it
+func (s *Schedular) bindContainer(ctx context.Context, container models.Container, node *models.Node) error {
+	ports, err := s.allocateHostPorts(container, *node)
+	if err != nil {
+		s.recordEvent(container.ID, models.EventReasonPortConflict, fmt.Sprintf("Could not allocate host ports on node %s: %v", node.ID, err))
+		return fmt.Errorf("failed to allocate ports for container %s on node %s: %v", container.ID, node.ID, err)
+	}
+
+	if err := s.nodeService.AssignContainerToNode(ctx, container.ID, node.ID, ports); err != nil {
+		return fmt.Errorf("failed to assign container %s to node %s: %v", container.ID, node.ID, err)
+	}
+
+	s.recordEvent(container.ID, models.EventReasonScheduled, fmt.Sprintf("Assigned to node %s", node.ID))
+
+	container.NodeID = node.ID
+	container.Ports = ports
+	node.Containers = append(node.Containers, container)
+	node.MemoryUsed += container.MemoryLimit
+	node.CpuUsed += container.CpuLimit
+	node.StorageUsed += container.StorageLimit
+
+	return nil
+}
+
+// Simulate reports how every node fares against the filters and strategy for the container, without writing anything
+func (s *Schedular) Simulate(container models.Container) (*models.SchedulingSimulation, error) {
+	nodes, err := s.nodeService.GetNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	// An already scheduled container should not be competing with itself for resources and ports
+	for i, node := range nodes {
+		if node.ID == container.NodeID {
+			nodes[i] = withoutContainers(node, []models.Container{container})
+		}
+	}
+
+	strategy := s.strategyFor(container)
+
+	simulation := &models.SchedulingSimulation{
+		ContainerID: container.ID,
+		Strategy:    s.strategyName(container),
+		Nodes:       make([]models.NodeSimulation, 0, len(nodes)),
+	}
+
+	bestScore := 0.0
+	for _, node := range nodes {
+		nodeSimulation := models.NodeSimulation{NodeID: node.ID, Feasible: true}
+
+		for _, filter := range s.filters {
+			result := models.FilterResult{Name: filter.name, Passed: true}
+			if err := filter.check(container, node, nodes); err != nil {
+				result.Passed = false
+				result.Reason = err.Error()
+				nodeSimulation.Feasible = false
+			}
+			nodeSimulation.Filters = append(nodeSimulation.Filters, result)
+		}
+
+		if nodeSimulation.Feasible {
+			nodeSimulation.Score = strategy.Score(container, node) + s.preferenceScore(container, node)
+			if simulation.SelectedNode == "" || nodeSimulation.Score > bestScore {
+				simulation.SelectedNode = node.ID
+				bestScore = nodeSimulation.Score
+			}
+		}
+
+		simulation.Nodes = append(simulation.Nodes, nodeSimulation)
+	}
+
+	return simulation, nil
+}
+
+// filterNode runs every filter against the node, returning the first failure
+func (s *Schedular) filterNode(container models.Container, node models.Node, nodes []models.Node) error {
+	for _, filter := range s.filters {
+		if err := filter.check(container, node, nodes); err != nil {
+			return fmt.Errorf("%s: %v", filter.name, err)
 		}
+	}
+	return nil
+}
+
+// strategyFor picks the container's own strategy if set, otherwise the configured default. Both are validated, only a
+// container stored before they were falls back to the default.
+func (s *Schedular) strategyFor(container models.Container) SchedulingStrategy {
+	name := s.strategyName(container)
 
-		return nil
+	strategy, ok := s.strategies[name]
+	if !ok {
+		log.Printf("Unknown scheduling strategy %q for container %s, using %s", name, container.ID, DefaultSchedulingStrategy)
+		return s.strategies[DefaultSchedulingStrategy]
 	}
 
-	return fmt.Errorf("failed to assign container %s, nodes at capacity", container.ID)
+	return strategy
+}
+
+func (s *Schedular) strategyName(container models.Container) string {
+	if container.SchedulingStrategy != "" {
+		return container.SchedulingStrategy
+	}
+	return s.cfg.SchedulingStrategy
+}
+
+func (s *Schedular) isNodeReady(container models.Container, node models.Node) error {
+	if node.Status != models.NodeStatusReady {
+		return fmt.Errorf("node is %s", node.Status)
+	}
+	return nil
+}
+
+func (s *Schedular) isNodeSchedulable(container models.Container, node models.Node) error {
+	if node.Unschedulable {
+		return fmt.Errorf("node is cordoned")
+	}
+	return nil
 }
 
-func (s *Schedular) doesNodeHaveFreeResources(container models.Container, node models.Node) bool {
+func (s *Schedular) doesNodeHaveFreeResources(container models.Container, node models.Node) error {
 	if node.MemoryLimit-node.MemoryUsed < container.MemoryLimit ||
 		node.CpuLimit-node.CpuUsed < container.CpuLimit ||
 		node.StorageLimit-node.StorageUsed < container.StorageLimit {
-		return false
+		return fmt.Errorf("not enough free resources")
 	}
-	return true
+	return nil
 }
 
-func (s *Schedular) doesNodeHavePortsAvailable(container models.Container, node models.Node) bool {
-	usedPortsMap := make(map[int]bool)
-	for _, c := range node.Containers {
-		for _, port := range c.Ports {
-			usedPortsMap[port.HostPort] = true
+func (s *Schedular) doesNodeHavePortsAvailable(container models.Container, node models.Node) error {
+	usedPortsMap := usedHostPorts(node)
+
+	wanted := make(map[string]int) // Protocol -> ports to assign
+	for _, port := range container.Ports {
+		if port.HostPort == 0 {
+			wanted[port.Protocol]++
+			continue
+		}
+
+		if usedPortsMap[hostPortKey{port.Protocol, port.HostPort}] {
+			return fmt.Errorf("%s host port %d already in use", port.Protocol, port.HostPort)
+		}
+	}
+
+	for protocol, count := range wanted {
+		portRange, ok := s.cfg.HostPortRanges[protocol]
+		if !ok {
+			return fmt.Errorf("no host port range configured for %s", protocol)
+		}
+
+		free := 0
+		for hostPort := portRange.Min; hostPort <= portRange.Max && free < count; hostPort++ {
+			if !usedPortsMap[hostPortKey{protocol, hostPort}] {
+				free++
+			}
+		}
+
+		if free < count {
+			return fmt.Errorf("not enough free %s host ports", protocol)
 		}
 	}
 
+	return nil
+}
+
+// allocateHostPorts returns the container's ports with every HostPort of 0 replaced by a free port from the protocol's range
+func (s *Schedular) allocateHostPorts(container models.Container, node models.Node) ([]models.Port, error) {
+	usedPortsMap := usedHostPorts(node)
 	for _, port := range container.Ports {
-		if usedPortsMap[port.HostPort] {
-			return false
+		usedPortsMap[hostPortKey{port.Protocol, port.HostPort}] = true
+	}
+
+	ports := make([]models.Port, len(container.Ports))
+	for i, port := range container.Ports {
+		ports[i] = port
+		if port.HostPort != 0 {
+			continue
+		}
+
+		portRange := s.cfg.HostPortRanges[port.Protocol]
+		for hostPort := portRange.Min; hostPort <= portRange.Max; hostPort++ {
+			if !usedPortsMap[hostPortKey{port.Protocol, hostPort}] {
+				ports[i].HostPort = hostPort
+				usedPortsMap[hostPortKey{port.Protocol, hostPort}] = true
+				break
+			}
+		}
+
+		if ports[i].HostPort == 0 {
+			return nil, fmt.Errorf("no free %s host port for container port %d", port.Protocol, port.ContainerPort)
+		}
+	}
+
+	return ports, nil
+}
+
+// hostPortKey identifies a host port, tcp and udp ports with the same number do not collide
+type hostPortKey struct {
+	protocol string
+	port     int
+}
+
+// usedHostPorts maps every host port taken on the node
+func usedHostPorts(node models.Node) map[hostPortKey]bool {
+	usedPortsMap := make(map[hostPortKey]bool)
+	for _, c := range node.Containers {
+		for _, port := range c.Ports {
+			usedPortsMap[hostPortKey{port.Protocol, port.HostPort}] = true
 		}
 	}
-	return true
+	return usedPortsMap
 }
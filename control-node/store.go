@@ -0,0 +1,249 @@
+package controlnode
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// Store is the key value store the control node keeps all of its state in.
+// EtcdClient is the production implementation, MemoryStore backs tests without a running etcd.
+// Revisions follow etcd semantics: every write bumps a single store wide revision.
+type Store interface {
+	Get(ctx context.Context, key string, opts ...OpOption) (*GetResponse, error)
+	Put(ctx context.Context, key, value string, opts ...OpOption) error
+	Delete(ctx context.Context, key string, opts ...OpOption) error
+
+	// Txn runs the ops atomically if every comparison holds
+	Txn(ctx context.Context, cmps []Cmp, ops []Op) (*TxnResponse, error)
+
+	// Watch streams changes to the key, or every key under it with WithPrefix, until ctx is cancelled
+	Watch(ctx context.Context, key string, opts ...OpOption) WatchChan
+	// RequestProgress sends the current revision to every watch opened WithProgressNotify
+	RequestProgress(ctx context.Context) error
+
+	// Grant creates a lease, keys put WithLease are deleted once it expires
+	Grant(ctx context.Context, ttl int64) (int64, error)
+	KeepAliveOnce(ctx context.Context, leaseID int64) error
+
+	Close() error
+}
+
+// ErrLeaseNotFound is returned when keeping alive a lease that has expired or never existed
+var ErrLeaseNotFound = errors.New("lease not found")
+
+// KeyValue is a stored key along with the revisions it was created and last modified at
+type KeyValue struct {
+	Key            string
+	Value          []byte
+	CreateRevision int64
+	ModRevision    int64
+	Lease          int64
+}
+
+type GetResponse struct {
+	Kvs      []KeyValue
+	Count    int64 // Number of matching keys, set even WithCountOnly
+	Revision int64 // Store revision the read was served at
+}
+
+type TxnResponse struct {
+	Succeeded bool
+	Revision  int64
+	Responses []*GetResponse // One per op, nil for anything but a get
+}
+
+// OpOption configures a single store operation, mirroring the clientv3 options the control node uses
+type OpOption func(*opOptions)
+
+type opOptions struct {
+	prefix         bool
+	countOnly      bool
+	prevKV         bool
+	progressNotify bool
+	revision       int64
+	lease          int64
+}
+
+func newOpOptions(opts []OpOption) opOptions {
+	var options opOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// WithPrefix matches every key starting with the given key
+func WithPrefix() OpOption { return func(o *opOptions) { o.prefix = true } }
+
+// WithCountOnly only returns how many keys matched
+func WithCountOnly() OpOption { return func(o *opOptions) { o.countOnly = true } }
+
+// WithPrevKV includes the previous value of a key in watch events
+func WithPrevKV() OpOption { return func(o *opOptions) { o.prevKV = true } }
+
+// WithProgressNotify lets a watch receive empty responses carrying the current revision
+func WithProgressNotify() OpOption { return func(o *opOptions) { o.progressNotify = true } }
+
+// WithRev starts a watch at the given revision
+func WithRev(revision int64) OpOption { return func(o *opOptions) { o.revision = revision } }
+
+// WithLease attaches a put key to a lease
+func WithLease(leaseID int64) OpOption { return func(o *opOptions) { o.lease = leaseID } }
+
+type OpType int
+
+const (
+	OpTypeGet OpType = iota
+	OpTypePut
+	OpTypeDelete
+)
+
+// Op is a single operation in a transaction
+type Op struct {
+	Type    OpType
+	Key     string
+	Value   string
+	options opOptions
+}
+
+func OpGet(key string, opts ...OpOption) Op {
+	return Op{Type: OpTypeGet, Key: key, options: newOpOptions(opts)}
+}
+
+func OpPut(key, value string, opts ...OpOption) Op {
+	return Op{Type: OpTypePut, Key: key, Value: value, options: newOpOptions(opts)}
+}
+
+func OpDelete(key string, opts ...OpOption) Op {
+	return Op{Type: OpTypeDelete, Key: key, options: newOpOptions(opts)}
+}
+
+// Cmp is a transaction guard, the only comparison the control node needs is on a key's mod revision.
+// A mod revision of 0 means the key must not exist.
+type Cmp struct {
+	Key         string
+	ModRevision int64
+}
+
+func CompareModRevision(key string, modRevision int64) Cmp {
+	return Cmp{Key: key, ModRevision: modRevision}
+}
+
+type WatchEventType int
+
+const (
+	EventTypePut WatchEventType = iota
+	EventTypeDelete
+)
+
+type WatchEvent struct {
+	Type   WatchEventType
+	Kv     KeyValue  // For deletes only the key and mod revision are set
+	PrevKv *KeyValue // Only set for watches opened WithPrevKV
+}
+
+// IsCreate reports whether the event created the key
+func (event WatchEvent) IsCreate() bool {
+	return event.Type == EventTypePut && event.Kv.CreateRevision == event.Kv.ModRevision
+}
+
+// WatchResponse holds the events from a single revision, or none for a progress notification
+type WatchResponse struct {
+	Revision        int64
+	Events          []WatchEvent
+	CompactRevision int64 // Set when the requested revision has been compacted away, the watch is closed after
+	Err             error
+}
+
+type WatchChan <-chan WatchResponse
+
+// All Storable models will implement this interface
+type Storable interface {
+	Key() string            // Generates a unique etcd key for the entity.
+	Value() (string, error) // Serializes the entity to a string for storage.
+}
+
+func saveEntity(store Store, entity Storable) error {
+	key := entity.Key()
+
+	valueStr, err := entity.Value()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return store.Put(ctx, key, valueStr)
+}
+
+// ErrConflict is returned when an entity changed between being read and written
+var ErrConflict = errors.New("resource has been modified, reload and try again")
+
+const conflictRetries = 5
+
+// VersionedEntity is an entity with the resource version (etcd ModRevision) it was read at.
+// A resource version of 0 means the key must not exist yet.
+type VersionedEntity struct {
+	Entity          Storable
+	ResourceVersion int64
+	Delete          bool // Delete the entity's key instead of writing it
+}
+
+// updateEntity writes the entity only if it has not changed since it was read at resourceVersion
+func updateEntity(ctx context.Context, store Store, entity Storable, resourceVersion int64) error {
+	return updateEntities(ctx, store, VersionedEntity{Entity: entity, ResourceVersion: resourceVersion})
+}
+
+// updateEntities writes, or deletes, every entity in a single transaction, only if none of them have changed since they were read.
+// Writes made with a leader's context also fail once it is no longer the leader, see WithLeaderFence.
+func updateEntities(ctx context.Context, store Store, entities ...VersionedEntity) error {
+	cmps := leaderFence(ctx)
+	ops := make([]Op, 0, len(entities))
+
+	for _, versioned := range entities {
+		key := versioned.Entity.Key()
+		cmps = append(cmps, CompareModRevision(key, versioned.ResourceVersion))
+
+		if versioned.Delete {
+			ops = append(ops, OpDelete(key))
+			continue
+		}
+
+		valueStr, err := versioned.Entity.Value()
+		if err != nil {
+			return err
+		}
+		ops = append(ops, OpPut(key, valueStr))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	resp, err := store.Txn(ctx, cmps, ops)
+	if err != nil {
+		return err
+	}
+
+	if !resp.Succeeded {
+		return ErrConflict
+	}
+
+	return nil
+}
+
+// retryOnConflict reruns a read-modify-write until it does not conflict with another writer
+func retryOnConflict(fn func() error) error {
+	var err error
+	for attempt := 0; attempt < conflictRetries; attempt++ {
+		if err = fn(); !errors.Is(err, ErrConflict) {
+			return err
+		}
+
+		// Jitter so competing writers do not retry in lockstep
+		time.Sleep(time.Duration(rand.Intn(50)) * time.Millisecond)
+	}
+	return err
+}
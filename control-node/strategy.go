@@ -0,0 +1,94 @@
+package controlnode
+
+import (
+	"0xKowalski1/container-orchestrator/models"
+	"fmt"
+	"math/rand"
+)
+
+const (
+	StrategyBinPack        = "binpack"         // Fill the most allocated nodes first to keep the number of busy hosts down
+	StrategySpread         = "spread"          // Place on the least allocated node first
+	StrategyLeastAllocated = "least-allocated" // Alias of spread
+	StrategyRandom         = "random"          // Any feasible node
+
+	DefaultSchedulingStrategy = StrategySpread
+)
+
+// SchedulingStrategy ranks the nodes that passed the schedular's filters, the highest scoring node is picked.
+// Filtering is the same for every strategy, a node that cannot run the container is never a choice.
+type SchedulingStrategy interface {
+	Score(container models.Container, node models.Node) float64
+}
+
+// ValidateSchedulingStrategy returns an error unless name is a strategy the schedular knows
+func ValidateSchedulingStrategy(name string) error {
+	if _, ok := newSchedulingStrategies(0)[name]; !ok {
+		return fmt.Errorf("unknown scheduling strategy %q, expected one of %s, %s, %s or %s", name, StrategyBinPack, StrategySpread, StrategyLeastAllocated, StrategyRandom)
+	}
+	return nil
+}
+
+// portCapacity is the number of host ports a node can hand out, used to measure host port pressure
+func newSchedulingStrategies(portCapacity int) map[string]SchedulingStrategy {
+	return map[string]SchedulingStrategy{
+		StrategyBinPack:        BinPackStrategy{PortCapacity: portCapacity},
+		StrategySpread:         SpreadStrategy{PortCapacity: portCapacity},
+		StrategyLeastAllocated: SpreadStrategy{PortCapacity: portCapacity},
+		StrategyRandom:         RandomStrategy{},
+	}
+}
+
+// BinPackStrategy prefers the node that would be most allocated after placing the container
+type BinPackStrategy struct {
+	PortCapacity int
+}
+
+func (strategy BinPackStrategy) Score(container models.Container, node models.Node) float64 {
+	return nodeAllocation(container, node, strategy.PortCapacity)
+}
+
+// SpreadStrategy prefers the node that would be least allocated after placing the container
+type SpreadStrategy struct {
+	PortCapacity int
+}
+
+func (strategy SpreadStrategy) Score(container models.Container, node models.Node) float64 {
+	return 1 - nodeAllocation(container, node, strategy.PortCapacity)
+}
+
+// RandomStrategy scores every node randomly
+type RandomStrategy struct{}
+
+func (RandomStrategy) Score(container models.Container, node models.Node) float64 {
+	return rand.Float64()
+}
+
+// nodeAllocation is the average pressure on memory, cpu, storage and host ports once the container is placed, from 0 to 1
+func nodeAllocation(container models.Container, node models.Node, portCapacity int) float64 {
+	usedPorts := 0
+	for _, c := range node.Containers {
+		usedPorts += len(c.Ports)
+	}
+
+	pressures := []float64{
+		ratio(node.MemoryUsed+container.MemoryLimit, node.MemoryLimit),
+		ratio(node.CpuUsed+container.CpuLimit, node.CpuLimit),
+		ratio(node.StorageUsed+container.StorageLimit, node.StorageLimit),
+		ratio(usedPorts+len(container.Ports), portCapacity),
+	}
+
+	total := 0.0
+	for _, pressure := range pressures {
+		total += pressure
+	}
+
+	return total / float64(len(pressures))
+}
+
+func ratio(used, limit int) float64 {
+	if limit <= 0 {
+		return 1
+	}
+	return min(float64(used)/float64(limit), 1)
+}
@@ -1,9 +1,71 @@
 package models
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
+
+// What happens to a container when the node it is bound to fails
+const (
+	ReschedulePolicyReschedule = "reschedule"  // Unbind and schedule elsewhere, the volume on the failed node is lost (default)
+	ReschedulePolicyKeepPinned = "keep-pinned" // Wait for the node to come back, keeps the node local volume
+)
+
+// What the worker does when a container exits while it is meant to be running
+const (
+	RestartPolicyAlways    = "Always"    // Restart whatever the exit code (default)
+	RestartPolicyOnFailure = "OnFailure" // Restart after a non zero exit code or OOM kill
+	RestartPolicyNever     = "Never"     // Leave it stopped
+)
+
+// StatusCrashLoopBackOff is the status of a container waiting out its backoff before the worker restarts it
+const StatusCrashLoopBackOff = "CrashLoopBackOff"
+
+// Why a container's last run ended
+const (
+	ExitReasonCompleted = "Completed" // Exited with code 0 while it was meant to be running
+	ExitReasonError     = "Error"     // Exited with a non zero code while it was meant to be running
+	ExitReasonOOMKilled = "OOMKilled" // Killed for exceeding its memory limit
+	ExitReasonStopped   = "Stopped"   // Stopped on purpose, its desired status was stopped or it was unassigned from the node
+)
+
+// Container condition types, each reports whether one part of running the container on its node is working
+const (
+	ContainerConditionCreated    = "Created"    // Image pulled and the container created on the node
+	ContainerConditionReconciled = "Reconciled" // Started or stopped to match the desired status
+	ContainerConditionReady      = "Ready"      // Running and passing its readiness probe, e.g. the world has loaded
+	ContainerConditionLive       = "Live"       // Passing its liveness probe, only reported for containers with one
+)
+
+// Container condition reasons
+const (
+	ConditionReasonImagePullFailed = "ImagePullFailed"
+	ConditionReasonCreateFailed    = "CreateFailed"
+	ConditionReasonCreated         = "Created"
+	ConditionReasonStartFailed     = "StartFailed"
+	ConditionReasonStopFailed      = "StopFailed"
+	ConditionReasonReconciled      = "Reconciled"
+	ConditionReasonBackOff         = "BackOff"             // Left stopped until its restart backoff is over
+	ConditionReasonRestartPolicy   = "RestartPolicy"       // Left stopped, its restart policy does not restart it
+	ConditionReasonRestartLimit    = "RestartLimitReached" // Left stopped after MaxRestarts restarts
+	ConditionReasonStarted         = "Started"             // Ready as soon as it starts, it has no readiness probe
+	ConditionReasonStarting        = "Starting"            // Waiting for the readiness probe to pass
+	ConditionReasonProbeSucceeded  = "ProbeSucceeded"
+	ConditionReasonProbeFailed     = "ProbeFailed"
+	ConditionReasonNotRunning      = "NotRunning"
+)
+
+// ContainerCondition is the latest observation of one condition type, reported by the worker running the container
+type ContainerCondition struct {
+	Type               string    `json:"type"`
+	Status             bool      `json:"status"`
+	Reason             string    `json:"reason"`
+	Message            string    `json:"message,omitempty"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"` // When Status last changed
+}
 
 type Port struct {
-	HostPort      int    `json:"hostPort"`
+	HostPort      int    `json:"hostPort"` // 0 lets the schedular assign a free port from the configured range
 	ContainerPort int    `json:"containerPort"`
 	Protocol      string `json:"protocol"` // tcp or udp
 }
@@ -29,6 +91,44 @@ type Container struct {
 	CpuLimit      int
 	StorageLimit  int
 	Ports         []Port
+
+	ReschedulePolicy   string // reschedule or keep-pinned, empty means reschedule
+	SchedulingStrategy string // Overrides the configured scheduling strategy when set
+
+	RestartPolicy string // Always, OnFailure or Never, empty means Always
+	MaxRestarts   int    // Consecutive restarts before the worker gives up, 0 for no limit
+
+	ReadinessProbe *Probe // Without one the container is Ready once it starts
+	LivenessProbe  *Probe // Restarted under its restart policy once this fails
+
+	NodeSelector map[string]string // Node must have every label
+	NodeAffinity *NodeAffinity
+	Tolerations  []Toleration
+
+	Labels         map[string]string
+	AntiAffinity   []ContainerAntiAffinity
+	TopologySpread []TopologySpreadConstraint
+
+	Priority     int  // Higher priority containers are scheduled first and may preempt lower priority ones
+	NeverPreempt bool // Never stopped to make room for a higher priority container
+
+	PreemptedDesiredStatus string // Set while a preempted container stops on its node, the desired status it gets back once unbound
+
+	SchedulingMessage string // Why the last scheduling attempt failed, cleared once scheduled
+
+	StartedAt     *time.Time // When the current, or last, run started
+	ExitCode      *int       // Exit code of the last run, nil if it has never exited
+	ExitedAt      *time.Time
+	OOMKilled     bool       // The last run was killed for exceeding its memory limit
+	ExitReason    string     // Completed, Error, OOMKilled or Stopped, tells a crash apart from a deliberate stop
+	RestartCount  int        // Runs started after the previous one ended while the container was meant to be running
+	NextRestartAt *time.Time // When the worker restarts a container in CrashLoopBackOff
+
+	Conditions []ContainerCondition // One per type, e.g. Created is false with ImagePullFailed if the image could not be pulled
+
+	ServerInfo *ServerInfo // Player counts and version from a game query probe, cleared when the container exits
+
+	ResourceVersion int64 // etcd ModRevision the container was read at, not persisted
 }
 
 // Container
@@ -41,6 +141,26 @@ type CreateContainerRequest struct {
 	CpuLimit     int      `json:"cpuLimit"`
 	StorageLimit int      `json:"storageLimit"`
 	Ports        []Port   `json:"ports"`
+
+	ReschedulePolicy   string `json:"reschedulePolicy"`
+	SchedulingStrategy string `json:"schedulingStrategy"`
+
+	RestartPolicy string `json:"restartPolicy"`
+	MaxRestarts   int    `json:"maxRestarts"`
+
+	ReadinessProbe *Probe `json:"readinessProbe"`
+	LivenessProbe  *Probe `json:"livenessProbe"`
+
+	NodeSelector map[string]string `json:"nodeSelector"`
+	NodeAffinity *NodeAffinity     `json:"nodeAffinity"`
+	Tolerations  []Toleration      `json:"tolerations"`
+
+	Labels         map[string]string          `json:"labels"`
+	AntiAffinity   []ContainerAntiAffinity    `json:"antiAffinity"`
+	TopologySpread []TopologySpreadConstraint `json:"topologySpread"`
+
+	Priority     int  `json:"priority"`
+	NeverPreempt bool `json:"neverPreempt"`
 }
 
 type UpdateContainerRequest struct {
@@ -51,6 +171,30 @@ type UpdateContainerRequest struct {
 	CpuLimit      int     `json:"cpuLimit"`
 	StorageLimit  int     `json:"storageLimit"`
 	Ports         []Port  `json:"ports"`
+
+	SchedulingMessage *string `json:"schedulingMessage,omitempty"`
+
+	// Reported by the worker running the container
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+	ExitCode  *int       `json:"exitCode,omitempty"` // Set along with ExitedAt and OOMKilled when the container exits
+	ExitedAt  *time.Time `json:"exitedAt,omitempty"`
+	OOMKilled *bool      `json:"oomKilled,omitempty"`
+
+	NextRestartAt *time.Time `json:"nextRestartAt,omitempty"` // Sent with the CrashLoopBackOff status
+
+	Conditions []ContainerCondition `json:"conditions,omitempty"` // Replaces the conditions of the same types, others are kept
+
+	ServerInfo *ServerInfo `json:"serverInfo,omitempty"` // Sent when a game query probe's answer changes
+}
+
+// Condition returns the container's condition of the given type, nil if it has not been reported
+func (c Container) Condition(conditionType string) *ContainerCondition {
+	for i := range c.Conditions {
+		if c.Conditions[i].Type == conditionType {
+			return &c.Conditions[i]
+		}
+	}
+	return nil
 }
 
 func (c Container) Key() string {
@@ -58,6 +202,8 @@ func (c Container) Key() string {
 }
 
 func (c Container) Value() (string, error) {
+	c.ResourceVersion = 0 // Comes from etcd on read
+
 	bytes, err := json.Marshal(c)
 	if err != nil {
 		return "", err
@@ -0,0 +1,141 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ContainerEvent is a single entry in a container's history, e.g. it was rescheduled off a failed node
+type ContainerEvent struct {
+	ContainerID string    `json:"containerId"`
+	NamespaceID string    `json:"namespaceId"`
+	Reason      string    `json:"reason"`     // Short machine readable reason, e.g. Rescheduled
+	Message     string    `json:"message"`    // Human readable detail
+	Source      string    `json:"source"`     // Component that recorded the event, control-node or a node ID
+	Time        time.Time `json:"time"`       // When it happened by the clock of the component that recorded it
+	ReceivedAt  time.Time `json:"receivedAt"` // When the control node stored it, events are listed in this order
+	ID          string    `json:"id"`         // Tells apart events received in the same instant
+}
+
+func (e ContainerEvent) Key() string {
+	// Keyed by when the control node received it, a worker's clock can be skewed. Zero padded so events sort in that
+	// order within the container prefix.
+	return fmt.Sprintf("/namespaces/%s/events/%s/%020d-%s", e.NamespaceID, e.ContainerID, e.ReceivedAt.UnixNano(), e.ID)
+}
+
+func (e ContainerEvent) Value() (string, error) {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+// Container event reasons
+const (
+	EventReasonScheduled           = "Scheduled"
+	EventReasonPulled              = "Pulled"
+	EventReasonStarted             = "Started"
+	EventReasonExited              = "Exited"
+	EventReasonOOMKilled           = "OOMKilled"
+	EventReasonRestarted           = "Restarted"
+	EventReasonBackOff             = "BackOff"
+	EventReasonRestartLimitReached = "RestartLimitReached"
+	EventReasonUnhealthy           = "Unhealthy" // A readiness or liveness probe failed
+	EventReasonPortConflict        = "PortConflict"
+	EventReasonNetworkSetupFailed  = "NetworkSetupFailed"
+	EventReasonVolumeCreated       = "VolumeCreated"
+	EventReasonVolumeCreateFailed  = "VolumeCreateFailed"
+	EventReasonEvicted             = "Evicted"
+	EventReasonNodeNotReady        = "NodeNotReady"
+	EventReasonRescheduled         = "Rescheduled"
+	EventReasonPreempting          = "Preempting"
+	EventReasonPreempted           = "Preempted"
+)
+
+// RecordContainerEventRequest is sent by workers to POST /events
+type RecordContainerEventRequest struct {
+	ContainerID string    `json:"containerId"`
+	Reason      string    `json:"reason"`
+	Message     string    `json:"message"`
+	Source      string    `json:"source"` // Node ID of the worker recording the event
+	Time        time.Time `json:"time"`   // When it happened on the worker, defaults to when it was received
+}
+
+// Cluster event types streamed from GET /events
+const (
+	ClusterEventContainerCreated       = "ContainerCreated"
+	ClusterEventContainerScheduled     = "ContainerScheduled"
+	ClusterEventContainerUnscheduled   = "ContainerUnscheduled"
+	ClusterEventContainerStatusChanged = "ContainerStatusChanged" // Status or desired status changed
+	ClusterEventContainerDeleted       = "ContainerDeleted"
+	ClusterEventNodeJoined             = "NodeJoined"
+	ClusterEventNodeReady              = "NodeReady" // Node started heartbeating again
+	ClusterEventNodeLost               = "NodeLost"  // Node heartbeat lease expired
+	ClusterEventNodeRemoved            = "NodeRemoved"
+
+	// ClusterEventResync means events were missed, the requested revision is no longer kept or the client fell
+	// behind, reload the full state
+	ClusterEventResync = "Resync"
+)
+
+// ClusterEvent is a single change across the cluster, streamed to clients from GET /events
+type ClusterEvent struct {
+	Type        string     `json:"type"`
+	Revision    int64      `json:"revision"` // etcd revision of the change, resume after it with Last-Event-ID
+	ContainerID string     `json:"containerId,omitempty"`
+	NodeID      string     `json:"nodeId,omitempty"`
+	Container   *Container `json:"container,omitempty"` // Container as it is now, or was before being deleted
+	Previous    *Container `json:"previous,omitempty"`  // Container before the change, for scheduling and status changes
+	Node        *Node      `json:"node,omitempty"`      // Stored node, computed fields such as status are not set
+}
+
+// ClusterEventFilter narrows the cluster event stream, empty fields match everything
+type ClusterEventFilter struct {
+	ContainerID string
+	NodeID      string
+	Types       []string
+}
+
+func (f ClusterEventFilter) Matches(event ClusterEvent) bool {
+	// Resyncs go to everyone, any of their events may have been missed
+	if event.Type == ClusterEventResync {
+		return true
+	}
+
+	if f.ContainerID != "" && event.ContainerID != f.ContainerID {
+		return false
+	}
+
+	if f.NodeID != "" && event.NodeID != f.NodeID && (event.Previous == nil || event.Previous.NodeID != f.NodeID) {
+		return false
+	}
+
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, eventType := range f.Types {
+		if eventType == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// Container status event types streamed from GET /containers/:id/watch
+const (
+	ContainerStatusEventChanged = "Changed"
+	ContainerStatusEventDeleted = "Deleted"
+)
+
+// ContainerStatusEvent is a change to a container's status, desired status or node
+type ContainerStatusEvent struct {
+	Type          string   `json:"type"`
+	ContainerID   string   `json:"containerId"`
+	Revision      int64    `json:"revision"`
+	Status        string   `json:"status"`
+	DesiredStatus string   `json:"desiredStatus"`
+	NodeID        string   `json:"nodeId"`
+	Changed       []string `json:"changed,omitempty"` // Which of status, desiredStatus and nodeId changed
+}
@@ -1,6 +1,15 @@
 package models
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	NodeStatusReady    = "Ready"    // Heartbeat lease is alive
+	NodeStatusNotReady = "NotReady" // Node has heartbeated before but its lease expired
+	NodeStatusUnknown  = "Unknown"  // Node has never sent a heartbeat
+)
 
 type Node struct {
 	ID           string      `json:"id"`
@@ -10,9 +19,18 @@ type Node struct {
 	StorageLimit int         `json:"storageLimit"`
 	NodeIp       string      `json:"nodeIp"`
 
+	Unschedulable bool              `json:"unschedulable"` // Cordoned, the schedular will not place new containers here
+	Labels        map[string]string `json:"labels"`
+	Taints        []Taint           `json:"taints"`
+
 	MemoryUsed  int `json:"memoryUsed"`  // Not to be persisted to etcd
 	CpuUsed     int `json:"cpuUsed"`     // Not to be persisted to etcd
 	StorageUsed int `json:"storageUsed"` // Not to be persisted to etcd
+
+	Status        string    `json:"status"`        // Not to be persisted to etcd, derived from the heartbeat lease
+	LastHeartbeat time.Time `json:"lastHeartbeat"` // Not to be persisted to etcd, read from the heartbeat record
+
+	ResourceVersion int64 `json:"resourceVersion"` // Not to be persisted to etcd, ModRevision the node was read at
 }
 
 type CreateNodeRequest struct {
@@ -21,6 +39,15 @@ type CreateNodeRequest struct {
 	CpuLimit     int    `json:"cpuLimit"`
 	StorageLimit int    `json:"storageLimit"`
 	NodeIp       string `json:"nodeIp"`
+
+	Labels map[string]string `json:"labels"`
+	Taints []Taint           `json:"taints"`
+}
+
+// Pointers allow differentiation between an omitted field and an empty value
+type UpdateNodeRequest struct {
+	Labels *map[string]string `json:"labels,omitempty"`
+	Taints *[]Taint           `json:"taints,omitempty"`
 }
 
 func (n Node) Key() string {
@@ -35,6 +62,10 @@ func (n Node) Value() (string, error) {
 		CpuLimit     int         `json:"cpuLimit"`
 		StorageLimit int         `json:"storageLimit"`
 		NodeIp       string      `json:"nodeIp"`
+
+		Unschedulable bool              `json:"unschedulable"`
+		Labels        map[string]string `json:"labels"`
+		Taints        []Taint           `json:"taints"`
 	}{
 		ID:           n.ID,
 		Containers:   n.Containers,
@@ -42,6 +73,10 @@ func (n Node) Value() (string, error) {
 		CpuLimit:     n.CpuLimit,
 		StorageLimit: n.StorageLimit,
 		NodeIp:       n.NodeIp,
+
+		Unschedulable: n.Unschedulable,
+		Labels:        n.Labels,
+		Taints:        n.Taints,
 	}
 
 	bytes, err := json.Marshal(serializedNode)
@@ -50,3 +85,32 @@ func (n Node) Value() (string, error) {
 	}
 	return string(bytes), nil
 }
+
+// Last heartbeat received from a node, kept after the lease expires so we know when a node was last seen
+type NodeHeartbeat struct {
+	NodeID string    `json:"nodeId"`
+	Time   time.Time `json:"time"`
+}
+
+func (h NodeHeartbeat) Key() string {
+	return "/heartbeats/" + h.NodeID
+}
+
+// LeaseKey is attached to an etcd lease, it disappears when the node stops heartbeating
+func (h NodeHeartbeat) LeaseKey() string {
+	return "/leases/nodes/" + h.NodeID
+}
+
+func (h NodeHeartbeat) Value() (string, error) {
+	bytes, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+// Sent over GET /nodes/:id/watch whenever the node's desired state may have changed
+type NodeWatchEvent struct {
+	Revision int64 `json:"revision"` // etcd revision the event was observed at, used to resume the watch
+	Node     Node  `json:"node"`
+}
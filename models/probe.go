@@ -0,0 +1,139 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Probe types
+const (
+	ProbeTypeTCP  = "tcp"  // Connects to the port
+	ProbeTypeUDP  = "udp"  // Sends a datagram to the port and waits for a reply
+	ProbeTypeExec = "exec" // Runs a command inside the container, exit code 0 passes
+	ProbeTypeHTTP = "http" // GETs a path on the port, a 2xx or 3xx response passes
+	ProbeTypeLog  = "log"  // Passes once a line logged since the container started matches a pattern, e.g. "Done \("
+
+	// Game query probes pass when the server answers its query protocol, and report what it answered as ServerInfo
+	ProbeTypeMinecraft = "minecraft" // Minecraft Server List Ping over tcp
+	ProbeTypeA2S       = "a2s"       // Valve A2S_INFO over udp, Source engine and most Steam dedicated servers
+)
+
+// ServerInfo is what a game server last answered to its query probe
+type ServerInfo struct {
+	Players    int    `json:"players"`
+	MaxPlayers int    `json:"maxPlayers"`
+	Version    string `json:"version"`
+	MOTD       string `json:"motd"`          // Minecraft description or A2S server name, formatting codes removed
+	Map        string `json:"map,omitempty"` // A2S only
+}
+
+// Probe is a check the worker runs against a container, as a readiness probe it decides when the container is Ready
+// and as a liveness probe a container that keeps failing it is restarted under its restart policy.
+// Network probes reach the container through the host port its container port is mapped to, the same way players do.
+type Probe struct {
+	Type string `json:"type"`
+
+	Port    int      `json:"port,omitempty"`    // Container port for tcp, udp, http and game query probes
+	Path    string   `json:"path,omitempty"`    // http, defaults to /
+	Send    []byte   `json:"send,omitempty"`    // udp, payload sent to the port, base64 in JSON
+	Expect  string   `json:"expect,omitempty"`  // udp, regex the reply must match, any reply passes if empty
+	Command []string `json:"command,omitempty"` // exec
+	Pattern string   `json:"pattern,omitempty"` // log, regex matched against each line
+
+	InitialDelaySeconds int `json:"initialDelaySeconds,omitempty"` // Wait after the container starts before the first check
+	PeriodSeconds       int `json:"periodSeconds,omitempty"`       // 0 means 10
+	TimeoutSeconds      int `json:"timeoutSeconds,omitempty"`      // 0 means 5
+	FailureThreshold    int `json:"failureThreshold,omitempty"`    // Consecutive failures before the probe fails, 0 means 3
+	SuccessThreshold    int `json:"successThreshold,omitempty"`    // Consecutive successes before the probe passes, 0 means 1
+}
+
+func (p Probe) InitialDelay() time.Duration {
+	return time.Duration(p.InitialDelaySeconds) * time.Second
+}
+
+func (p Probe) Period() time.Duration {
+	if p.PeriodSeconds <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(p.PeriodSeconds) * time.Second
+}
+
+func (p Probe) Timeout() time.Duration {
+	if p.TimeoutSeconds <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(p.TimeoutSeconds) * time.Second
+}
+
+func (p Probe) Failures() int {
+	if p.FailureThreshold <= 0 {
+		return 3
+	}
+	return p.FailureThreshold
+}
+
+func (p Probe) Successes() int {
+	if p.SuccessThreshold <= 0 {
+		return 1
+	}
+	return p.SuccessThreshold
+}
+
+// Validate checks the probe can be run against a container with the given ports
+func (p Probe) Validate(ports []Port) error {
+	switch p.Type {
+	case ProbeTypeTCP, ProbeTypeHTTP, ProbeTypeMinecraft:
+		if !hasPort(ports, p.Port, "tcp") {
+			return fmt.Errorf("%s probe port %d is not a tcp port of the container", p.Type, p.Port)
+		}
+	case ProbeTypeA2S:
+		if !hasPort(ports, p.Port, "udp") {
+			return fmt.Errorf("a2s probe port %d is not a udp port of the container", p.Port)
+		}
+	case ProbeTypeUDP:
+		if !hasPort(ports, p.Port, "udp") {
+			return fmt.Errorf("udp probe port %d is not a udp port of the container", p.Port)
+		}
+		if len(p.Send) == 0 {
+			return fmt.Errorf("udp probe needs a payload to send")
+		}
+		if _, err := regexp.Compile(p.Expect); err != nil {
+			return fmt.Errorf("invalid udp probe expect pattern: %w", err)
+		}
+	case ProbeTypeExec:
+		if len(p.Command) == 0 {
+			return fmt.Errorf("exec probe needs a command")
+		}
+	case ProbeTypeLog:
+		if p.Pattern == "" {
+			return fmt.Errorf("log probe needs a pattern")
+		}
+		if _, err := regexp.Compile(p.Pattern); err != nil {
+			return fmt.Errorf("invalid log probe pattern: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown probe type %q", p.Type)
+	}
+
+	return nil
+}
+
+// HostPort returns the host port the probe's container port is mapped to, 0 if it is not mapped
+func (p Probe) HostPort(ports []Port, protocol string) int {
+	for _, port := range ports {
+		if port.ContainerPort == p.Port && port.Protocol == protocol {
+			return port.HostPort
+		}
+	}
+	return 0
+}
+
+func hasPort(ports []Port, containerPort int, protocol string) bool {
+	for _, port := range ports {
+		if port.ContainerPort == containerPort && port.Protocol == protocol {
+			return true
+		}
+	}
+	return false
+}
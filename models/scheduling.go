@@ -0,0 +1,99 @@
+package models
+
+// Taint effects
+const (
+	TaintEffectNoSchedule       = "NoSchedule"       // Containers that do not tolerate the taint are never scheduled on the node
+	TaintEffectPreferNoSchedule = "PreferNoSchedule" // The schedular avoids the node for containers that do not tolerate the taint
+)
+
+// Toleration operators
+const (
+	TolerationOpEqual  = "Equal"  // Key and value must match (default)
+	TolerationOpExists = "Exists" // Only the key must match, an empty key tolerates every taint
+)
+
+// Node selector operators
+const (
+	SelectorOpIn           = "In"
+	SelectorOpNotIn        = "NotIn"
+	SelectorOpExists       = "Exists"
+	SelectorOpDoesNotExist = "DoesNotExist"
+)
+
+// Taint repels containers from a node unless they tolerate it, e.g. dedicated=modded:NoSchedule
+type Taint struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Effect string `json:"effect"` // NoSchedule or PreferNoSchedule
+}
+
+// Toleration allows a container onto a node with a matching taint
+type Toleration struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"` // Equal or Exists
+	Value    string `json:"value"`
+	Effect   string `json:"effect"` // Empty tolerates every effect
+}
+
+// NodeSelectorRequirement matches a single node label
+type NodeSelectorRequirement struct {
+	Key      string   `json:"key"`
+	Operator string   `json:"operator"` // In, NotIn, Exists or DoesNotExist
+	Values   []string `json:"values"`
+}
+
+// NodeSelectorTerm matches a node when all of its requirements match
+type NodeSelectorTerm struct {
+	MatchExpressions []NodeSelectorRequirement `json:"matchExpressions"`
+}
+
+// PreferredSchedulingTerm adds its weight to the score of nodes matching the preference
+type PreferredSchedulingTerm struct {
+	Weight     int              `json:"weight"`
+	Preference NodeSelectorTerm `json:"preference"`
+}
+
+type NodeAffinity struct {
+	Required  []NodeSelectorTerm        `json:"required"`  // The node must match at least one term
+	Preferred []PreferredSchedulingTerm `json:"preferred"` // Nodes matching more weight are preferred
+}
+
+// ContainerAntiAffinity keeps a container off nodes already running a container matching the selector.
+// An empty selector matches containers with the same labels as the container being scheduled.
+type ContainerAntiAffinity struct {
+	LabelSelector map[string]string `json:"labelSelector"`
+}
+
+// TopologySpreadConstraint limits how unevenly matching containers are spread across the values of a node label.
+// An empty selector matches containers with the same labels as the container being scheduled.
+type TopologySpreadConstraint struct {
+	MaxSkew       int               `json:"maxSkew"`     // Largest allowed difference between the fullest and emptiest domain
+	TopologyKey   string            `json:"topologyKey"` // Node label that defines the domains, nodes without it are not eligible
+	LabelSelector map[string]string `json:"labelSelector"`
+}
+
+// SimulateSchedulingRequest asks the schedular where a container would be placed without placing it
+type SimulateSchedulingRequest struct {
+	ContainerID string                  `json:"containerId,omitempty"` // An existing container
+	Container   *CreateContainerRequest `json:"container,omitempty"`   // Or one that has not been created yet
+}
+
+type FilterResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type NodeSimulation struct {
+	NodeID   string         `json:"nodeId"`
+	Feasible bool           `json:"feasible"` // Passed every filter
+	Filters  []FilterResult `json:"filters"`
+	Score    float64        `json:"score"` // Only set for feasible nodes
+}
+
+type SchedulingSimulation struct {
+	ContainerID  string           `json:"containerId"`
+	Strategy     string           `json:"strategy"`
+	SelectedNode string           `json:"selectedNode"` // Empty when no node is feasible
+	Nodes        []NodeSimulation `json:"nodes"`
+}
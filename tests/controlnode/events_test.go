@@ -0,0 +1,391 @@
+package controlnode_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	controlnode "0xKowalski1/container-orchestrator/control-node"
+	"0xKowalski1/container-orchestrator/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runEventBus starts the bus from the current revision so no change made by the test is missed
+func (tc *testCluster) runEventBus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	resp, err := tc.store.Get(ctx, "/", controlnode.WithPrefix(), controlnode.WithCountOnly())
+	require.NoError(t, err)
+
+	go tc.eventBus.RunFrom(ctx, resp.Revision)
+}
+
+func receiveEvent(t *testing.T, events chan controlnode.Event) controlnode.Event {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+		return controlnode.Event{}
+	}
+}
+
+func TestEventBus_ContainerEvents(t *testing.T) {
+	tc := setup(t)
+	tc.runEventBus(t)
+
+	events := make(chan controlnode.Event, 10)
+	unsubscribe := tc.eventBus.Subscribe(func(event controlnode.Event) { events <- event }, controlnode.ContainerAdded, controlnode.ContainerUpdated, controlnode.ContainerRemoved)
+	defer unsubscribe()
+
+	tc.addNode(t, node("node1", 1024, 2))
+	tc.addContainer(t, container("c1", 256, 1))
+	require.NoError(t, tc.nodeService.AssignContainerToNode(context.Background(), "c1", "node1", nil))
+	require.NoError(t, tc.containerService.DeleteContainer("c1", tc.nodeService))
+
+	added := receiveEvent(t, events)
+	assert.Equal(t, controlnode.ContainerAdded, added.Type)
+	assert.Nil(t, added.OldContainer)
+	require.NotNil(t, added.Container)
+	assert.Equal(t, "c1", added.Container.ID)
+
+	updated := receiveEvent(t, events)
+	assert.Equal(t, controlnode.ContainerUpdated, updated.Type)
+	require.NotNil(t, updated.OldContainer)
+	assert.Empty(t, updated.OldContainer.NodeID)
+	assert.Equal(t, "node1", updated.Container.NodeID)
+	assert.Equal(t, updated.Revision, updated.Container.ResourceVersion)
+
+	removed := receiveEvent(t, events)
+	assert.Equal(t, controlnode.ContainerRemoved, removed.Type)
+	assert.Nil(t, removed.Container)
+	require.NotNil(t, removed.OldContainer)
+	assert.Equal(t, "node1", removed.OldContainer.NodeID)
+}
+
+func TestEventBus_NodeEvents(t *testing.T) {
+	tc := setup(t)
+	tc.runEventBus(t)
+
+	events := make(chan controlnode.Event, 10)
+	unsubscribe := tc.eventBus.Subscribe(func(event controlnode.Event) { events <- event }, controlnode.NodeAdded, controlnode.NodeRemoved)
+	defer unsubscribe()
+
+	tc.addNode(t, node("node1", 1024, 2))
+	require.NoError(t, tc.nodeService.SetUnschedulable("node1", true)) // NodeUpdated is filtered out
+	require.NoError(t, tc.nodeService.DeleteNode("node1", false))
+
+	added := receiveEvent(t, events)
+	assert.Equal(t, controlnode.NodeAdded, added.Type)
+	assert.Equal(t, "node1", added.Node.ID)
+
+	removed := receiveEvent(t, events)
+	assert.Equal(t, controlnode.NodeRemoved, removed.Type)
+	require.NotNil(t, removed.OldNode)
+	assert.True(t, removed.OldNode.Unschedulable)
+}
+
+func TestEventBus_SlowListenerDoesNotBlock(t *testing.T) {
+	tc := setup(t)
+	tc.runEventBus(t)
+
+	release := make(chan struct{})
+	unsubscribeSlow := tc.eventBus.Subscribe(func(event controlnode.Event) { <-release })
+	defer unsubscribeSlow()
+	defer close(release)
+
+	events := make(chan controlnode.Event, 10)
+	unsubscribe := tc.eventBus.Subscribe(func(event controlnode.Event) { events <- event })
+
+	for _, containerID := range []string{"c1", "c2", "c3"} {
+		tc.addContainer(t, container(containerID, 256, 1))
+	}
+
+	for _, containerID := range []string{"c1", "c2", "c3"} {
+		event := receiveEvent(t, events)
+		assert.Equal(t, controlnode.ContainerAdded, event.Type)
+		assert.Equal(t, containerID, event.Container.ID)
+	}
+
+	unsubscribe()
+	tc.addContainer(t, container("c4", 256, 1))
+
+	select {
+	case event := <-events:
+		t.Fatalf("received event after unsubscribing: %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestEventBus_SlowListenerResyncs(t *testing.T) {
+	tc := setup(t)
+	tc.runEventBus(t)
+
+	release := make(chan struct{})
+	slow := make(chan controlnode.Event, controlnode.SubscriberQueueLimit)
+	unsubscribeSlow := tc.eventBus.Subscribe(func(event controlnode.Event) {
+		<-release
+		slow <- event
+	}, controlnode.ContainerAdded)
+	defer unsubscribeSlow()
+
+	added := make(chan controlnode.Event, 1)
+	unsubscribe := tc.eventBus.Subscribe(func(event controlnode.Event) { added <- event }, controlnode.ContainerAdded)
+	defer unsubscribe()
+
+	count := 2 * controlnode.SubscriberQueueLimit
+	for i := 0; i < count; i++ {
+		tc.addContainer(t, container(fmt.Sprintf("c%d", i), 256, 1))
+	}
+
+	// Everything is published once the fast listener has seen the last container, it may have resynced on the way
+	last := fmt.Sprintf("c%d", count-1)
+	for {
+		event := receiveEvent(t, added)
+		if event.Container != nil && event.Container.ID == last {
+			break
+		}
+	}
+	close(release)
+
+	received := 0
+	for {
+		event := receiveEvent(t, slow)
+		if event.Type == controlnode.Resync {
+			break
+		}
+		received++
+	}
+	assert.Less(t, received, count)
+}
+
+func TestSchedular_Run_SchedulesOnEvents(t *testing.T) {
+	tc := setup(t)
+	tc.runEventBus(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tc.schedular.Run(ctx)
+
+	tc.addNode(t, node("node1", 1024, 2))
+	tc.addContainer(t, models.CreateContainerRequest{ID: "c1", Image: "test", MemoryLimit: 256, CpuLimit: 1})
+
+	assert.Eventually(t, func() bool {
+		return tc.container(t, "c1").NodeID == "node1"
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func receiveBatch(t *testing.T, batches <-chan []models.ClusterEvent) []models.ClusterEvent {
+	t.Helper()
+
+	select {
+	case batch, ok := <-batches:
+		require.True(t, ok, "cluster event stream closed")
+		return batch
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for cluster events")
+		return nil
+	}
+}
+
+func TestEventBus_WatchClusterEvents(t *testing.T) {
+	tests := []struct {
+		name     string
+		filter   models.ClusterEventFilter
+		expected []string
+	}{
+		{
+			name: "everything",
+			expected: []string{
+				models.ClusterEventNodeJoined,
+				models.ClusterEventNodeReady,
+				models.ClusterEventContainerCreated,
+				models.ClusterEventContainerScheduled,
+				models.ClusterEventContainerStatusChanged,
+				models.ClusterEventContainerDeleted,
+			},
+		},
+		{
+			name:   "by container",
+			filter: models.ClusterEventFilter{ContainerID: "c1"},
+			expected: []string{
+				models.ClusterEventContainerCreated,
+				models.ClusterEventContainerScheduled,
+				models.ClusterEventContainerStatusChanged,
+				models.ClusterEventContainerDeleted,
+			},
+		},
+		{
+			name:   "by node",
+			filter: models.ClusterEventFilter{NodeID: "node1"},
+			expected: []string{
+				models.ClusterEventNodeJoined,
+				models.ClusterEventNodeReady,
+				models.ClusterEventContainerScheduled,
+				models.ClusterEventContainerStatusChanged,
+				models.ClusterEventContainerDeleted,
+			},
+		},
+		{
+			name:     "by type",
+			filter:   models.ClusterEventFilter{Types: []string{models.ClusterEventNodeJoined, models.ClusterEventContainerDeleted}},
+			expected: []string{models.ClusterEventNodeJoined, models.ClusterEventContainerDeleted},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := setup(t)
+			tc.runEventBus(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			batches := tc.eventBus.WatchClusterEvents(ctx, 0, tt.filter)
+
+			tc.addNode(t, node("node1", 1024, 2))
+			tc.addContainer(t, container("c1", 256, 1))
+			require.NoError(t, tc.nodeService.AssignContainerToNode(context.Background(), "c1", "node1", nil))
+			status := "running"
+			require.NoError(t, tc.containerService.UpdateContainer(context.Background(), "c1", models.UpdateContainerRequest{Status: &status}))
+			require.NoError(t, tc.containerService.DeleteContainer("c1", tc.nodeService))
+
+			// Nodes, containers and leases are watched separately but still arrive in revision order
+			var received []string
+			var lastRevision int64
+			for len(received) < len(tt.expected) {
+				for _, event := range receiveBatch(t, batches) {
+					received = append(received, event.Type)
+					assert.GreaterOrEqual(t, event.Revision, lastRevision)
+					lastRevision = event.Revision
+				}
+			}
+			assert.Equal(t, tt.expected, received)
+		})
+	}
+}
+
+func TestEventBus_WatchClusterEvents_Resume(t *testing.T) {
+	tc := setup(t)
+	tc.runEventBus(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	batches := tc.eventBus.WatchClusterEvents(ctx, 0, models.ClusterEventFilter{})
+
+	tc.addContainer(t, container("c1", 256, 1))
+	created := receiveBatch(t, batches)
+	require.Len(t, created, 1)
+	cancel()
+
+	// Changes made while disconnected are replayed after the last seen revision
+	tc.addContainer(t, container("c2", 256, 1))
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	batches = tc.eventBus.WatchClusterEvents(ctx, created[0].Revision, models.ClusterEventFilter{})
+
+	resumed := receiveBatch(t, batches)
+	require.Len(t, resumed, 1)
+	assert.Equal(t, models.ClusterEventContainerCreated, resumed[0].Type)
+	assert.Equal(t, "c2", resumed[0].ContainerID)
+}
+
+func TestEventBus_WatchClusterEvents_ResumeTooOld(t *testing.T) {
+	tc := setup(t)
+	tc.addNode(t, node("node1", 1024, 2))
+	tc.addContainer(t, container("c1", 256, 1))
+	created := tc.container(t, "c1").ResourceVersion
+
+	// The bus only keeps what it has seen since it started
+	tc.runEventBus(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	live := tc.eventBus.WatchClusterEvents(ctx, 0, models.ClusterEventFilter{})
+	tc.addContainer(t, container("c2", 256, 1))
+	require.Len(t, receiveBatch(t, live), 1)
+
+	batches := tc.eventBus.WatchClusterEvents(ctx, created-1, models.ClusterEventFilter{})
+
+	resumed := receiveBatch(t, batches)
+	require.Len(t, resumed, 2)
+	assert.Equal(t, models.ClusterEventResync, resumed[0].Type)
+	assert.Equal(t, created, resumed[0].Revision)
+	assert.Equal(t, "c2", resumed[1].ContainerID)
+}
+
+func TestContainerService_GetEvents(t *testing.T) {
+	tc := setup(t)
+	tc.addNode(t, node("node1", 1024, 2))
+	tc.addContainer(t, container("c1", 256, 1))
+	tc.addContainer(t, container("c10", 256, 1))
+
+	tc.schedular.ScheduleContainers(context.Background())
+
+	exitedAt := time.Now().Add(time.Minute).UTC()
+	require.NoError(t, tc.containerService.SaveEvent(models.ContainerEvent{ContainerID: "c1", Reason: models.EventReasonOOMKilled, Source: "node1", Time: exitedAt}))
+	require.NoError(t, tc.containerService.SaveEvent(models.ContainerEvent{ContainerID: "c1", Reason: models.EventReasonExited, Message: "Exited with code 137", Source: "node1", Time: exitedAt.Add(time.Millisecond)}))
+
+	events, err := tc.containerService.GetEvents("c1")
+	require.NoError(t, err)
+
+	// c10 shares the c1 prefix but none of its events
+	reasons := make([]string, len(events))
+	for i, event := range events {
+		assert.Equal(t, "c1", event.ContainerID)
+		reasons[i] = event.Reason
+	}
+	assert.Equal(t, []string{models.EventReasonScheduled, models.EventReasonOOMKilled, models.EventReasonExited}, reasons)
+	assert.Equal(t, "control-node", events[0].Source)
+	assert.Equal(t, "node1", events[2].Source)
+	assert.Equal(t, "test", events[2].NamespaceID)
+}
+
+func TestContainerService_SaveEvent_WorkerTime(t *testing.T) {
+	tc := setup(t)
+
+	// Events at the same worker time are all kept, and a worker clock running behind does not reorder history
+	sameTime := time.Now().UTC()
+	require.NoError(t, tc.containerService.SaveEvent(models.ContainerEvent{ContainerID: "c1", Reason: models.EventReasonStarted, Source: "node1", Time: sameTime}))
+	require.NoError(t, tc.containerService.SaveEvent(models.ContainerEvent{ContainerID: "c1", Reason: models.EventReasonExited, Source: "node1", Time: sameTime}))
+	require.NoError(t, tc.containerService.SaveEvent(models.ContainerEvent{ContainerID: "c1", Reason: models.EventReasonRestarted, Source: "node2", Time: sameTime.Add(-time.Hour)}))
+
+	events, err := tc.containerService.GetEvents("c1")
+	require.NoError(t, err)
+
+	reasons := make([]string, len(events))
+	for i, event := range events {
+		reasons[i] = event.Reason
+	}
+	assert.Equal(t, []string{models.EventReasonStarted, models.EventReasonExited, models.EventReasonRestarted}, reasons)
+	assert.True(t, events[2].Time.Equal(sameTime.Add(-time.Hour)))
+}
+
+func TestContainerService_SaveEvent_Expires(t *testing.T) {
+	tc := setup(t)
+	require.NoError(t, tc.containerService.RecordEvent("c1", models.EventReasonScheduled, "Assigned to node node1"))
+
+	resp, err := tc.store.Get(context.Background(), "/namespaces/test/events/c1/", controlnode.WithPrefix())
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 1)
+	require.NotZero(t, resp.Kvs[0].Lease)
+
+	// Expiring the shared lease drops the events, later events get a fresh lease
+	tc.store.Revoke(resp.Kvs[0].Lease)
+
+	events, err := tc.containerService.GetEvents("c1")
+	require.NoError(t, err)
+	assert.Empty(t, events)
+
+	require.NoError(t, tc.containerService.RecordEvent("c1", models.EventReasonRescheduled, "Rescheduled off node node1"))
+	events, err = tc.containerService.GetEvents("c1")
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, models.EventReasonRescheduled, events[0].Reason)
+}
@@ -0,0 +1,399 @@
+package controlnode_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	controlnode "0xKowalski1/container-orchestrator/control-node"
+	"0xKowalski1/container-orchestrator/models"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerHandler_CreateContainer(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		expectedCode int
+		expectedErr  string // Part of the error message, empty if the container should be created
+	}{
+		{
+			name:         "defaults",
+			body:         `{"id": "c1", "image": "test"}`,
+			expectedCode: http.StatusCreated,
+		},
+		{
+			name:         "known scheduling strategy",
+			body:         `{"id": "c1", "image": "test", "schedulingStrategy": "binpack"}`,
+			expectedCode: http.StatusCreated,
+		},
+		{
+			name:         "unknown scheduling strategy",
+			body:         `{"id": "c1", "image": "test", "schedulingStrategy": "bin-pack"}`,
+			expectedCode: http.StatusBadRequest,
+			expectedErr:  `Unknown scheduling strategy "bin-pack"`,
+		},
+		{
+			name:         "keep-pinned reschedule policy",
+			body:         `{"id": "c1", "image": "test", "reschedulePolicy": "keep-pinned"}`,
+			expectedCode: http.StatusCreated,
+		},
+		{
+			name:         "unknown reschedule policy",
+			body:         `{"id": "c1", "image": "test", "reschedulePolicy": "pinned"}`,
+			expectedCode: http.StatusBadRequest,
+			expectedErr:  `Unknown reschedule policy "pinned"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := setup(t)
+			handler := controlnode.NewContainerHandler(tc.containerService, tc.nodeService)
+
+			rec := serve(t, handler.CreateContainer, http.MethodPost, tt.body)
+
+			assert.Equal(t, tt.expectedCode, rec.Code)
+			if tt.expectedErr != "" {
+				var resp struct{ Error string }
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+				assert.Contains(t, resp.Error, tt.expectedErr)
+				_, err := tc.containerService.GetContainer("c1")
+				assert.Error(t, err)
+				return
+			}
+			tc.container(t, "c1")
+		})
+	}
+}
+
+func TestNodeHandler_JoinCluster(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		expectedCode int
+	}{
+		{
+			name:         "labels and taints",
+			body:         `{"id": "node1", "labels": {"disk": "nvme"}, "taints": [{"key": "dedicated", "value": "modded", "effect": "NoSchedule"}]}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "taint without a key",
+			body:         `{"id": "node1", "taints": [{"value": "modded", "effect": "NoSchedule"}]}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "taint with an unknown effect",
+			body:         `{"id": "node1", "taints": [{"key": "dedicated", "effect": "NoExecute"}]}`,
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := setup(t)
+
+			rec := serve(t, controlnode.NewNodeHandler(tc.nodeService).JoinCluster, http.MethodPost, tt.body)
+
+			assert.Equal(t, tt.expectedCode, rec.Code)
+			joined, err := tc.nodeService.GetNode("node1")
+			require.NoError(t, err)
+			if tt.expectedCode != http.StatusOK {
+				assert.Nil(t, joined)
+				return
+			}
+			require.NotNil(t, joined)
+			assert.Equal(t, map[string]string{"disk": "nvme"}, joined.Labels)
+			assert.Equal(t, []models.Taint{{Key: "dedicated", Value: "modded", Effect: models.TaintEffectNoSchedule}}, joined.Taints)
+		})
+	}
+}
+
+func TestNodeHandler_UpdateNode(t *testing.T) {
+	tests := []struct {
+		name           string
+		nodeID         string
+		body           string
+		expectedCode   int
+		expectedLabels map[string]string
+		expectedTaints []models.Taint
+	}{
+		{
+			name:           "replaces labels and keeps taints",
+			nodeID:         "node1",
+			body:           `{"labels": {"disk": "ssd"}}`,
+			expectedCode:   http.StatusOK,
+			expectedLabels: map[string]string{"disk": "ssd"},
+			expectedTaints: []models.Taint{{Key: "shared", Effect: models.TaintEffectPreferNoSchedule}},
+		},
+		{
+			name:           "clears taints",
+			nodeID:         "node1",
+			body:           `{"taints": []}`,
+			expectedCode:   http.StatusOK,
+			expectedLabels: map[string]string{"disk": "nvme"},
+			expectedTaints: []models.Taint{},
+		},
+		{
+			name:           "invalid taint",
+			nodeID:         "node1",
+			body:           `{"taints": [{"key": "dedicated", "effect": "Sometimes"}]}`,
+			expectedCode:   http.StatusBadRequest,
+			expectedLabels: map[string]string{"disk": "nvme"},
+			expectedTaints: []models.Taint{{Key: "shared", Effect: models.TaintEffectPreferNoSchedule}},
+		},
+		{
+			name:         "unknown node",
+			nodeID:       "missing",
+			body:         `{"labels": {}}`,
+			expectedCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := setup(t)
+			req := node("node1", 1024, 2)
+			req.Labels = map[string]string{"disk": "nvme"}
+			req.Taints = []models.Taint{{Key: "shared", Effect: models.TaintEffectPreferNoSchedule}}
+			tc.addNode(t, req)
+
+			rec := serve(t, controlnode.NewNodeHandler(tc.nodeService).UpdateNode, http.MethodPatch, tt.body, "id", tt.nodeID)
+
+			assert.Equal(t, tt.expectedCode, rec.Code)
+			if tt.expectedLabels == nil {
+				return
+			}
+			updated := tc.node(t, "node1")
+			assert.Equal(t, tt.expectedLabels, updated.Labels)
+			assert.Equal(t, tt.expectedTaints, updated.Taints)
+		})
+	}
+}
+
+func TestNodeHandler_NodeLifecycle(t *testing.T) {
+	tests := []struct {
+		name          string
+		handler       func(handler *controlnode.NodeHandler) echo.HandlerFunc
+		method        string
+		nodeID        string
+		cordoned      bool
+		withContainer bool
+		expectedCode  int
+		check         func(t *testing.T, tc *testCluster) // Optional, run after the request
+	}{
+		{
+			name:         "cordon",
+			handler:      func(handler *controlnode.NodeHandler) echo.HandlerFunc { return handler.CordonNode },
+			method:       http.MethodPost,
+			nodeID:       "node1",
+			expectedCode: http.StatusOK,
+			check: func(t *testing.T, tc *testCluster) {
+				assert.True(t, tc.node(t, "node1").Unschedulable)
+			},
+		},
+		{
+			name:         "cordon unknown node",
+			handler:      func(handler *controlnode.NodeHandler) echo.HandlerFunc { return handler.CordonNode },
+			method:       http.MethodPost,
+			nodeID:       "missing",
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "uncordon",
+			handler:      func(handler *controlnode.NodeHandler) echo.HandlerFunc { return handler.UncordonNode },
+			method:       http.MethodPost,
+			nodeID:       "node1",
+			cordoned:     true,
+			expectedCode: http.StatusOK,
+			check: func(t *testing.T, tc *testCluster) {
+				assert.False(t, tc.node(t, "node1").Unschedulable)
+			},
+		},
+		{
+			name:         "drain unknown node",
+			handler:      func(handler *controlnode.NodeHandler) echo.HandlerFunc { return handler.DrainNode },
+			method:       http.MethodPost,
+			nodeID:       "missing",
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "delete empty node",
+			handler:      func(handler *controlnode.NodeHandler) echo.HandlerFunc { return handler.DeleteNode },
+			method:       http.MethodDelete,
+			nodeID:       "node1",
+			expectedCode: http.StatusOK,
+			check: func(t *testing.T, tc *testCluster) {
+				deleted, err := tc.nodeService.GetNode("node1")
+				require.NoError(t, err)
+				assert.Nil(t, deleted)
+			},
+		},
+		{
+			name:          "delete node with containers",
+			handler:       func(handler *controlnode.NodeHandler) echo.HandlerFunc { return handler.DeleteNode },
+			method:        http.MethodDelete,
+			nodeID:        "node1",
+			withContainer: true,
+			expectedCode:  http.StatusConflict,
+			check: func(t *testing.T, tc *testCluster) {
+				assert.Equal(t, "node1", tc.container(t, "c1").NodeID)
+			},
+		},
+		{
+			name:         "delete unknown node",
+			handler:      func(handler *controlnode.NodeHandler) echo.HandlerFunc { return handler.DeleteNode },
+			method:       http.MethodDelete,
+			nodeID:       "missing",
+			expectedCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := setup(t)
+			tc.addNode(t, node("node1", 1024, 2))
+			require.NoError(t, tc.nodeService.SetUnschedulable("node1", tt.cordoned))
+			if tt.withContainer {
+				tc.addContainer(t, container("c1", 256, 1))
+				require.NoError(t, tc.nodeService.AssignContainerToNode(context.Background(), "c1", "node1", nil))
+			}
+
+			rec := serve(t, tt.handler(controlnode.NewNodeHandler(tc.nodeService)), tt.method, "", "id", tt.nodeID)
+
+			assert.Equal(t, tt.expectedCode, rec.Code)
+			if tt.check != nil {
+				tt.check(t, tc)
+			}
+		})
+	}
+}
+
+func TestSchedularHandler_Simulate(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		expectedCode   int
+		expectedNode   string            // Empty if no node is feasible
+		expectedFailed map[string]string // NodeID -> the one filter it fails
+	}{
+		{
+			name:           "existing container",
+			body:           `{"containerId": "c1"}`,
+			expectedCode:   http.StatusOK,
+			expectedNode:   "node1",
+			expectedFailed: map[string]string{"node2": "NodeSchedulable"},
+		},
+		{
+			name:           "container request too big for the schedulable node",
+			body:           `{"container": {"id": "c2", "image": "test", "memoryLimit": 2048, "cpuLimit": 1, "storageLimit": 1}}`,
+			expectedCode:   http.StatusOK,
+			expectedFailed: map[string]string{"node1": "FreeResources", "node2": "NodeSchedulable"},
+		},
+		{
+			name:         "unknown container",
+			body:         `{"containerId": "missing"}`,
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "unknown scheduling strategy",
+			body:         `{"container": {"id": "c2", "image": "test", "schedulingStrategy": "bin-pack"}}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "neither a container nor its ID",
+			body:         `{}`,
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := setup(t)
+			tc.addNode(t, node("node1", 1024, 2))
+			tc.addNode(t, node("node2", 4096, 4))
+			require.NoError(t, tc.nodeService.SetUnschedulable("node2", true))
+			tc.addContainer(t, container("c1", 512, 1))
+
+			before, err := tc.store.Get(context.Background(), "/", controlnode.WithPrefix())
+			require.NoError(t, err)
+
+			rec := serve(t, controlnode.NewSchedularHandler(tc.schedular, tc.containerService).Simulate, http.MethodPost, tt.body)
+
+			// Simulating never writes, not even a scheduling message
+			after, err := tc.store.Get(context.Background(), "/", controlnode.WithPrefix())
+			require.NoError(t, err)
+			assert.Equal(t, before.Revision, after.Revision)
+
+			require.Equal(t, tt.expectedCode, rec.Code)
+			if tt.expectedCode != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Simulation models.SchedulingSimulation
+			}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.Equal(t, tt.expectedNode, resp.Simulation.SelectedNode)
+			assert.Equal(t, "spread", resp.Simulation.Strategy)
+			require.Len(t, resp.Simulation.Nodes, 2)
+
+			for _, nodeSimulation := range resp.Simulation.Nodes {
+				var failed []string
+				for _, filter := range nodeSimulation.Filters {
+					if !filter.Passed {
+						assert.NotEmpty(t, filter.Reason, filter.Name)
+						failed = append(failed, filter.Name)
+					}
+				}
+
+				if expected, ok := tt.expectedFailed[nodeSimulation.NodeID]; ok {
+					assert.Equal(t, []string{expected}, failed, nodeSimulation.NodeID)
+					assert.False(t, nodeSimulation.Feasible, nodeSimulation.NodeID)
+					continue
+				}
+				assert.Empty(t, failed, nodeSimulation.NodeID)
+				assert.True(t, nodeSimulation.Feasible, nodeSimulation.NodeID)
+				assert.Positive(t, nodeSimulation.Score, nodeSimulation.NodeID)
+			}
+		})
+	}
+}
+
+func TestValidateSchedulingStrategy(t *testing.T) {
+	for _, name := range []string{"binpack", "spread", "least-allocated", "random"} {
+		assert.NoError(t, controlnode.ValidateSchedulingStrategy(name), name)
+	}
+	for _, name := range []string{"", "Spread", "bin-pack"} {
+		assert.Error(t, controlnode.ValidateSchedulingStrategy(name), name)
+	}
+}
+
+// serve runs a handler against a JSON request, params are path parameter names and values in pairs
+func serve(t *testing.T, handler echo.HandlerFunc, method, body string, params ...string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+
+	var names, values []string
+	for i := 0; i+1 < len(params); i += 2 {
+		names = append(names, params[i])
+		values = append(values, params[i+1])
+	}
+
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames(names...)
+	c.SetParamValues(values...)
+
+	require.NoError(t, handler(c))
+	return rec
+}
@@ -0,0 +1,75 @@
+package controlnode_test
+
+import (
+	"context"
+	"testing"
+
+	controlnode "0xKowalski1/container-orchestrator/control-node"
+	"0xKowalski1/container-orchestrator/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const electionKey = "/election/control-node/replica-1"
+
+func TestWithLeaderFence(t *testing.T) {
+	tests := []struct {
+		name          string
+		reelected     bool // The election key changes after the fence is taken, another replica has led since
+		expectedError error
+	}{
+		{name: "still leader"},
+		{name: "leadership lost", reelected: true, expectedError: controlnode.ErrConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := setup(t)
+			tc.addNode(t, node("node1", 1024, 2))
+			tc.addContainer(t, container("c1", 256, 1))
+
+			require.NoError(t, tc.store.Put(context.Background(), electionKey, "replica-1"))
+			resp, err := tc.store.Get(context.Background(), electionKey)
+			require.NoError(t, err)
+			leaderCtx := controlnode.WithLeaderFence(context.Background(), electionKey, resp.Kvs[0].ModRevision)
+
+			if tt.reelected {
+				require.NoError(t, tc.store.Put(context.Background(), electionKey, "replica-2"))
+			}
+
+			stopped := "stopped"
+			err = tc.containerService.UpdateContainer(leaderCtx, "c1", models.UpdateContainerRequest{DesiredStatus: &stopped})
+			tc.schedular.ScheduleContainers(leaderCtx)
+
+			if tt.expectedError != nil {
+				assert.ErrorIs(t, err, tt.expectedError)
+				assert.Equal(t, "running", tc.container(t, "c1").DesiredStatus)
+				assert.Empty(t, tc.container(t, "c1").NodeID)
+				assert.Empty(t, tc.node(t, "node1").Containers)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, "stopped", tc.container(t, "c1").DesiredStatus)
+				assert.Equal(t, "node1", tc.container(t, "c1").NodeID)
+			}
+
+			// Writes outside of leadership, such as API requests, are never fenced
+			running := "running"
+			require.NoError(t, tc.containerService.UpdateContainer(context.Background(), "c1", models.UpdateContainerRequest{DesiredStatus: &running}))
+		})
+	}
+}
+
+func TestSchedular_ScheduleContainers_LeadershipLost(t *testing.T) {
+	tc := setup(t)
+	tc.addNode(t, node("node1", 1024, 2))
+	tc.addContainer(t, container("c1", 256, 1))
+
+	// The leader context is cancelled the moment leadership is lost, the schedular must not place anything after
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tc.schedular.ScheduleContainers(ctx)
+
+	assert.Empty(t, tc.container(t, "c1").NodeID)
+	assert.Empty(t, tc.node(t, "node1").Containers)
+}
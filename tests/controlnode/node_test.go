@@ -0,0 +1,517 @@
+package controlnode_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	controlnode "0xKowalski1/container-orchestrator/control-node"
+	"0xKowalski1/container-orchestrator/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeService_AssignContainerToNode(t *testing.T) {
+	tests := []struct {
+		name          string
+		assignedTo    string // Node the container is already bound to
+		nodeID        string
+		expectedError bool
+	}{
+		{name: "unscheduled container", nodeID: "node1"},
+		{name: "already on the same node", assignedTo: "node1", nodeID: "node1"},
+		{name: "already on another node", assignedTo: "node2", nodeID: "node1", expectedError: true},
+		{name: "missing node", nodeID: "missing", expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := setup(t)
+			tc.addNode(t, node("node1", 1024, 2))
+			tc.addNode(t, node("node2", 1024, 2))
+			tc.addContainer(t, container("c1", 256, 1))
+
+			if tt.assignedTo != "" {
+				require.NoError(t, tc.nodeService.AssignContainerToNode(context.Background(), "c1", tt.assignedTo, nil))
+			}
+
+			ports := []models.Port{{HostPort: 30001, ContainerPort: 25565, Protocol: "tcp"}}
+			err := tc.nodeService.AssignContainerToNode(context.Background(), "c1", tt.nodeID, ports)
+
+			if tt.expectedError {
+				assert.Error(t, err)
+				assert.Equal(t, tt.assignedTo, tc.container(t, "c1").NodeID)
+				return
+			}
+
+			require.NoError(t, err)
+			assigned := tc.container(t, "c1")
+			assert.Equal(t, tt.nodeID, assigned.NodeID)
+			assert.Equal(t, ports, assigned.Ports)
+
+			boundNode := tc.node(t, tt.nodeID)
+			assert.Equal(t, 256, boundNode.MemoryUsed)
+		})
+	}
+}
+
+func TestNodeService_AssignContainerToNode_HostPorts(t *testing.T) {
+	tests := []struct {
+		name          string
+		port          models.Port
+		expectedError error
+	}{
+		{name: "port taken on the node", port: models.Port{HostPort: 30001, ContainerPort: 25565, Protocol: "tcp"}, expectedError: controlnode.ErrHostPortInUse},
+		{name: "same number on the other protocol", port: models.Port{HostPort: 30001, ContainerPort: 25565, Protocol: "udp"}},
+		{name: "free port", port: models.Port{HostPort: 30002, ContainerPort: 25565, Protocol: "tcp"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := setup(t)
+			tc.addNode(t, node("node1", 1024, 2))
+			tc.addContainer(t, container("c1", 256, 1))
+			tc.addContainer(t, container("c2", 256, 1))
+			require.NoError(t, tc.nodeService.AssignContainerToNode(context.Background(), "c2", "node1", []models.Port{{HostPort: 30001, ContainerPort: 25565, Protocol: "tcp"}}))
+
+			err := tc.nodeService.AssignContainerToNode(context.Background(), "c1", "node1", []models.Port{tt.port})
+
+			if tt.expectedError != nil {
+				assert.ErrorIs(t, err, tt.expectedError)
+				assert.Empty(t, tc.container(t, "c1").NodeID)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "node1", tc.container(t, "c1").NodeID)
+		})
+	}
+}
+
+func TestNodeService_EvictContainer_Cancelled(t *testing.T) {
+	tc := setup(t)
+	tc.addNode(t, node("node1", 1024, 2))
+	tc.addContainer(t, container("c1", 256, 1))
+	require.NoError(t, tc.nodeService.AssignContainerToNode(context.Background(), "c1", "node1", nil))
+
+	// A leader that lost leadership gives up straight away instead of waiting out the stop timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := tc.nodeService.EvictContainer(ctx, *tc.container(t, "c1"))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, "node1", tc.container(t, "c1").NodeID)
+	assert.Equal(t, "running", tc.container(t, "c1").DesiredStatus)
+}
+
+func TestContainerService_UpdateContainerIfMatch(t *testing.T) {
+	tc := setup(t)
+	tc.addContainer(t, container("c1", 256, 1))
+
+	stale := tc.container(t, "c1").ResourceVersion
+	status := "running"
+	require.NoError(t, tc.containerService.UpdateContainer(context.Background(), "c1", models.UpdateContainerRequest{Status: &status}))
+
+	desiredStatus := "stopped"
+	err := tc.containerService.UpdateContainerIfMatch(context.Background(), "c1", models.UpdateContainerRequest{DesiredStatus: &desiredStatus}, stale)
+	assert.ErrorIs(t, err, controlnode.ErrConflict)
+
+	current := tc.container(t, "c1")
+	assert.Equal(t, "running", current.DesiredStatus)
+	require.NoError(t, tc.containerService.UpdateContainerIfMatch(context.Background(), "c1", models.UpdateContainerRequest{DesiredStatus: &desiredStatus}, current.ResourceVersion))
+	assert.Equal(t, "stopped", tc.container(t, "c1").DesiredStatus)
+
+	_, err = tc.containerService.CreateContainer(container("c1", 256, 1))
+	assert.ErrorIs(t, err, controlnode.ErrConflict)
+}
+
+func TestContainerService_DeleteContainer(t *testing.T) {
+	tests := []struct {
+		name          string
+		assigned      bool
+		stale         bool
+		expectedError error
+	}{
+		{name: "scheduled container", assigned: true},
+		{name: "unscheduled container", assigned: false},
+		{name: "container modified since it was read", assigned: true, stale: true, expectedError: controlnode.ErrConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := setup(t)
+			tc.addNode(t, node("node1", 1024, 2))
+			tc.addContainer(t, container("c1", 256, 1))
+			tc.addContainer(t, container("c2", 256, 1))
+
+			require.NoError(t, tc.nodeService.AssignContainerToNode(context.Background(), "c2", "node1", nil))
+			if tt.assigned {
+				require.NoError(t, tc.nodeService.AssignContainerToNode(context.Background(), "c1", "node1", nil))
+			}
+
+			read := tc.container(t, "c1")
+			if tt.stale {
+				tc.setStatus(t, "c1", "running")
+			}
+
+			err := tc.containerService.DeleteContainerIfMatch("c1", tc.nodeService, read.ResourceVersion)
+			if tt.expectedError != nil {
+				assert.ErrorIs(t, err, tt.expectedError)
+
+				// Neither the container nor its binding is touched
+				assert.Equal(t, "node1", tc.container(t, "c1").NodeID)
+				assert.Len(t, tc.node(t, "node1").Containers, 2)
+				return
+			}
+			require.NoError(t, err)
+
+			_, err = tc.containerService.GetContainer("c1")
+			assert.Error(t, err)
+
+			boundNode := tc.node(t, "node1")
+			require.Len(t, boundNode.Containers, 1)
+			assert.Equal(t, "c2", boundNode.Containers[0].ID)
+		})
+	}
+}
+
+func TestNodeService_DeleteNode(t *testing.T) {
+	tests := []struct {
+		name          string
+		withContainer bool
+		force         bool
+		expectedError error
+	}{
+		{name: "empty node"},
+		{name: "node with containers", withContainer: true, expectedError: controlnode.ErrNodeNotEmpty},
+		{name: "forced with containers", withContainer: true, force: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := setup(t)
+			tc.addNode(t, node("node1", 1024, 2))
+			tc.addContainer(t, container("c1", 256, 1))
+
+			if tt.withContainer {
+				require.NoError(t, tc.nodeService.AssignContainerToNode(context.Background(), "c1", "node1", nil))
+			}
+
+			err := tc.nodeService.DeleteNode("node1", tt.force)
+
+			if tt.expectedError != nil {
+				assert.ErrorIs(t, err, tt.expectedError)
+				assert.Equal(t, "node1", tc.container(t, "c1").NodeID)
+				return
+			}
+
+			require.NoError(t, err)
+			deleted, err := tc.nodeService.GetNode("node1")
+			require.NoError(t, err)
+			assert.Nil(t, deleted)
+
+			// Containers are handed back to the schedular
+			assert.Empty(t, tc.container(t, "c1").NodeID)
+		})
+	}
+
+	tc := setup(t)
+	assert.ErrorIs(t, tc.nodeService.DeleteNode("missing", false), controlnode.ErrNodeNotFound)
+}
+
+func TestNodeService_UpdateNodeIfMatch(t *testing.T) {
+	tc := setup(t)
+	tc.addNode(t, node("node1", 1024, 2))
+
+	read := tc.node(t, "node1")
+	labels := map[string]string{"disk": "nvme"}
+	require.NoError(t, tc.nodeService.UpdateNodeIfMatch("node1", models.UpdateNodeRequest{Labels: &labels}, read.ResourceVersion))
+	assert.Equal(t, labels, tc.node(t, "node1").Labels)
+
+	// A patch against the version read before the labels changed is refused
+	taints := []models.Taint{{Key: "dedicated", Value: "modded", Effect: models.TaintEffectNoSchedule}}
+	err := tc.nodeService.UpdateNodeIfMatch("node1", models.UpdateNodeRequest{Taints: &taints}, read.ResourceVersion)
+	assert.ErrorIs(t, err, controlnode.ErrConflict)
+	assert.Empty(t, tc.node(t, "node1").Taints)
+
+	assert.ErrorIs(t, tc.nodeService.UpdateNode("missing", models.UpdateNodeRequest{Labels: &labels}), controlnode.ErrNodeNotFound)
+}
+
+func TestNodeService_DrainNode(t *testing.T) {
+	tests := []struct {
+		name          string
+		withContainer bool
+		desiredStatus string
+	}{
+		{name: "empty node"},
+		{name: "running container is stopped then moved", withContainer: true, desiredStatus: "running"},
+		{name: "stopped container is moved straight away", withContainer: true, desiredStatus: "stopped"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := setup(t)
+			ctx := context.Background()
+			tc.addNode(t, node("node1", 1024, 2))
+			tc.addNode(t, node("node2", 1024, 2))
+
+			if tt.withContainer {
+				tc.addContainer(t, container("c1", 256, 1))
+				require.NoError(t, tc.nodeService.AssignContainerToNode(ctx, "c1", "node1", nil))
+				desiredStatus := tt.desiredStatus
+				require.NoError(t, tc.containerService.UpdateContainer(ctx, "c1", models.UpdateContainerRequest{DesiredStatus: &desiredStatus}))
+				tc.setStatus(t, "c1", tt.desiredStatus)
+			}
+
+			// Stop the container once it is asked to, as its worker would
+			workerDone := make(chan struct{})
+			go func() {
+				defer close(workerDone)
+				if !tt.withContainer || tt.desiredStatus == "stopped" {
+					return
+				}
+
+				for {
+					current, err := tc.containerService.GetContainer("c1")
+					if !assert.NoError(t, err) {
+						return
+					}
+					if current.DesiredStatus == "stopped" {
+						stopped := "stopped"
+						assert.NoError(t, tc.containerService.UpdateContainer(ctx, "c1", models.UpdateContainerRequest{Status: &stopped}))
+						return
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}()
+
+			require.NoError(t, tc.nodeService.DrainNode(ctx, "node1"))
+			<-workerDone
+
+			drained := tc.node(t, "node1")
+			assert.True(t, drained.Unschedulable)
+			assert.Empty(t, drained.Containers)
+
+			if !tt.withContainer {
+				return
+			}
+
+			// The container keeps its desired status and lands on the other node
+			evicted := tc.container(t, "c1")
+			assert.Empty(t, evicted.NodeID)
+			assert.Equal(t, tt.desiredStatus, evicted.DesiredStatus)
+			assert.Contains(t, tc.eventReasons(t, "c1"), models.EventReasonEvicted)
+
+			tc.schedular.ScheduleContainers(ctx)
+			assert.Equal(t, "node2", tc.container(t, "c1").NodeID)
+		})
+	}
+
+	tc := setup(t)
+	assert.ErrorIs(t, tc.nodeService.DrainNode(context.Background(), "missing"), controlnode.ErrNodeNotFound)
+}
+
+func TestContainerService_SubscribeToStatus(t *testing.T) {
+	tc := setup(t)
+	tc.addNode(t, node("node1", 1024, 2))
+	tc.addContainer(t, container("c1", 256, 1))
+
+	_, err := tc.containerService.SubscribeToStatus("missing")
+	assert.Error(t, err)
+
+	statusChan, err := tc.containerService.SubscribeToStatus("c1")
+	require.NoError(t, err)
+
+	next := func() models.ContainerStatusEvent {
+		t.Helper()
+		select {
+		case event := <-statusChan:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a status event")
+			return models.ContainerStatusEvent{}
+		}
+	}
+
+	// Writes that leave status, desired status and node alone are not events
+	message := "Waiting for capacity"
+	require.NoError(t, tc.containerService.UpdateContainer(context.Background(), "c1", models.UpdateContainerRequest{SchedulingMessage: &message}))
+
+	desiredStatus := "stopped"
+	require.NoError(t, tc.containerService.UpdateContainer(context.Background(), "c1", models.UpdateContainerRequest{DesiredStatus: &desiredStatus}))
+	event := next()
+	assert.Equal(t, models.ContainerStatusEventChanged, event.Type)
+	assert.Equal(t, "stopped", event.DesiredStatus)
+	assert.Equal(t, []string{"desiredStatus"}, event.Changed)
+
+	require.NoError(t, tc.nodeService.AssignContainerToNode(context.Background(), "c1", "node1", nil))
+	event = next()
+	assert.Equal(t, "node1", event.NodeID)
+	assert.Equal(t, []string{"nodeId"}, event.Changed)
+
+	require.NoError(t, tc.containerService.DeleteContainer("c1", tc.nodeService))
+	for event = next(); event.Type != models.ContainerStatusEventDeleted; event = next() {
+	}
+	assert.Equal(t, "c1", event.ContainerID)
+
+	tc.containerService.UnsubscribeFromStatus("c1", statusChan)
+	_, open := <-statusChan
+	assert.False(t, open)
+}
+
+func TestContainerService_UpdateContainer_ExitAndRestart(t *testing.T) {
+	tests := []struct {
+		name                 string
+		desiredStatus        string
+		exitCode             int
+		oomKilled            bool
+		expectedExitReason   string
+		expectedRestartCount int
+	}{
+		{name: "crashed", desiredStatus: "running", exitCode: 1, expectedExitReason: models.ExitReasonError, expectedRestartCount: 1},
+		{name: "exited cleanly", desiredStatus: "running", exitCode: 0, expectedExitReason: models.ExitReasonCompleted, expectedRestartCount: 1},
+		{name: "oom killed", desiredStatus: "running", exitCode: 137, oomKilled: true, expectedExitReason: models.ExitReasonOOMKilled, expectedRestartCount: 1},
+		{name: "stopped by user", desiredStatus: "stopped", exitCode: 143, expectedExitReason: models.ExitReasonStopped},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := setup(t)
+			tc.addNode(t, node("node1", 1024, 2))
+			tc.addContainer(t, container("c1", 256, 1))
+			require.NoError(t, tc.nodeService.AssignContainerToNode(context.Background(), "c1", "node1", nil))
+
+			startedAt := time.Now().UTC()
+			require.NoError(t, tc.containerService.UpdateContainer(context.Background(), "c1", models.UpdateContainerRequest{StartedAt: &startedAt}))
+			require.NoError(t, tc.containerService.UpdateContainer(context.Background(), "c1", models.UpdateContainerRequest{DesiredStatus: &tt.desiredStatus}))
+
+			status := "stopped"
+			exitedAt := startedAt.Add(time.Minute)
+			require.NoError(t, tc.containerService.UpdateContainer(context.Background(), "c1", models.UpdateContainerRequest{
+				Status:    &status,
+				ExitCode:  &tt.exitCode,
+				ExitedAt:  &exitedAt,
+				OOMKilled: &tt.oomKilled,
+			}))
+
+			exited := tc.container(t, "c1")
+			require.NotNil(t, exited.ExitCode)
+			assert.Equal(t, tt.exitCode, *exited.ExitCode)
+			assert.Equal(t, tt.oomKilled, exited.OOMKilled)
+			assert.Equal(t, tt.expectedExitReason, exited.ExitReason)
+
+			// Starting again, and the start being reported twice
+			restartedAt := exitedAt.Add(time.Second)
+			require.NoError(t, tc.containerService.UpdateContainer(context.Background(), "c1", models.UpdateContainerRequest{StartedAt: &restartedAt}))
+			require.NoError(t, tc.containerService.UpdateContainer(context.Background(), "c1", models.UpdateContainerRequest{StartedAt: &restartedAt}))
+
+			restarted := tc.container(t, "c1")
+			assert.Equal(t, tt.expectedRestartCount, restarted.RestartCount)
+			assert.Equal(t, tt.expectedExitReason, restarted.ExitReason) // Describes the last run until the next exit
+
+			events, err := tc.containerService.GetEvents("c1")
+			require.NoError(t, err)
+			restartEvents := 0
+			for _, event := range events {
+				if event.Reason == models.EventReasonRestarted {
+					restartEvents++
+				}
+			}
+			assert.Equal(t, tt.expectedRestartCount, restartEvents)
+		})
+	}
+}
+
+func TestContainerService_UpdateContainer_CrashLoopBackOff(t *testing.T) {
+	tc := setup(t)
+	tc.addNode(t, node("node1", 1024, 2))
+	req := container("c1", 256, 1)
+	req.RestartPolicy = models.RestartPolicyOnFailure
+	req.MaxRestarts = 5
+	tc.addContainer(t, req)
+	require.NoError(t, tc.nodeService.AssignContainerToNode(context.Background(), "c1", "node1", nil))
+
+	created := tc.container(t, "c1")
+	assert.Equal(t, models.RestartPolicyOnFailure, created.RestartPolicy)
+	assert.Equal(t, 5, created.MaxRestarts)
+
+	startedAt := time.Now().UTC()
+	require.NoError(t, tc.containerService.UpdateContainer(context.Background(), "c1", models.UpdateContainerRequest{StartedAt: &startedAt}))
+
+	// The worker reports the exit and its backoff in one patch
+	status := models.StatusCrashLoopBackOff
+	exitCode := 1
+	exitedAt := startedAt.Add(time.Second)
+	nextRestartAt := exitedAt.Add(10 * time.Second)
+	require.NoError(t, tc.containerService.UpdateContainer(context.Background(), "c1", models.UpdateContainerRequest{
+		Status:        &status,
+		ExitCode:      &exitCode,
+		ExitedAt:      &exitedAt,
+		NextRestartAt: &nextRestartAt,
+	}))
+
+	backingOff := tc.container(t, "c1")
+	assert.Equal(t, models.StatusCrashLoopBackOff, backingOff.Status)
+	assert.Equal(t, models.ExitReasonError, backingOff.ExitReason)
+	require.NotNil(t, backingOff.NextRestartAt)
+	assert.True(t, nextRestartAt.Equal(*backingOff.NextRestartAt))
+
+	running := "running"
+	require.NoError(t, tc.containerService.UpdateContainer(context.Background(), "c1", models.UpdateContainerRequest{Status: &running, StartedAt: &nextRestartAt}))
+
+	restarted := tc.container(t, "c1")
+	assert.Nil(t, restarted.NextRestartAt)
+	assert.Equal(t, 1, restarted.RestartCount)
+}
+
+func TestContainerService_UpdateContainer_Conditions(t *testing.T) {
+	tc := setup(t)
+	tc.addContainer(t, container("c1", 256, 1))
+
+	failedAt := time.Now().UTC().Truncate(time.Second)
+	report := func(condition models.ContainerCondition) {
+		t.Helper()
+		require.NoError(t, tc.containerService.UpdateContainer(context.Background(), "c1", models.UpdateContainerRequest{Conditions: []models.ContainerCondition{condition}}))
+	}
+
+	report(models.ContainerCondition{Type: models.ContainerConditionCreated, Status: false, Reason: models.ConditionReasonImagePullFailed, Message: "not found", LastTransitionTime: failedAt})
+	report(models.ContainerCondition{Type: models.ContainerConditionReconciled, Status: true, Reason: models.ConditionReasonReconciled, LastTransitionTime: failedAt})
+
+	// Still failing with a new message, the transition time stays when it first failed
+	report(models.ContainerCondition{Type: models.ContainerConditionCreated, Status: false, Reason: models.ConditionReasonImagePullFailed, Message: "unauthorized", LastTransitionTime: failedAt.Add(time.Minute)})
+
+	created := tc.container(t, "c1").Condition(models.ContainerConditionCreated)
+	require.NotNil(t, created)
+	assert.Equal(t, "unauthorized", created.Message)
+	assert.True(t, failedAt.Equal(created.LastTransitionTime))
+
+	recoveredAt := failedAt.Add(2 * time.Minute)
+	report(models.ContainerCondition{Type: models.ContainerConditionCreated, Status: true, Reason: models.ConditionReasonCreated, LastTransitionTime: recoveredAt})
+
+	current := tc.container(t, "c1")
+	assert.Len(t, current.Conditions, 2)
+	created = current.Condition(models.ContainerConditionCreated)
+	require.NotNil(t, created)
+	assert.True(t, created.Status)
+	assert.True(t, recoveredAt.Equal(created.LastTransitionTime))
+	assert.NotNil(t, current.Condition(models.ContainerConditionReconciled))
+}
+
+func TestContainerService_UpdateContainer_ServerInfo(t *testing.T) {
+	tc := setup(t)
+	tc.addContainer(t, container("c1", 256, 1))
+
+	info := models.ServerInfo{Players: 3, MaxPlayers: 20, Version: "1.20.4", MOTD: "A Minecraft Server"}
+	require.NoError(t, tc.containerService.UpdateContainer(context.Background(), "c1", models.UpdateContainerRequest{ServerInfo: &info}))
+	assert.Equal(t, &info, tc.container(t, "c1").ServerInfo)
+
+	// Other updates keep it
+	status := "running"
+	require.NoError(t, tc.containerService.UpdateContainer(context.Background(), "c1", models.UpdateContainerRequest{Status: &status}))
+	assert.Equal(t, &info, tc.container(t, "c1").ServerInfo)
+
+	// Nothing answers queries once it exits
+	stopped, exitCode, exitedAt := "stopped", 0, time.Now().UTC()
+	require.NoError(t, tc.containerService.UpdateContainer(context.Background(), "c1", models.UpdateContainerRequest{Status: &stopped, ExitCode: &exitCode, ExitedAt: &exitedAt}))
+	assert.Nil(t, tc.container(t, "c1").ServerInfo)
+}
@@ -0,0 +1,101 @@
+package controlnode_test
+
+import (
+	"context"
+	"testing"
+
+	"0xKowalski1/container-orchestrator/config"
+	controlnode "0xKowalski1/container-orchestrator/control-node"
+	"0xKowalski1/container-orchestrator/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeController_ReconcileNodes(t *testing.T) {
+	tests := []struct {
+		name           string
+		policy         string
+		gracePeriod    int
+		notReady       bool
+		expectedNode   string   // Where the container ends up once the schedular has run
+		expectedEvents []string // Recorded over two reconciles
+	}{
+		{
+			name:           "reschedules off a node past the grace period",
+			notReady:       true,
+			expectedNode:   "node2",
+			expectedEvents: []string{models.EventReasonScheduled, models.EventReasonRescheduled, models.EventReasonScheduled},
+		},
+		{
+			name:           "reschedule policy set explicitly",
+			policy:         models.ReschedulePolicyReschedule,
+			notReady:       true,
+			expectedNode:   "node2",
+			expectedEvents: []string{models.EventReasonScheduled, models.EventReasonRescheduled, models.EventReasonScheduled},
+		},
+		{
+			name:           "keeps a pinned container on its node and records it once",
+			policy:         models.ReschedulePolicyKeepPinned,
+			notReady:       true,
+			expectedNode:   "node1",
+			expectedEvents: []string{models.EventReasonScheduled, models.EventReasonNodeNotReady},
+		},
+		{
+			name:           "leaves a node within the grace period",
+			gracePeriod:    3600,
+			notReady:       true,
+			expectedNode:   "node1",
+			expectedEvents: []string{models.EventReasonScheduled},
+		},
+		{
+			name:           "leaves a ready node",
+			expectedNode:   "node1",
+			expectedEvents: []string{models.EventReasonScheduled},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := setup(t)
+			ctx := context.Background()
+			nodeController := controlnode.NewNodeController(&config.Config{Namespace: "test", NodeFailureGracePeriod: tt.gracePeriod}, tc.containerService, tc.nodeService)
+
+			tc.addNode(t, node("node1", 1024, 2))
+			req := container("c1", 256, 1)
+			req.ReschedulePolicy = tt.policy
+			tc.addContainer(t, req)
+			tc.schedular.ScheduleContainers(ctx)
+			require.Equal(t, "node1", tc.container(t, "c1").NodeID)
+
+			tc.addNode(t, node("node2", 1024, 2))
+			if tt.notReady {
+				tc.expireHeartbeat(t, "node1")
+			}
+
+			nodeController.ReconcileNodes(ctx)
+			nodeController.ReconcileNodes(ctx)
+			tc.schedular.ScheduleContainers(ctx)
+
+			assert.Equal(t, tt.expectedNode, tc.container(t, "c1").NodeID)
+			assert.Equal(t, tt.expectedEvents, tc.eventReasons(t, "c1"))
+		})
+	}
+}
+
+func TestNodeController_ReconcileNodes_Cancelled(t *testing.T) {
+	tc := setup(t)
+	nodeController := controlnode.NewNodeController(&config.Config{Namespace: "test"}, tc.containerService, tc.nodeService)
+
+	tc.addNode(t, node("node1", 1024, 2))
+	tc.addContainer(t, container("c1", 256, 1))
+	tc.schedular.ScheduleContainers(context.Background())
+	tc.expireHeartbeat(t, "node1")
+
+	// A leader that has lost leadership leaves the node to the next one
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	nodeController.ReconcileNodes(ctx)
+
+	assert.Equal(t, "node1", tc.container(t, "c1").NodeID)
+}
@@ -0,0 +1,512 @@
+package controlnode_test
+
+import (
+	"context"
+	"testing"
+
+	"0xKowalski1/container-orchestrator/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedular_ScheduleContainers(t *testing.T) {
+	tests := []struct {
+		name         string
+		nodes        []models.CreateNodeRequest
+		cordoned     []string
+		notReady     []string // Joined but never heartbeated
+		container    models.CreateContainerRequest
+		expectedNode string // Empty if the container should stay unscheduled
+	}{
+		{
+			name:         "fits on the only node",
+			nodes:        []models.CreateNodeRequest{node("node1", 1024, 2)},
+			container:    container("c1", 512, 1),
+			expectedNode: "node1",
+		},
+		{
+			name:      "too big for every node",
+			nodes:     []models.CreateNodeRequest{node("node1", 1024, 2)},
+			container: container("c1", 2048, 1),
+		},
+		{
+			name:      "no nodes",
+			container: container("c1", 512, 1),
+		},
+		{
+			name:         "skips cordoned node",
+			nodes:        []models.CreateNodeRequest{node("node1", 4096, 4), node("node2", 1024, 2)},
+			cordoned:     []string{"node1"},
+			container:    container("c1", 512, 1),
+			expectedNode: "node2",
+		},
+		{
+			name:         "skips node that is not ready",
+			nodes:        []models.CreateNodeRequest{node("node1", 4096, 4)},
+			notReady:     []string{"node2"},
+			container:    container("c1", 512, 1),
+			expectedNode: "node1",
+		},
+		{
+			name:         "spreads onto the emptiest node",
+			nodes:        []models.CreateNodeRequest{node("node1", 1024, 2), node("node2", 4096, 4)},
+			container:    container("c1", 512, 1),
+			expectedNode: "node2",
+		},
+		{
+			name:  "binpacks onto the fullest node",
+			nodes: []models.CreateNodeRequest{node("node1", 1024, 2), node("node2", 4096, 4)},
+			container: func() models.CreateContainerRequest {
+				req := container("c1", 512, 1)
+				req.SchedulingStrategy = "binpack"
+				return req
+			}(),
+			expectedNode: "node1",
+		},
+		{
+			name: "honours node selector",
+			nodes: []models.CreateNodeRequest{
+				node("node1", 4096, 4),
+				func() models.CreateNodeRequest {
+					req := node("node2", 1024, 2)
+					req.Labels = map[string]string{"region": "eu"}
+					return req
+				}(),
+			},
+			container: func() models.CreateContainerRequest {
+				req := container("c1", 512, 1)
+				req.NodeSelector = map[string]string{"region": "eu"}
+				return req
+			}(),
+			expectedNode: "node2",
+		},
+		{
+			name: "avoids tainted node without toleration",
+			nodes: []models.CreateNodeRequest{
+				func() models.CreateNodeRequest {
+					req := node("node1", 4096, 4)
+					req.Taints = []models.Taint{{Key: "dedicated", Value: "db", Effect: models.TaintEffectNoSchedule}}
+					return req
+				}(),
+				node("node2", 1024, 2),
+			},
+			container:    container("c1", 512, 1),
+			expectedNode: "node2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := setup(t)
+
+			for _, req := range tt.nodes {
+				tc.addNode(t, req)
+			}
+			for _, nodeID := range tt.notReady {
+				require.NoError(t, tc.nodeService.CreateNode(node(nodeID, 8192, 8)))
+			}
+			for _, nodeID := range tt.cordoned {
+				require.NoError(t, tc.nodeService.SetUnschedulable(nodeID, true))
+			}
+			tc.addContainer(t, tt.container)
+
+			tc.schedular.ScheduleContainers(context.Background())
+
+			scheduled := tc.container(t, tt.container.ID)
+			assert.Equal(t, tt.expectedNode, scheduled.NodeID)
+
+			if tt.expectedNode == "" {
+				assert.NotEmpty(t, scheduled.SchedulingMessage)
+				return
+			}
+
+			assert.Empty(t, scheduled.SchedulingMessage)
+			boundNode := tc.node(t, tt.expectedNode)
+			require.Len(t, boundNode.Containers, 1)
+			assert.Equal(t, tt.container.ID, boundNode.Containers[0].ID)
+		})
+	}
+}
+
+func TestSchedular_ScheduleContainers_NodeConstraints(t *testing.T) {
+	// node1 is the roomier node, so the spread strategy picks it unless a constraint steers the container away
+	big := func(labels map[string]string, taints ...models.Taint) models.CreateNodeRequest {
+		req := node("node1", 4096, 4)
+		req.Labels = labels
+		req.Taints = taints
+		return req
+	}
+	small := node("node2", 1024, 2)
+	small.Labels = map[string]string{"disk": "nvme"}
+
+	noSchedule := models.Taint{Key: "dedicated", Value: "modded", Effect: models.TaintEffectNoSchedule}
+	preferNoSchedule := models.Taint{Key: "shared", Value: "true", Effect: models.TaintEffectPreferNoSchedule}
+
+	withTolerations := func(tolerations ...models.Toleration) models.CreateContainerRequest {
+		req := container("c1", 512, 1)
+		req.Tolerations = tolerations
+		return req
+	}
+	withAffinity := func(affinity models.NodeAffinity) models.CreateContainerRequest {
+		req := container("c1", 512, 1)
+		req.NodeAffinity = &affinity
+		return req
+	}
+	diskIn := func(values ...string) models.NodeSelectorTerm {
+		return models.NodeSelectorTerm{MatchExpressions: []models.NodeSelectorRequirement{{Key: "disk", Operator: models.SelectorOpIn, Values: values}}}
+	}
+
+	tests := []struct {
+		name         string
+		nodes        []models.CreateNodeRequest
+		container    models.CreateContainerRequest
+		expectedNode string // Empty if the container should stay unscheduled
+	}{
+		{
+			name:         "toleration matching key and value",
+			nodes:        []models.CreateNodeRequest{big(nil, noSchedule), small},
+			container:    withTolerations(models.Toleration{Key: "dedicated", Value: "modded", Effect: models.TaintEffectNoSchedule}),
+			expectedNode: "node1",
+		},
+		{
+			name:         "toleration with a different value",
+			nodes:        []models.CreateNodeRequest{big(nil, noSchedule), small},
+			container:    withTolerations(models.Toleration{Key: "dedicated", Value: "vanilla"}),
+			expectedNode: "node2",
+		},
+		{
+			name:         "toleration for a different effect",
+			nodes:        []models.CreateNodeRequest{big(nil, noSchedule), small},
+			container:    withTolerations(models.Toleration{Key: "dedicated", Value: "modded", Effect: models.TaintEffectPreferNoSchedule}),
+			expectedNode: "node2",
+		},
+		{
+			name:         "exists toleration with an empty key tolerates every taint",
+			nodes:        []models.CreateNodeRequest{big(nil, noSchedule), small},
+			container:    withTolerations(models.Toleration{Operator: models.TolerationOpExists}),
+			expectedNode: "node1",
+		},
+		{
+			name:      "untolerated taint on the only node",
+			nodes:     []models.CreateNodeRequest{big(nil, noSchedule)},
+			container: container("c1", 512, 1),
+		},
+		{
+			name:         "prefer no schedule taint steers to another node",
+			nodes:        []models.CreateNodeRequest{big(nil, preferNoSchedule), small},
+			container:    container("c1", 512, 1),
+			expectedNode: "node2",
+		},
+		{
+			name:         "prefer no schedule taint still allows the only node",
+			nodes:        []models.CreateNodeRequest{big(nil, preferNoSchedule)},
+			container:    container("c1", 512, 1),
+			expectedNode: "node1",
+		},
+		{
+			name:         "required affinity",
+			nodes:        []models.CreateNodeRequest{big(map[string]string{"disk": "hdd"}), small},
+			container:    withAffinity(models.NodeAffinity{Required: []models.NodeSelectorTerm{diskIn("nvme")}}),
+			expectedNode: "node2",
+		},
+		{
+			name:         "required affinity matches any of its terms",
+			nodes:        []models.CreateNodeRequest{big(map[string]string{"disk": "hdd"}), small},
+			container:    withAffinity(models.NodeAffinity{Required: []models.NodeSelectorTerm{diskIn("ssd"), diskIn("hdd")}}),
+			expectedNode: "node1",
+		},
+		{
+			name:  "required affinity with not in",
+			nodes: []models.CreateNodeRequest{big(map[string]string{"disk": "hdd"}), small},
+			container: withAffinity(models.NodeAffinity{Required: []models.NodeSelectorTerm{{
+				MatchExpressions: []models.NodeSelectorRequirement{{Key: "disk", Operator: models.SelectorOpNotIn, Values: []string{"hdd"}}},
+			}}}),
+			expectedNode: "node2",
+		},
+		{
+			name:      "required affinity no node matches",
+			nodes:     []models.CreateNodeRequest{big(map[string]string{"disk": "hdd"}), small},
+			container: withAffinity(models.NodeAffinity{Required: []models.NodeSelectorTerm{diskIn("ssd")}}),
+		},
+		{
+			name:         "preferred affinity",
+			nodes:        []models.CreateNodeRequest{big(nil), small},
+			container:    withAffinity(models.NodeAffinity{Preferred: []models.PreferredSchedulingTerm{{Weight: 10, Preference: diskIn("nvme")}}}),
+			expectedNode: "node2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := setup(t)
+
+			for _, req := range tt.nodes {
+				tc.addNode(t, req)
+			}
+			tc.addContainer(t, tt.container)
+
+			tc.schedular.ScheduleContainers(context.Background())
+
+			scheduled := tc.container(t, tt.container.ID)
+			assert.Equal(t, tt.expectedNode, scheduled.NodeID)
+			if tt.expectedNode == "" {
+				assert.NotEmpty(t, scheduled.SchedulingMessage)
+			}
+		})
+	}
+}
+
+func TestSchedular_ScheduleContainers_AntiAffinityAndSpread(t *testing.T) {
+	web := func(id string) models.CreateContainerRequest {
+		req := container(id, 256, 0)
+		req.Labels = map[string]string{"app": "web"}
+		return req
+	}
+	// pinned runs on the named node, placed before the container under test
+	pinned := func(req models.CreateContainerRequest, nodeID string) models.CreateContainerRequest {
+		req.NodeSelector = map[string]string{"host": nodeID}
+		return req
+	}
+	spread := func(req models.CreateContainerRequest) models.CreateContainerRequest {
+		req.TopologySpread = []models.TopologySpreadConstraint{{MaxSkew: 1, TopologyKey: "zone"}}
+		return req
+	}
+
+	tests := []struct {
+		name         string
+		nodes        []models.CreateNodeRequest
+		existing     []models.CreateContainerRequest
+		cordoned     []string // Cordoned once the existing containers are placed
+		container    models.CreateContainerRequest
+		expectedNode string // Empty if the container should stay unscheduled
+	}{
+		{
+			name:     "anti-affinity avoids a node running a sibling",
+			nodes:    []models.CreateNodeRequest{labelledNode("node1", 4096, "a"), labelledNode("node2", 1024, "b")},
+			existing: []models.CreateContainerRequest{pinned(web("web-1"), "node1")},
+			container: func() models.CreateContainerRequest {
+				req := web("web-2")
+				req.AntiAffinity = []models.ContainerAntiAffinity{{}}
+				return req
+			}(),
+			expectedNode: "node2",
+		},
+		{
+			name:  "anti-affinity ignores containers outside its selector",
+			nodes: []models.CreateNodeRequest{labelledNode("node1", 4096, "a"), labelledNode("node2", 1024, "b")},
+			existing: []models.CreateContainerRequest{pinned(func() models.CreateContainerRequest {
+				req := container("db-1", 256, 0)
+				req.Labels = map[string]string{"app": "db"}
+				return req
+			}(), "node1")},
+			container: func() models.CreateContainerRequest {
+				req := web("web-1")
+				req.AntiAffinity = []models.ContainerAntiAffinity{{}}
+				return req
+			}(),
+			expectedNode: "node1",
+		},
+		{
+			name:     "anti-affinity with every node taken",
+			nodes:    []models.CreateNodeRequest{labelledNode("node1", 4096, "a")},
+			existing: []models.CreateContainerRequest{pinned(web("web-1"), "node1")},
+			container: func() models.CreateContainerRequest {
+				req := web("web-2")
+				req.AntiAffinity = []models.ContainerAntiAffinity{{}}
+				return req
+			}(),
+		},
+		{
+			name:         "topology spread places in the emptier zone",
+			nodes:        []models.CreateNodeRequest{labelledNode("node1", 4096, "a"), labelledNode("node2", 1024, "b")},
+			existing:     []models.CreateContainerRequest{pinned(web("web-1"), "node1")},
+			container:    spread(web("web-2")),
+			expectedNode: "node2",
+		},
+		{
+			name:         "topology spread skips nodes without the topology label",
+			nodes:        []models.CreateNodeRequest{node("node1", 4096, 4), labelledNode("node2", 1024, "a")},
+			container:    spread(web("web-1")),
+			expectedNode: "node2",
+		},
+		{
+			name: "topology spread ignores an empty zone on a cordoned node",
+			nodes: []models.CreateNodeRequest{
+				labelledNode("node1", 4096, "a"),
+				labelledNode("node2", 1024, "b"),
+				labelledNode("node3", 8192, "c"),
+			},
+			existing:     []models.CreateContainerRequest{pinned(web("web-1"), "node1"), pinned(web("web-2"), "node2")},
+			cordoned:     []string{"node3"},
+			container:    spread(web("web-3")),
+			expectedNode: "node1",
+		},
+		{
+			name: "topology spread ignores an empty zone outside the node selector",
+			nodes: []models.CreateNodeRequest{
+				labelledNode("node1", 4096, "a"),
+				labelledNode("node2", 1024, "b"),
+				func() models.CreateNodeRequest {
+					req := labelledNode("node3", 8192, "c")
+					req.Labels["pool"] = "batch"
+					return req
+				}(),
+			},
+			existing: []models.CreateContainerRequest{pinned(web("web-1"), "node1"), pinned(web("web-2"), "node2")},
+			container: func() models.CreateContainerRequest {
+				req := spread(web("web-3"))
+				req.NodeAffinity = &models.NodeAffinity{Required: []models.NodeSelectorTerm{{
+					MatchExpressions: []models.NodeSelectorRequirement{{Key: "pool", Operator: models.SelectorOpDoesNotExist}},
+				}}}
+				return req
+			}(),
+			expectedNode: "node1",
+		},
+		{
+			name:      "topology spread still counts a zone whose nodes are full",
+			nodes:     []models.CreateNodeRequest{labelledNode("node1", 4096, "a"), labelledNode("node2", 128, "b")},
+			existing:  []models.CreateContainerRequest{pinned(web("web-1"), "node1")},
+			container: spread(web("web-2")),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := setup(t)
+
+			for _, req := range tt.nodes {
+				tc.addNode(t, req)
+			}
+			for _, req := range tt.existing {
+				tc.addContainer(t, req)
+			}
+			tc.schedular.ScheduleContainers(context.Background())
+			for _, req := range tt.existing {
+				require.NotEmpty(t, tc.container(t, req.ID).NodeID)
+			}
+
+			for _, nodeID := range tt.cordoned {
+				require.NoError(t, tc.nodeService.SetUnschedulable(nodeID, true))
+			}
+			tc.addContainer(t, tt.container)
+
+			tc.schedular.ScheduleContainers(context.Background())
+
+			scheduled := tc.container(t, tt.container.ID)
+			assert.Equal(t, tt.expectedNode, scheduled.NodeID)
+			if tt.expectedNode == "" {
+				assert.NotEmpty(t, scheduled.SchedulingMessage)
+			}
+		})
+	}
+}
+
+func TestSchedular_ScheduleContainers_SchedulingMessage(t *testing.T) {
+	tc := setup(t)
+	ctx := context.Background()
+	tc.addNode(t, node("node1", 4096, 4))
+	tc.addNode(t, node("node2", 1024, 2))
+	require.NoError(t, tc.nodeService.SetUnschedulable("node1", true))
+	tc.addContainer(t, container("c1", 2048, 1))
+
+	tc.schedular.ScheduleContainers(ctx)
+
+	// Every node is listed with the reason it was filtered out
+	message := tc.container(t, "c1").SchedulingMessage
+	assert.Contains(t, message, "0/2 nodes available")
+	assert.Contains(t, message, "node1 (")
+	assert.Contains(t, message, "node2 (")
+
+	// Binding the container clears the message
+	require.NoError(t, tc.nodeService.SetUnschedulable("node1", false))
+	require.NoError(t, tc.nodeService.AssignContainerToNode(ctx, "c1", "node1", nil))
+	assert.Empty(t, tc.container(t, "c1").SchedulingMessage)
+}
+
+func TestSchedular_ScheduleContainers_AssignsHostPorts(t *testing.T) {
+	tc := setup(t)
+	tc.addNode(t, node("node1", 4096, 4))
+
+	for _, containerID := range []string{"c1", "c2"} {
+		req := container(containerID, 128, 1)
+		req.Ports = []models.Port{{HostPort: 0, ContainerPort: 25565, Protocol: "tcp"}}
+		tc.addContainer(t, req)
+	}
+
+	tc.schedular.ScheduleContainers(context.Background())
+
+	first, second := tc.container(t, "c1"), tc.container(t, "c2")
+	require.Len(t, first.Ports, 1)
+	require.Len(t, second.Ports, 1)
+	assert.GreaterOrEqual(t, first.Ports[0].HostPort, 30000)
+	assert.LessOrEqual(t, first.Ports[0].HostPort, 30009)
+	assert.NotEqual(t, first.Ports[0].HostPort, second.Ports[0].HostPort)
+}
+
+func TestSchedular_ScheduleContainers_ByPriority(t *testing.T) {
+	tc := setup(t)
+	tc.addNode(t, node("node1", 1024, 2))
+
+	low := container("low", 1024, 1)
+	high := container("high", 1024, 1)
+	high.Priority = 10
+	tc.addContainer(t, low)
+	tc.addContainer(t, high)
+
+	tc.schedular.ScheduleContainers(context.Background())
+
+	assert.Equal(t, "node1", tc.container(t, "high").NodeID)
+	assert.Empty(t, tc.container(t, "low").NodeID)
+}
+
+func TestSchedular_ScheduleContainers_Preempts(t *testing.T) {
+	tc := setup(t)
+	ctx := context.Background()
+	tc.addNode(t, node("node1", 1024, 2))
+	tc.addNode(t, node("node2", 512, 2)) // Too small for the preemptor, room for the victim once it is requeued
+
+	low := container("low", 512, 1)
+	low.Ports = []models.Port{{HostPort: 25565, ContainerPort: 25565, Protocol: "tcp"}}
+	tc.addContainer(t, low)
+
+	tc.schedular.ScheduleContainers(ctx)
+	require.Equal(t, "node1", tc.container(t, "low").NodeID)
+	tc.setStatus(t, "low", "running")
+
+	high := container("high", 1024, 1)
+	high.Priority = 10
+	high.Ports = []models.Port{{HostPort: 25565, ContainerPort: 25565, Protocol: "tcp"}}
+	tc.addContainer(t, high)
+
+	// The victim is told to stop but keeps its resources and host port until the worker reports it stopped
+	tc.schedular.ScheduleContainers(ctx)
+
+	victim := tc.container(t, "low")
+	assert.Equal(t, "node1", victim.NodeID)
+	assert.Equal(t, "stopped", victim.DesiredStatus)
+	assert.Equal(t, "running", victim.PreemptedDesiredStatus)
+	assert.Empty(t, tc.container(t, "high").NodeID)
+
+	tc.schedular.ScheduleContainers(ctx)
+	assert.Empty(t, tc.container(t, "high").NodeID)
+	assert.Equal(t, "node1", tc.container(t, "low").NodeID)
+
+	// Once stopped the victim is unbound and requeued with the desired status it had, the preemptor takes its place
+	// and the victim is scheduled again like any other container
+	tc.setStatus(t, "low", "stopped")
+	tc.schedular.ScheduleContainers(ctx)
+
+	assert.Equal(t, "node1", tc.container(t, "high").NodeID)
+	victim = tc.container(t, "low")
+	assert.Equal(t, "node2", victim.NodeID)
+	assert.Equal(t, "running", victim.DesiredStatus)
+	assert.Empty(t, victim.PreemptedDesiredStatus)
+}
+
+// labelledNode is a node in the given zone, labelled with its own ID as host so containers can be pinned to it
+func labelledNode(id string, memory int, zone string) models.CreateNodeRequest {
+	req := node(id, memory, 4)
+	req.Labels = map[string]string{"host": id, "zone": zone}
+	return req
+}
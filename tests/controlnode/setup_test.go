@@ -0,0 +1,105 @@
+package controlnode_test
+
+import (
+	"context"
+	"testing"
+
+	"0xKowalski1/container-orchestrator/config"
+	controlnode "0xKowalski1/container-orchestrator/control-node"
+	"0xKowalski1/container-orchestrator/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testCluster struct {
+	store            *controlnode.MemoryStore
+	containerService *controlnode.ContainerService
+	nodeService      *controlnode.NodeService
+	eventBus         *controlnode.EventBus
+	schedular        *controlnode.Schedular
+}
+
+func setup(t *testing.T) *testCluster {
+	cfg := &config.Config{
+		Namespace:            "test",
+		NodeHeartbeatTimeout: 30,
+		EventTTL:             60,
+		SchedulingStrategy:   "spread",
+		HostPortRanges: map[string]config.PortRange{
+			"tcp": {Min: 30000, Max: 30009},
+			"udp": {Min: 30000, Max: 30009},
+		},
+	}
+
+	store := controlnode.NewMemoryStore()
+	t.Cleanup(func() { store.Close() })
+
+	containerService := controlnode.NewContainerService(cfg, store)
+	nodeService := controlnode.NewNodeService(cfg, store, containerService)
+	eventBus := controlnode.NewEventBus(cfg, store)
+
+	return &testCluster{
+		store:            store,
+		containerService: containerService,
+		nodeService:      nodeService,
+		eventBus:         eventBus,
+		schedular:        controlnode.NewSchedular(cfg, store, eventBus, containerService, nodeService),
+	}
+}
+
+// addNode joins a node to the cluster and heartbeats it so it is Ready
+func (tc *testCluster) addNode(t *testing.T, req models.CreateNodeRequest) {
+	require.NoError(t, tc.nodeService.CreateNode(req))
+	require.NoError(t, tc.nodeService.Heartbeat(req.ID))
+}
+
+func (tc *testCluster) addContainer(t *testing.T, req models.CreateContainerRequest) {
+	_, err := tc.containerService.CreateContainer(req)
+	require.NoError(t, err)
+}
+
+// setStatus reports the container's status as its worker would
+func (tc *testCluster) setStatus(t *testing.T, containerID, status string) {
+	require.NoError(t, tc.containerService.UpdateContainer(context.Background(), containerID, models.UpdateContainerRequest{Status: &status}))
+}
+
+// expireHeartbeat expires the node's heartbeat lease so it is NotReady, as if it stopped heartbeating
+func (tc *testCluster) expireHeartbeat(t *testing.T, nodeID string) {
+	resp, err := tc.store.Get(context.Background(), models.NodeHeartbeat{NodeID: nodeID}.LeaseKey())
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 1)
+	tc.store.Revoke(resp.Kvs[0].Lease)
+	require.Equal(t, models.NodeStatusNotReady, tc.node(t, nodeID).Status)
+}
+
+func (tc *testCluster) eventReasons(t *testing.T, containerID string) []string {
+	events, err := tc.containerService.GetEvents(containerID)
+	require.NoError(t, err)
+
+	reasons := make([]string, len(events))
+	for i, event := range events {
+		reasons[i] = event.Reason
+	}
+	return reasons
+}
+
+func (tc *testCluster) container(t *testing.T, containerID string) *models.Container {
+	container, err := tc.containerService.GetContainer(containerID)
+	require.NoError(t, err)
+	return container
+}
+
+func (tc *testCluster) node(t *testing.T, nodeID string) *models.Node {
+	node, err := tc.nodeService.GetNode(nodeID)
+	require.NoError(t, err)
+	require.NotNil(t, node)
+	return node
+}
+
+func node(id string, memory, cpu int) models.CreateNodeRequest {
+	return models.CreateNodeRequest{ID: id, MemoryLimit: memory, CpuLimit: cpu, StorageLimit: 100, NodeIp: "127.0.0.1"}
+}
+
+func container(id string, memory, cpu int) models.CreateContainerRequest {
+	return models.CreateContainerRequest{ID: id, Image: "test", MemoryLimit: memory, CpuLimit: cpu, StorageLimit: 1}
+}
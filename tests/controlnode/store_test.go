@@ -0,0 +1,179 @@
+package controlnode_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	controlnode "0xKowalski1/container-orchestrator/control-node"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore_GetPrefix(t *testing.T) {
+	store := controlnode.NewMemoryStore()
+	ctx := context.Background()
+
+	require.NoError(t, store.Put(ctx, "/nodes/b", "2"))
+	require.NoError(t, store.Put(ctx, "/nodes/a", "1"))
+	require.NoError(t, store.Put(ctx, "/other", "3"))
+
+	resp, err := store.Get(ctx, "/nodes/", controlnode.WithPrefix())
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), resp.Revision)
+	require.Len(t, resp.Kvs, 2)
+	assert.Equal(t, "/nodes/a", resp.Kvs[0].Key)
+	assert.Equal(t, "/nodes/b", resp.Kvs[1].Key)
+
+	resp, err = store.Get(ctx, "/nodes/", controlnode.WithPrefix(), controlnode.WithCountOnly())
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), resp.Count)
+	assert.Empty(t, resp.Kvs)
+}
+
+func TestMemoryStore_Revisions(t *testing.T) {
+	store := controlnode.NewMemoryStore()
+	ctx := context.Background()
+
+	require.NoError(t, store.Put(ctx, "/key", "1"))
+	require.NoError(t, store.Put(ctx, "/key", "2"))
+
+	resp, err := store.Get(ctx, "/key")
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 1)
+	assert.Equal(t, "2", string(resp.Kvs[0].Value))
+	assert.Equal(t, int64(1), resp.Kvs[0].CreateRevision)
+	assert.Equal(t, int64(2), resp.Kvs[0].ModRevision)
+
+	require.NoError(t, store.Delete(ctx, "/key"))
+	resp, err = store.Get(ctx, "/key")
+	require.NoError(t, err)
+	assert.Empty(t, resp.Kvs)
+	assert.Equal(t, int64(3), resp.Revision)
+}
+
+func TestMemoryStore_Txn(t *testing.T) {
+	tests := []struct {
+		name        string
+		modRevision int64
+		succeeded   bool
+	}{
+		{name: "current revision", modRevision: 1, succeeded: true},
+		{name: "stale revision", modRevision: 2, succeeded: false},
+		{name: "must not exist", modRevision: 0, succeeded: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := controlnode.NewMemoryStore()
+			ctx := context.Background()
+			require.NoError(t, store.Put(ctx, "/a", "1"))
+
+			resp, err := store.Txn(ctx,
+				[]controlnode.Cmp{controlnode.CompareModRevision("/a", tt.modRevision)},
+				[]controlnode.Op{controlnode.OpPut("/a", "2"), controlnode.OpPut("/b", "2")},
+			)
+			require.NoError(t, err)
+			assert.Equal(t, tt.succeeded, resp.Succeeded)
+
+			getResp, err := store.Get(ctx, "/", controlnode.WithPrefix())
+			require.NoError(t, err)
+			if tt.succeeded {
+				// Both writes land in a single revision
+				require.Len(t, getResp.Kvs, 2)
+				assert.Equal(t, int64(2), getResp.Kvs[0].ModRevision)
+				assert.Equal(t, int64(2), getResp.Kvs[1].ModRevision)
+			} else {
+				require.Len(t, getResp.Kvs, 1)
+				assert.Equal(t, "1", string(getResp.Kvs[0].Value))
+			}
+		})
+	}
+}
+
+func TestMemoryStore_Watch(t *testing.T) {
+	store := controlnode.NewMemoryStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(t, store.Put(ctx, "/nodes/a", "1"))
+
+	watchChan := store.Watch(ctx, "/nodes/", controlnode.WithPrefix(), controlnode.WithPrevKV())
+
+	require.NoError(t, store.Put(ctx, "/other", "ignored"))
+	require.NoError(t, store.Put(ctx, "/nodes/a", "2"))
+	require.NoError(t, store.Delete(ctx, "/nodes/a"))
+
+	resp := receive(t, watchChan)
+	assert.Equal(t, int64(3), resp.Revision)
+	require.Len(t, resp.Events, 1)
+	assert.Equal(t, controlnode.EventTypePut, resp.Events[0].Type)
+	assert.False(t, resp.Events[0].IsCreate())
+	assert.Equal(t, "2", string(resp.Events[0].Kv.Value))
+	require.NotNil(t, resp.Events[0].PrevKv)
+	assert.Equal(t, "1", string(resp.Events[0].PrevKv.Value))
+
+	resp = receive(t, watchChan)
+	assert.Equal(t, int64(4), resp.Revision)
+	require.Len(t, resp.Events, 1)
+	assert.Equal(t, controlnode.EventTypeDelete, resp.Events[0].Type)
+	assert.Equal(t, "/nodes/a", resp.Events[0].Kv.Key)
+
+	// Cancelling closes the watch
+	cancel()
+	for range watchChan {
+	}
+}
+
+func TestMemoryStore_WatchFromRevision(t *testing.T) {
+	store := controlnode.NewMemoryStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(t, store.Put(ctx, "/key", "1"))
+	require.NoError(t, store.Put(ctx, "/key", "2"))
+	require.NoError(t, store.Put(ctx, "/key", "3"))
+
+	watchChan := store.Watch(ctx, "/key", controlnode.WithRev(2))
+
+	assert.Equal(t, "2", string(receive(t, watchChan).Events[0].Kv.Value))
+	assert.Equal(t, "3", string(receive(t, watchChan).Events[0].Kv.Value))
+
+	require.NoError(t, store.RequestProgress(ctx))
+	select {
+	case resp := <-watchChan:
+		t.Fatalf("unexpected progress notification on a watch without WithProgressNotify: %+v", resp)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryStore_Lease(t *testing.T) {
+	store := controlnode.NewMemoryStore()
+	ctx := context.Background()
+
+	leaseID, err := store.Grant(ctx, 30)
+	require.NoError(t, err)
+	require.NoError(t, store.Put(ctx, "/leased", "1", controlnode.WithLease(leaseID)))
+	require.NoError(t, store.KeepAliveOnce(ctx, leaseID))
+
+	store.Revoke(leaseID)
+
+	resp, err := store.Get(ctx, "/leased")
+	require.NoError(t, err)
+	assert.Empty(t, resp.Kvs)
+	assert.ErrorIs(t, store.KeepAliveOnce(ctx, leaseID), controlnode.ErrLeaseNotFound)
+}
+
+func receive(t *testing.T, watchChan controlnode.WatchChan) controlnode.WatchResponse {
+	t.Helper()
+
+	select {
+	case resp, ok := <-watchChan:
+		require.True(t, ok, "watch closed")
+		return resp
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for watch response")
+		return controlnode.WatchResponse{}
+	}
+}
@@ -19,7 +19,7 @@ func setup() (*storage.StorageManager, *utils_test.MockFileOps, *utils_test.Mock
 	mockFileOps := new(utils_test.MockFileOps)
 	mockCmdRunner := new(utils_test.MockCmdRunner)
 
-	return storage.NewStorageManager(cfg, mockFileOps, mockCmdRunner), mockFileOps, mockCmdRunner
+	return storage.NewStorageManager(cfg, mockFileOps, mockCmdRunner, nil), mockFileOps, mockCmdRunner
 }
 
 // RemoveVolume
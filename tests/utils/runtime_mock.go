@@ -0,0 +1,318 @@
+package utils_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"0xKowalski1/container-orchestrator/models"
+	workernode "0xKowalski1/container-orchestrator/worker-node"
+)
+
+// Operations a FakeRuntime can be told to fail
+const (
+	FakeOpCreate = "create"
+	FakeOpStart  = "start"
+	FakeOpStop   = "stop"
+	FakeOpRemove = "remove"
+	FakeOpExec   = "exec"
+)
+
+// FakeRuntime is an in-memory workernode.Runtime for tests. It keeps containerd's rules, a container must be stopped before it
+// is removed and a stopped container cannot be stopped again, and sends the same events containerd would.
+type FakeRuntime struct {
+	mu         sync.Mutex
+	containers map[string]*fakeContainer
+	errors     map[string]error // Operation/ContainerID -> error to fail with
+	calls      []string
+	nextPid    uint32
+	logs       map[string][]byte
+	execCodes  map[string]int // ContainerID -> exit code of commands run in it, 0 if not set
+	stopCodes  map[string]int // ContainerID -> exit code when it is stopped, 143 for SIGTERM if not set
+
+	events chan workernode.RuntimeEvent
+}
+
+type fakeContainer struct {
+	spec   models.Container
+	status string // stopped or running
+	pid    uint32
+}
+
+func NewFakeRuntime() *FakeRuntime {
+	return &FakeRuntime{
+		containers: make(map[string]*fakeContainer),
+		errors:     make(map[string]error),
+		nextPid:    100,
+		logs:       make(map[string][]byte),
+		execCodes:  make(map[string]int),
+		stopCodes:  make(map[string]int),
+		events:     make(chan workernode.RuntimeEvent, 256),
+	}
+}
+
+// SetError makes every call of the operation on the container fail with err until it is set back to nil
+func (f *FakeRuntime) SetError(op, containerID string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err == nil {
+		delete(f.errors, op+"/"+containerID)
+		return
+	}
+	f.errors[op+"/"+containerID] = err
+}
+
+// Calls returns every operation made against the runtime in order, e.g. "start c1", and clears them
+func (f *FakeRuntime) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	calls := f.calls
+	f.calls = nil
+	return calls
+}
+
+// Status returns the container's status, empty if it does not exist
+func (f *FakeRuntime) Status(containerID string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if c, ok := f.containers[containerID]; ok {
+		return c.status
+	}
+	return ""
+}
+
+// Add puts a container straight into the runtime, as if it was left behind from before the worker started
+func (f *FakeRuntime) Add(containerSpec models.Container, status string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.containers[containerSpec.ID] = &fakeContainer{spec: containerSpec, status: status}
+}
+
+// WriteLog appends a line to the container's log, as if the container printed it
+func (f *FakeRuntime) WriteLog(containerID, line string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.logs[containerID] = append(f.logs[containerID], line+"\n"...)
+}
+
+// SetExecExitCode sets the exit code of every command run in the container
+func (f *FakeRuntime) SetExecExitCode(containerID string, exitCode int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.execCodes[containerID] = exitCode
+}
+
+// SetStopExitCode sets the exit code the container exits with when it is stopped, e.g. 0 for a server that shuts down
+// cleanly on SIGTERM
+func (f *FakeRuntime) SetStopExitCode(containerID string, exitCode int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.stopCodes[containerID] = exitCode
+}
+
+// Exit makes the container's process exit on its own
+func (f *FakeRuntime) Exit(containerID string, exitCode int) error {
+	f.mu.Lock()
+	c, ok := f.containers[containerID]
+	if !ok || c.status != "running" {
+		f.mu.Unlock()
+		return fmt.Errorf("container %s is not running", containerID)
+	}
+	c.status = "stopped"
+	pid := c.pid
+	f.mu.Unlock()
+
+	f.send(workernode.RuntimeEvent{Type: workernode.RuntimeEventExit, ContainerID: containerID, Pid: pid, ExitCode: exitCode, Time: time.Now()})
+	return nil
+}
+
+// OOMKill kills the container for exceeding its memory limit
+func (f *FakeRuntime) OOMKill(containerID string) error {
+	f.mu.Lock()
+	_, ok := f.containers[containerID]
+	f.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("container %s not found", containerID)
+	}
+
+	f.send(workernode.RuntimeEvent{Type: workernode.RuntimeEventOOM, ContainerID: containerID, Time: time.Now()})
+	return f.Exit(containerID, 137)
+}
+
+func (f *FakeRuntime) CreateContainer(containerSpec models.Container) (models.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call(FakeOpCreate, containerSpec.ID); err != nil {
+		return models.Container{}, err
+	}
+	if _, ok := f.containers[containerSpec.ID]; ok {
+		return models.Container{}, fmt.Errorf("container %s already exists", containerSpec.ID)
+	}
+
+	f.containers[containerSpec.ID] = &fakeContainer{spec: containerSpec, status: "stopped"}
+	return models.Container{ID: containerSpec.ID}, nil
+}
+
+func (f *FakeRuntime) StartContainer(containerID string) error {
+	f.mu.Lock()
+	if err := f.call(FakeOpStart, containerID); err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	c, ok := f.containers[containerID]
+	if !ok {
+		f.mu.Unlock()
+		return fmt.Errorf("container %s not found", containerID)
+	}
+	if c.status == "running" {
+		f.mu.Unlock()
+		return fmt.Errorf("container %s already has a running task", containerID)
+	}
+
+	f.nextPid++
+	c.pid = f.nextPid
+	c.status = "running"
+	pid := c.pid
+	f.mu.Unlock()
+
+	f.send(workernode.RuntimeEvent{Type: workernode.RuntimeEventStart, ContainerID: containerID, Pid: pid, Time: time.Now()})
+	return nil
+}
+
+func (f *FakeRuntime) StopContainer(containerID string, timeout int) error {
+	f.mu.Lock()
+	if err := f.call(FakeOpStop, containerID); err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	c, ok := f.containers[containerID]
+	if !ok {
+		f.mu.Unlock()
+		return fmt.Errorf("container %s not found", containerID)
+	}
+	if c.status != "running" {
+		f.mu.Unlock()
+		return fmt.Errorf("container %s has no running task", containerID)
+	}
+
+	c.status = "stopped"
+	pid := c.pid
+	exitCode, ok := f.stopCodes[containerID]
+	if !ok {
+		exitCode = 143
+	}
+	f.mu.Unlock()
+
+	// Stopped with SIGTERM, then the task is deleted
+	now := time.Now()
+	f.send(workernode.RuntimeEvent{Type: workernode.RuntimeEventExit, ContainerID: containerID, Pid: pid, ExitCode: exitCode, Time: now})
+	f.send(workernode.RuntimeEvent{Type: workernode.RuntimeEventDelete, ContainerID: containerID, Pid: pid, Time: now})
+	return nil
+}
+
+func (f *FakeRuntime) RemoveContainer(containerID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call(FakeOpRemove, containerID); err != nil {
+		return err
+	}
+	c, ok := f.containers[containerID]
+	if !ok {
+		return fmt.Errorf("container %s not found", containerID)
+	}
+	if c.status == "running" {
+		return fmt.Errorf("container %s has a running task", containerID)
+	}
+
+	delete(f.containers, containerID)
+	return nil
+}
+
+func (f *FakeRuntime) ListContainers() ([]models.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	containers := make([]models.Container, 0, len(f.containers))
+	for id := range f.containers {
+		containers = append(containers, models.Container{ID: id})
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].ID < containers[j].ID })
+
+	return containers, nil
+}
+
+func (f *FakeRuntime) InspectContainer(containerID string) (models.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.containers[containerID]
+	if !ok {
+		return models.Container{}, fmt.Errorf("container %s not found", containerID)
+	}
+
+	return models.Container{ID: containerID, Status: c.status}, nil
+}
+
+func (f *FakeRuntime) ExecContainer(ctx context.Context, containerID string, args []string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+
+	if err := f.call(FakeOpExec, containerID); err != nil {
+		return -1, err
+	}
+	c, ok := f.containers[containerID]
+	if !ok || c.status != "running" {
+		return -1, fmt.Errorf("container %s is not running", containerID)
+	}
+
+	return f.execCodes[containerID], nil
+}
+
+func (f *FakeRuntime) LogSize(containerID string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return int64(len(f.logs[containerID])), nil
+}
+
+func (f *FakeRuntime) ReadLog(containerID string, offset int64) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	logs := f.logs[containerID]
+	if offset >= int64(len(logs)) {
+		return nil, nil
+	}
+
+	end := min(int64(len(logs)), offset+workernode.MaxLogRead)
+	return append([]byte(nil), logs[offset:end]...), nil
+}
+
+func (f *FakeRuntime) Events() <-chan workernode.RuntimeEvent {
+	return f.events
+}
+
+// call records the operation and returns the error it was set to fail with, called with f.mu held
+func (f *FakeRuntime) call(op, containerID string) error {
+	f.calls = append(f.calls, op+" "+containerID)
+	return f.errors[op+"/"+containerID]
+}
+
+func (f *FakeRuntime) send(event workernode.RuntimeEvent) {
+	f.events <- event
+}
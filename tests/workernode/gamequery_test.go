@@ -0,0 +1,150 @@
+package workernode_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"0xKowalski1/container-orchestrator/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerManager_GameQueryProbe(t *testing.T) {
+	tests := []struct {
+		name string
+		// serve starts a game server answering its query with the number of online players
+		serve    func(t *testing.T, online *atomic.Int32) (models.Probe, models.Port)
+		wantInfo models.ServerInfo
+	}{
+		{
+			name:     "minecraft",
+			serve:    serveMinecraft,
+			wantInfo: models.ServerInfo{Players: 3, MaxPlayers: 20, Version: "1.20.4", MOTD: "A Minecraft Server, hosted here"},
+		},
+		{
+			name:     "a2s",
+			serve:    serveA2S,
+			wantInfo: models.ServerInfo{Players: 3, MaxPlayers: 24, Version: "1.38.8.1", MOTD: "Test Server", Map: "de_dust2"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tn := setup(t)
+
+			var online atomic.Int32
+			online.Store(3)
+			probe, port := tt.serve(t, &online)
+			probe.PeriodSeconds = 1
+
+			c1 := container("c1", "running")
+			c1.Ports = []models.Port{port}
+			c1.ReadinessProbe = &probe
+
+			require.NoError(t, tn.containers.SyncContainers([]models.Container{c1}))
+			waitForCondition(t, tn, "c1", models.ContainerConditionReady, true, models.ConditionReasonProbeSucceeded)
+			assert.Equal(t, &tt.wantInfo, tn.controlNode.serverInfo("c1"))
+
+			// A player joining is reported on the next check
+			online.Store(4)
+			require.Eventually(t, func() bool {
+				info := tn.controlNode.serverInfo("c1")
+				return info != nil && info.Players == 4
+			}, 3*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+// serveMinecraft answers Server List Pings, see https://wiki.vg/Server_List_Ping
+func serveMinecraft(t *testing.T, online *atomic.Int32) (models.Probe, models.Port) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+
+				// Handshake then status request
+				for i := 0; i < 2; i++ {
+					length, err := binary.ReadUvarint(reader)
+					if err != nil {
+						return
+					}
+					if _, err := io.CopyN(io.Discard, reader, int64(length)); err != nil {
+						return
+					}
+				}
+
+				status, _ := json.Marshal(map[string]any{
+					"version": map[string]any{"name": "1.20.4", "protocol": 765},
+					"players": map[string]any{"max": 20, "online": online.Load()},
+					"description": map[string]any{
+						"text":  "§aA Minecraft Server",
+						"extra": []any{map[string]any{"text": ", §lhosted here"}},
+					},
+				})
+
+				var packet []byte
+				packet = binary.AppendUvarint(packet, 0x00)
+				packet = binary.AppendUvarint(packet, uint64(len(status)))
+				packet = append(packet, status...)
+
+				conn.Write(append(binary.AppendUvarint(nil, uint64(len(packet))), packet...))
+			}()
+		}
+	}()
+
+	return models.Probe{Type: models.ProbeTypeMinecraft, Port: 25565}, mappedPort(25565, listener.Addr(), "tcp")
+}
+
+// serveA2S answers A2S_INFO queries, asking for a challenge first as current Source servers do
+func serveA2S(t *testing.T, online *atomic.Int32) (models.Probe, models.Port) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	challenge := []byte{0x0A, 0x0B, 0x0C, 0x0D}
+	request := append([]byte{0xFF, 0xFF, 0xFF, 0xFF, 'T'}, "Source Engine Query\x00"...)
+
+	go func() {
+		buf := make([]byte, 1400)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			switch {
+			case bytes.Equal(buf[:n], request):
+				conn.WriteTo(append([]byte{0xFF, 0xFF, 0xFF, 0xFF, 'A'}, challenge...), addr)
+			case bytes.Equal(buf[:n], append(append([]byte(nil), request...), challenge...)):
+				reply := []byte{0xFF, 0xFF, 0xFF, 0xFF, 'I', 17}
+				reply = append(reply, "Test Server\x00de_dust2\x00csgo\x00Counter-Strike: Global Offensive\x00"...)
+				reply = binary.LittleEndian.AppendUint16(reply, 730)
+				reply = append(reply, byte(online.Load()), 24, 0, 'd', 'l', 0, 1)
+				reply = append(reply, "1.38.8.1\x00"...)
+				conn.WriteTo(reply, addr)
+			}
+		}
+	}()
+
+	return models.Probe{Type: models.ProbeTypeA2S, Port: 27015}, mappedPort(27015, conn.LocalAddr(), "udp")
+}
@@ -0,0 +1,274 @@
+package workernode_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"0xKowalski1/container-orchestrator/models"
+	utils_test "0xKowalski1/container-orchestrator/tests/utils"
+	workernode "0xKowalski1/container-orchestrator/worker-node"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerManager_SyncContainers(t *testing.T) {
+	tests := []struct {
+		name          string
+		desiredStatus string // Empty when the container is no longer on the node
+		actualStatus  string // Empty when the container does not exist
+		wantCalls     []string
+		wantStatus    string
+	}{
+		{name: "running and missing", desiredStatus: "running", wantCalls: []string{"create c1", "start c1"}, wantStatus: "running"},
+		{name: "running and stopped", desiredStatus: "running", actualStatus: "stopped", wantCalls: []string{"start c1"}, wantStatus: "running"},
+		{name: "running and running", desiredStatus: "running", actualStatus: "running", wantStatus: "running"},
+		{name: "stopped and missing", desiredStatus: "stopped", wantCalls: []string{"create c1"}, wantStatus: "stopped"},
+		{name: "stopped and stopped", desiredStatus: "stopped", actualStatus: "stopped", wantStatus: "stopped"},
+		{name: "stopped and running", desiredStatus: "stopped", actualStatus: "running", wantCalls: []string{"stop c1"}, wantStatus: "stopped"},
+		{name: "removed and running", actualStatus: "running", wantCalls: []string{"stop c1", "remove c1"}},
+		{name: "removed and stopped", actualStatus: "stopped", wantCalls: []string{"remove c1"}},
+		{name: "removed and missing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tn := setup(t)
+
+			if tt.actualStatus != "" {
+				tn.runtime.Add(container("c1", tt.actualStatus), tt.actualStatus)
+			}
+
+			var desired []models.Container
+			if tt.desiredStatus != "" {
+				desired = append(desired, container("c1", tt.desiredStatus))
+			}
+
+			require.NoError(t, tn.containers.SyncContainers(desired))
+
+			assert.Equal(t, tt.wantCalls, tn.runtime.Calls())
+			assert.Equal(t, tt.wantStatus, tn.runtime.Status("c1"))
+
+			if tt.desiredStatus != "" {
+				reconciled := tn.controlNode.condition("c1", models.ContainerConditionReconciled)
+				require.NotNil(t, reconciled)
+				assert.True(t, reconciled.Status)
+			}
+
+			// Syncing again has nothing left to do
+			require.NoError(t, tn.containers.SyncContainers(desired))
+			assert.Empty(t, tn.runtime.Calls())
+		})
+	}
+}
+
+func TestContainerManager_SyncContainers_Failures(t *testing.T) {
+	t.Run("failing container does not stop the others", func(t *testing.T) {
+		tn := setup(t)
+		tn.runtime.SetError(utils_test.FakeOpStart, "c1", errors.New("no space left on device"))
+
+		err := tn.containers.SyncContainers([]models.Container{container("c1", "running"), container("c2", "running")})
+
+		var syncErr *workernode.SyncError
+		require.ErrorAs(t, err, &syncErr)
+		assert.Len(t, syncErr.Containers, 1)
+		assert.ErrorContains(t, syncErr.Containers["c1"], "no space left on device")
+		assert.Equal(t, "running", tn.runtime.Status("c2"))
+
+		reconciled := tn.controlNode.condition("c1", models.ContainerConditionReconciled)
+		require.NotNil(t, reconciled)
+		assert.False(t, reconciled.Status)
+		assert.Equal(t, models.ConditionReasonStartFailed, reconciled.Reason)
+
+		// The failed container backs off rather than being retried on the next sync
+		tn.runtime.SetError(utils_test.FakeOpStart, "c1", nil)
+		tn.runtime.Calls()
+
+		err = tn.containers.SyncContainers([]models.Container{container("c1", "running"), container("c2", "running")})
+		require.ErrorAs(t, err, &syncErr)
+		assert.ErrorContains(t, syncErr.Containers["c1"], "retrying in")
+		assert.Empty(t, tn.runtime.Calls())
+	})
+
+	t.Run("image pull failure", func(t *testing.T) {
+		tn := setup(t)
+		tn.runtime.SetError(utils_test.FakeOpCreate, "c1", fmt.Errorf("%w test: not found", workernode.ErrImagePull))
+
+		err := tn.containers.SyncContainers([]models.Container{container("c1", "running")})
+		assert.ErrorIs(t, err, workernode.ErrImagePull)
+
+		created := tn.controlNode.condition("c1", models.ContainerConditionCreated)
+		require.NotNil(t, created)
+		assert.False(t, created.Status)
+		assert.Equal(t, models.ConditionReasonImagePullFailed, created.Reason)
+		assert.Nil(t, tn.controlNode.condition("c1", models.ContainerConditionReconciled))
+	})
+
+	t.Run("containers whose volume or network failed are left alone", func(t *testing.T) {
+		tn := setup(t)
+		tn.runtime.Add(container("c2", "running"), "running")
+
+		desired := []models.Container{container("c1", "running"), container("c2", "stopped"), container("c3", "running")}
+		skip := map[string]error{
+			"c1": errors.New("failed to create volume: no space left on device"),
+			"c2": errors.New("failed to setup container network: bridge missing"),
+		}
+
+		require.NoError(t, tn.containers.SyncContainersExcept(desired, skip))
+
+		assert.Equal(t, []string{"create c3", "start c3"}, tn.runtime.Calls())
+		assert.Empty(t, tn.runtime.Status("c1"))
+		assert.Equal(t, "running", tn.runtime.Status("c2")) // Not stopped, and not removed as if it left the node
+
+		// Picked up once nothing is skipping them
+		require.NoError(t, tn.containers.SyncContainers(desired))
+		assert.ElementsMatch(t, []string{"create c1", "start c1", "stop c2"}, tn.runtime.Calls())
+	})
+
+	t.Run("container that cannot be removed is retried", func(t *testing.T) {
+		tn := setup(t)
+		tn.runtime.Add(container("c1", "stopped"), "stopped")
+		tn.runtime.SetError(utils_test.FakeOpRemove, "c1", errors.New("device or resource busy"))
+
+		err := tn.containers.SyncContainers(nil)
+
+		var syncErr *workernode.SyncError
+		require.ErrorAs(t, err, &syncErr)
+		assert.Contains(t, syncErr.Containers, "c1")
+		assert.Equal(t, "stopped", tn.runtime.Status("c1"))
+	})
+}
+
+func TestContainerManager_RestartPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		exitCode    int
+		wantRestart bool
+	}{
+		{name: "always restarts on success", policy: models.RestartPolicyAlways, exitCode: 0, wantRestart: true},
+		{name: "always restarts on failure", policy: models.RestartPolicyAlways, exitCode: 1, wantRestart: true},
+		{name: "on failure restarts on failure", policy: models.RestartPolicyOnFailure, exitCode: 1, wantRestart: true},
+		{name: "on failure leaves success stopped", policy: models.RestartPolicyOnFailure, exitCode: 0},
+		{name: "never leaves failure stopped", policy: models.RestartPolicyNever, exitCode: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tn := setup(t)
+			c1 := container("c1", "running")
+			c1.RestartPolicy = tt.policy
+
+			require.NoError(t, tn.containers.SyncContainers([]models.Container{c1}))
+			waitForStatuses(t, tn, "c1", "running")
+			tn.runtime.Calls()
+
+			require.NoError(t, tn.runtime.Exit("c1", tt.exitCode))
+			waitForStatuses(t, tn, "c1", "running", "stopped")
+
+			require.NoError(t, tn.containers.SyncContainers([]models.Container{c1}))
+			if tt.wantRestart {
+				assert.Equal(t, []string{"start c1"}, tn.runtime.Calls())
+				assert.Equal(t, "running", tn.runtime.Status("c1"))
+			} else {
+				assert.Empty(t, tn.runtime.Calls())
+				assert.Equal(t, "stopped", tn.runtime.Status("c1"))
+				assertHeld(t, tn, "c1", models.ConditionReasonRestartPolicy)
+			}
+		})
+	}
+}
+
+func TestContainerManager_CrashLoopBackOff(t *testing.T) {
+	tn := setup(t)
+	c1 := container("c1", "running")
+
+	require.NoError(t, tn.containers.SyncContainers([]models.Container{c1}))
+	waitForStatuses(t, tn, "c1", "running")
+
+	// The first crash is restarted straight away
+	require.NoError(t, tn.runtime.Exit("c1", 1))
+	waitForStatuses(t, tn, "c1", "running", "stopped")
+	waitForResync(t, tn)
+
+	require.NoError(t, tn.containers.SyncContainers([]models.Container{c1}))
+	waitForStatuses(t, tn, "c1", "running", "stopped", "running")
+
+	// Crashing again backs off
+	require.NoError(t, tn.runtime.OOMKill("c1"))
+	waitForStatuses(t, tn, "c1", "running", "stopped", "running", models.StatusCrashLoopBackOff)
+
+	exit := tn.controlNode.lastExit("c1")
+	require.NotNil(t, exit)
+	assert.Equal(t, 137, *exit.ExitCode)
+	assert.True(t, *exit.OOMKilled)
+	require.NotNil(t, exit.NextRestartAt)
+	assert.WithinDuration(t, time.Now().Add(10*time.Second), *exit.NextRestartAt, 2*time.Second)
+	assert.Contains(t, tn.controlNode.eventReasons("c1"), models.EventReasonOOMKilled)
+	assert.Contains(t, tn.controlNode.eventReasons("c1"), models.EventReasonBackOff)
+
+	tn.runtime.Calls()
+	require.NoError(t, tn.containers.SyncContainers([]models.Container{c1}))
+	assert.Empty(t, tn.runtime.Calls())
+	assert.Equal(t, "stopped", tn.runtime.Status("c1"))
+	assertHeld(t, tn, "c1", models.ConditionReasonBackOff)
+
+	// Stopping the container on purpose forgets the crash loop
+	c1.DesiredStatus = "stopped"
+	require.NoError(t, tn.containers.SyncContainers([]models.Container{c1}))
+	c1.DesiredStatus = "running"
+	require.NoError(t, tn.containers.SyncContainers([]models.Container{c1}))
+	assert.Equal(t, []string{"start c1"}, tn.runtime.Calls())
+}
+
+func TestContainerManager_MaxRestarts(t *testing.T) {
+	tn := setup(t)
+	c1 := container("c1", "running")
+	c1.MaxRestarts = 1
+
+	require.NoError(t, tn.containers.SyncContainers([]models.Container{c1}))
+	waitForStatuses(t, tn, "c1", "running")
+
+	require.NoError(t, tn.runtime.Exit("c1", 1))
+	waitForStatuses(t, tn, "c1", "running", "stopped")
+	waitForResync(t, tn)
+	require.NoError(t, tn.containers.SyncContainers([]models.Container{c1}))
+	waitForStatuses(t, tn, "c1", "running", "stopped", "running")
+
+	require.NoError(t, tn.runtime.Exit("c1", 1))
+	waitForStatuses(t, tn, "c1", "running", "stopped", "running", "stopped")
+	assert.Contains(t, tn.controlNode.eventReasons("c1"), models.EventReasonRestartLimitReached)
+
+	tn.runtime.Calls()
+	require.NoError(t, tn.containers.SyncContainers([]models.Container{c1}))
+	assert.Empty(t, tn.runtime.Calls())
+	assertHeld(t, tn, "c1", models.ConditionReasonRestartLimit)
+}
+
+// assertHeld checks the container is reported as deliberately left stopped, not as reconciled
+func assertHeld(t *testing.T, tn *testNode, containerID, reason string) {
+	t.Helper()
+	reconciled := tn.controlNode.condition(containerID, models.ContainerConditionReconciled)
+	require.NotNil(t, reconciled)
+	assert.False(t, reconciled.Status)
+	assert.Equal(t, reason, reconciled.Reason)
+}
+
+// waitForStatuses waits for the runtime events to be reported as exactly these statuses
+func waitForStatuses(t *testing.T, tn *testNode, containerID string, statuses ...string) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(statuses, tn.controlNode.statuses(containerID))
+	}, 2*time.Second, 10*time.Millisecond, "got statuses %v", tn.controlNode.statuses(containerID))
+}
+
+func waitForResync(t *testing.T, tn *testNode) {
+	t.Helper()
+	select {
+	case <-tn.containers.Resync():
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a resync")
+	}
+}
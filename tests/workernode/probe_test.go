@@ -0,0 +1,215 @@
+package workernode_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"0xKowalski1/container-orchestrator/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerManager_ReadinessProbe(t *testing.T) {
+	tests := []struct {
+		name string
+		// serve starts whatever the probe checks passing, returning the probe, the container's ports and a function
+		// that makes it fail
+		serve func(t *testing.T, tn *testNode) (models.Probe, []models.Port, func())
+	}{
+		{
+			name: "tcp",
+			serve: func(t *testing.T, tn *testNode) (models.Probe, []models.Port, func()) {
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				require.NoError(t, err)
+				t.Cleanup(func() { listener.Close() })
+
+				probe := models.Probe{Type: models.ProbeTypeTCP, Port: 25565}
+				return probe, []models.Port{mappedPort(25565, listener.Addr(), "tcp")}, func() { listener.Close() }
+			},
+		},
+		{
+			name: "udp",
+			serve: func(t *testing.T, tn *testNode) (models.Probe, []models.Port, func()) {
+				conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+				require.NoError(t, err)
+				t.Cleanup(func() { conn.Close() })
+
+				var failing atomic.Bool
+				go func() {
+					buf := make([]byte, 1024)
+					for {
+						n, addr, err := conn.ReadFrom(buf)
+						if err != nil {
+							return
+						}
+						if string(buf[:n]) == "ping" && !failing.Load() {
+							conn.WriteTo([]byte("pong 2/10"), addr)
+						}
+					}
+				}()
+
+				probe := models.Probe{Type: models.ProbeTypeUDP, Port: 27015, Send: []byte("ping"), Expect: `^pong \d+/\d+$`, TimeoutSeconds: 1}
+				return probe, []models.Port{mappedPort(27015, conn.LocalAddr(), "udp")}, func() { failing.Store(true) }
+			},
+		},
+		{
+			name: "http",
+			serve: func(t *testing.T, tn *testNode) (models.Probe, []models.Port, func()) {
+				var status atomic.Int32
+				status.Store(http.StatusOK)
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path != "/health" {
+						w.WriteHeader(http.StatusNotFound)
+						return
+					}
+					w.WriteHeader(int(status.Load()))
+				}))
+				t.Cleanup(server.Close)
+
+				probe := models.Probe{Type: models.ProbeTypeHTTP, Port: 8080, Path: "/health"}
+				return probe, []models.Port{mappedPort(8080, server.Listener.Addr(), "tcp")}, func() { status.Store(http.StatusServiceUnavailable) }
+			},
+		},
+		{
+			name: "exec",
+			serve: func(t *testing.T, tn *testNode) (models.Probe, []models.Port, func()) {
+				probe := models.Probe{Type: models.ProbeTypeExec, Command: []string{"rcon-cli", "list"}}
+				return probe, nil, func() { tn.runtime.SetExecExitCode("c1", 1) }
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tn := setup(t)
+
+			probe, ports, fail := tt.serve(t, tn)
+			probe.PeriodSeconds = 1
+			probe.FailureThreshold = 1
+
+			c1 := container("c1", "running")
+			c1.Ports = ports
+			c1.ReadinessProbe = &probe
+
+			require.NoError(t, tn.containers.SyncContainers([]models.Container{c1}))
+			waitForCondition(t, tn, "c1", models.ContainerConditionReady, true, models.ConditionReasonProbeSucceeded)
+
+			fail()
+			waitForCondition(t, tn, "c1", models.ContainerConditionReady, false, models.ConditionReasonProbeFailed)
+			assert.Contains(t, tn.controlNode.eventReasons("c1"), models.EventReasonUnhealthy)
+
+			// Failing readiness leaves the container running
+			assert.Equal(t, "running", tn.runtime.Status("c1"))
+		})
+	}
+}
+
+func TestContainerManager_ReadinessProbe_Log(t *testing.T) {
+	tn := setup(t)
+
+	// Lines from a previous run do not count
+	tn.runtime.WriteLog("c1", `[Server thread/INFO]: Done (4.1s)! For help, type "help"`)
+
+	c1 := container("c1", "running")
+	c1.ReadinessProbe = &models.Probe{Type: models.ProbeTypeLog, Pattern: `Done \(\d+\.\d+s\)!`, PeriodSeconds: 1}
+
+	require.NoError(t, tn.containers.SyncContainers([]models.Container{c1}))
+	waitForCondition(t, tn, "c1", models.ContainerConditionReady, false, models.ConditionReasonStarting)
+
+	tn.runtime.WriteLog("c1", "[Server thread/INFO]: Preparing level \"world\"")
+	time.Sleep(1500 * time.Millisecond)
+	ready := tn.controlNode.condition("c1", models.ContainerConditionReady)
+	require.NotNil(t, ready)
+	assert.False(t, ready.Status)
+
+	tn.runtime.WriteLog("c1", `[Server thread/INFO]: Done (12.3s)! For help, type "help"`)
+	waitForCondition(t, tn, "c1", models.ContainerConditionReady, true, models.ConditionReasonProbeSucceeded)
+
+	// Not ready once it exits
+	require.NoError(t, tn.runtime.Exit("c1", 0))
+	waitForCondition(t, tn, "c1", models.ContainerConditionReady, false, models.ConditionReasonNotRunning)
+}
+
+func TestContainerManager_NoReadinessProbe(t *testing.T) {
+	tn := setup(t)
+
+	require.NoError(t, tn.containers.SyncContainers([]models.Container{container("c1", "running")}))
+	waitForCondition(t, tn, "c1", models.ContainerConditionReady, true, models.ConditionReasonStarted)
+	assert.Nil(t, tn.controlNode.condition("c1", models.ContainerConditionLive))
+}
+
+func TestContainerManager_LivenessProbe(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       string
+		stopExitCode int // Exit code when the worker stops it
+		wantRestart  bool
+	}{
+		{name: "always", policy: models.RestartPolicyAlways, stopExitCode: 143, wantRestart: true},
+		{name: "on failure", policy: models.RestartPolicyOnFailure, stopExitCode: 143, wantRestart: true},
+		{name: "on failure exiting cleanly when stopped", policy: models.RestartPolicyOnFailure, stopExitCode: 0, wantRestart: true},
+		{name: "never", policy: models.RestartPolicyNever, stopExitCode: 143},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tn := setup(t)
+			tn.runtime.SetStopExitCode("c1", tt.stopExitCode)
+
+			c1 := container("c1", "running")
+			c1.RestartPolicy = tt.policy
+			c1.LivenessProbe = &models.Probe{Type: models.ProbeTypeExec, Command: []string{"healthcheck"}, PeriodSeconds: 1, FailureThreshold: 1}
+
+			require.NoError(t, tn.containers.SyncContainers([]models.Container{c1}))
+			waitForCondition(t, tn, "c1", models.ContainerConditionLive, true, models.ConditionReasonProbeSucceeded)
+
+			tn.runtime.SetExecExitCode("c1", 1)
+			waitForCondition(t, tn, "c1", models.ContainerConditionLive, false, models.ConditionReasonProbeFailed)
+			assert.Contains(t, tn.controlNode.eventReasons("c1"), models.EventReasonUnhealthy)
+
+			// Stopped by the worker, then restarted or not under its restart policy
+			require.Eventually(t, func() bool { return tn.controlNode.lastExit("c1") != nil }, 2*time.Second, 10*time.Millisecond)
+			assert.Equal(t, "stopped", tn.runtime.Status("c1"))
+
+			if tt.wantRestart {
+				waitForResync(t, tn)
+			}
+			tn.runtime.SetExecExitCode("c1", 0)
+			tn.runtime.Calls()
+			require.NoError(t, tn.containers.SyncContainers([]models.Container{c1}))
+
+			if tt.wantRestart {
+				assert.Contains(t, tn.runtime.Calls(), "start c1")
+				waitForCondition(t, tn, "c1", models.ContainerConditionLive, true, models.ConditionReasonProbeSucceeded)
+			} else {
+				assert.NotContains(t, tn.runtime.Calls(), "start c1")
+				assert.Equal(t, "stopped", tn.runtime.Status("c1"))
+			}
+		})
+	}
+}
+
+// mappedPort maps a container port to the host port a test server is listening on
+func mappedPort(containerPort int, addr net.Addr, protocol string) models.Port {
+	_, port, _ := net.SplitHostPort(addr.String())
+	hostPort, _ := strconv.Atoi(port)
+	return models.Port{ContainerPort: containerPort, HostPort: hostPort, Protocol: protocol}
+}
+
+func waitForCondition(t *testing.T, tn *testNode, containerID, conditionType string, status bool, reason string) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		condition := tn.controlNode.condition(containerID, conditionType)
+		return condition != nil && condition.Status == status && condition.Reason == reason
+	}, 3*time.Second, 10*time.Millisecond, "%s condition never became %v with %s", conditionType, status, reason)
+}
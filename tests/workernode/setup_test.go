@@ -0,0 +1,133 @@
+package workernode_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"0xKowalski1/container-orchestrator/config"
+	"0xKowalski1/container-orchestrator/models"
+	utils_test "0xKowalski1/container-orchestrator/tests/utils"
+	workernode "0xKowalski1/container-orchestrator/worker-node"
+)
+
+// fakeControlNode records what the worker reports instead of sending it to a control node
+type fakeControlNode struct {
+	mu      sync.Mutex
+	patches map[string][]models.UpdateContainerRequest
+	events  []models.RecordContainerEventRequest
+}
+
+func (cn *fakeControlNode) UpdateContainer(containerID string, req models.UpdateContainerRequest) (*models.Container, error) {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	cn.patches[containerID] = append(cn.patches[containerID], req)
+	return &models.Container{ID: containerID}, nil
+}
+
+func (cn *fakeControlNode) RecordEvent(req models.RecordContainerEventRequest) error {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	cn.events = append(cn.events, req)
+	return nil
+}
+
+// statuses returns every status reported for the container in order
+func (cn *fakeControlNode) statuses(containerID string) []string {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	var statuses []string
+	for _, patch := range cn.patches[containerID] {
+		if patch.Status != nil {
+			statuses = append(statuses, *patch.Status)
+		}
+	}
+	return statuses
+}
+
+// lastExit returns the last exit reported for the container, nil if it has not exited
+func (cn *fakeControlNode) lastExit(containerID string) *models.UpdateContainerRequest {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	patches := cn.patches[containerID]
+	for i := len(patches) - 1; i >= 0; i-- {
+		if patches[i].ExitCode != nil {
+			return &patches[i]
+		}
+	}
+	return nil
+}
+
+// condition returns the last condition of the type reported for the container, nil if none was
+func (cn *fakeControlNode) condition(containerID, conditionType string) *models.ContainerCondition {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	patches := cn.patches[containerID]
+	for i := len(patches) - 1; i >= 0; i-- {
+		for _, condition := range patches[i].Conditions {
+			if condition.Type == conditionType {
+				return &condition
+			}
+		}
+	}
+	return nil
+}
+
+// serverInfo returns the last server info reported for the container, nil if none was
+func (cn *fakeControlNode) serverInfo(containerID string) *models.ServerInfo {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	patches := cn.patches[containerID]
+	for i := len(patches) - 1; i >= 0; i-- {
+		if patches[i].ServerInfo != nil {
+			return patches[i].ServerInfo
+		}
+	}
+	return nil
+}
+
+func (cn *fakeControlNode) eventReasons(containerID string) []string {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	var reasons []string
+	for _, event := range cn.events {
+		if event.ContainerID == containerID {
+			reasons = append(reasons, event.Reason)
+		}
+	}
+	return reasons
+}
+
+type testNode struct {
+	runtime     *utils_test.FakeRuntime
+	controlNode *fakeControlNode
+	containers  *workernode.ContainerManager
+}
+
+// setup runs a container manager against a fake runtime, handling runtime events until the test ends
+func setup(t *testing.T) *testNode {
+	runtime := utils_test.NewFakeRuntime()
+	controlNode := &fakeControlNode{patches: make(map[string][]models.UpdateContainerRequest)}
+	containers := workernode.NewContainerManager(&config.Config{NodeIp: "127.0.0.1"}, runtime, controlNode, workernode.NewEventRecorder(controlNode, "node-1"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go containers.Run(ctx)
+
+	return &testNode{
+		runtime:     runtime,
+		controlNode: controlNode,
+		containers:  containers,
+	}
+}
+
+func container(id, desiredStatus string) models.Container {
+	return models.Container{ID: id, Image: "test", DesiredStatus: desiredStatus, NodeID: "node-1", StopTimeout: 1}
+}
@@ -0,0 +1,108 @@
+package workernode
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	syncMinBackoff = 5 * time.Second
+	syncMaxBackoff = 5 * time.Minute
+)
+
+// syncBackoff spaces out retries of containers that keep failing to sync, so a broken container is not retried on
+// every pass while the rest of the node carries on being reconciled
+type syncBackoff struct {
+	mu         sync.Mutex
+	containers map[string]*syncFailure
+	resync     func() // Called once a container is due to be retried
+}
+
+type syncFailure struct {
+	attempts  int
+	nextRetry time.Time
+	err       error // Last failure, reported again while waiting to retry
+	timer     *time.Timer
+}
+
+func newSyncBackoff(resync func()) *syncBackoff {
+	return &syncBackoff{
+		containers: make(map[string]*syncFailure),
+		resync:     resync,
+	}
+}
+
+// wait returns the last error while the container is backing off, nil once it may be retried
+func (b *syncBackoff) wait(containerID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failure, ok := b.containers[containerID]
+	if !ok {
+		return nil
+	}
+
+	if remaining := time.Until(failure.nextRetry); remaining > 0 {
+		return fmt.Errorf("retrying in %s: %w", remaining.Round(time.Second), failure.err)
+	}
+
+	return nil
+}
+
+// failed records a failure and schedules a resync for the retry, doubling the delay each time
+func (b *syncBackoff) failed(containerID string, err error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failure, ok := b.containers[containerID]
+	if !ok {
+		failure = &syncFailure{}
+		b.containers[containerID] = failure
+	}
+	if failure.timer != nil {
+		failure.timer.Stop()
+	}
+
+	delay := syncMinBackoff
+	for i := 0; i < failure.attempts && delay < syncMaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, syncMaxBackoff)
+
+	failure.attempts++
+	failure.err = err
+	failure.nextRetry = time.Now().Add(delay)
+	failure.timer = time.AfterFunc(delay, b.resync)
+
+	return fmt.Errorf("retrying in %s: %w", delay, err)
+}
+
+// succeeded resets the container's backoff
+func (b *syncBackoff) succeeded(containerID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if failure, ok := b.containers[containerID]; ok {
+		if failure.timer != nil {
+			failure.timer.Stop()
+		}
+		delete(b.containers, containerID)
+	}
+}
+
+// forgetExcept drops the failures of every container not in keep, they are no longer on this node
+func (b *syncBackoff) forgetExcept(keep map[string]bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for containerID, failure := range b.containers {
+		if keep[containerID] {
+			continue
+		}
+		if failure.timer != nil {
+			failure.timer.Stop()
+		}
+		delete(b.containers, containerID)
+	}
+}
@@ -2,12 +2,14 @@ package workernode
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"syscall"
 	"time"
 
-	"0xKowalski1/container-orchestrator/api-wrapper"
 	"0xKowalski1/container-orchestrator/config"
 	"0xKowalski1/container-orchestrator/models"
 
@@ -27,6 +29,7 @@ import (
 type ContainerdRuntime struct {
 	client *containerd.Client
 	cfg    *config.Config
+	events chan RuntimeEvent
 }
 
 // NewContainerdRuntime creates a new instance of ContainerdRuntime with the given containerd client.
@@ -40,6 +43,7 @@ func NewContainerdRuntime(cfg *config.Config) (*ContainerdRuntime, error) {
 	runtime := &ContainerdRuntime{
 		client: client,
 		cfg:    cfg,
+		events: make(chan RuntimeEvent, 64),
 	}
 
 	runtime.SubscribeToEvents()
@@ -47,80 +51,6 @@ func NewContainerdRuntime(cfg *config.Config) (*ContainerdRuntime, error) {
 	return runtime, nil
 }
 
-func (r *ContainerdRuntime) SyncContainers(desiredContainers []models.Container) error {
-
-	// List actual containers
-	actualContainers, err := r.ListContainers()
-	if err != nil {
-		log.Printf("Error listing containers: %v", err)
-		return err
-	}
-
-	// Map actual container IDs for easier lookup
-	actualMap := make(map[string]models.Container)
-	for _, c := range actualContainers {
-		ic, err := r.InspectContainer(c.ID)
-		if err != nil {
-			log.Printf("Error inspecting container: %v", err)
-		}
-		actualMap[c.ID] = ic
-	}
-
-	for _, desiredContainer := range desiredContainers {
-		// Create missing containers
-		if _, exists := actualMap[desiredContainer.ID]; !exists {
-			// Create container if it does not exist in actual state
-
-			_, err := r.CreateContainer(desiredContainer)
-			if err != nil {
-				log.Printf("Failed to create container: %v", err)
-				continue
-			}
-		}
-
-		r.reconcileContainerState(desiredContainer, actualMap[desiredContainer.ID])
-	}
-
-	// Stop extra containers
-	for _, c := range actualContainers {
-		found := false
-		for _, d := range desiredContainers {
-			if d.ID == c.ID {
-				found = true
-				break
-			}
-		}
-		if !found {
-			// Check errors
-			r.StopContainer(c.ID, c.StopTimeout)
-			r.RemoveContainer(c.ID)
-		}
-	}
-
-	return nil
-}
-
-func (r *ContainerdRuntime) reconcileContainerState(desiredContainer models.Container, actualContainer models.Container) {
-	switch desiredContainer.DesiredStatus {
-	case "running":
-		if actualContainer.Status != "running" {
-
-			err := r.StartContainer(desiredContainer.ID)
-			if err != nil {
-				log.Fatalf("Failed to start container: %v", err)
-			}
-
-		}
-	case "stopped":
-		if actualContainer.Status != "stopped" {
-			err := r.StopContainer(desiredContainer.ID, desiredContainer.StopTimeout)
-			if err != nil {
-				log.Fatalf("Failed to stop container: %v", err)
-			}
-		}
-	}
-}
-
 // This should return a pointer to a container
 // CreateContainer instantiates a new container but does not start it.
 func (_runtime *ContainerdRuntime) CreateContainer(containerSpec models.Container) (models.Container, error) {
@@ -129,7 +59,7 @@ func (_runtime *ContainerdRuntime) CreateContainer(containerSpec models.Containe
 	image, err := _runtime.client.Pull(ctx, containerSpec.Image, containerd.WithPullUnpack)
 	if err != nil {
 		log.Printf("Error pulling image: %v", err)
-		return models.Container{}, err
+		return models.Container{}, fmt.Errorf("%w %s: %v", ErrImagePull, containerSpec.Image, err)
 	}
 
 	volumePath := _runtime.cfg.StoragePath + containerSpec.ID
@@ -185,9 +115,15 @@ func (_runtime *ContainerdRuntime) StartContainer(containerID string) error {
 		return err
 	}
 
-	logPath := _runtime.cfg.LogPath + _runtime.cfg.Namespace + "-" + containerID + ".log"
+	// A container that exited keeps its stopped task until it is deleted, which blocks creating a new one
+	if task, err := container.Task(ctx, nil); err == nil {
+		if _, err := task.Delete(ctx); err != nil {
+			log.Printf("Failed to delete previous task for container %s: %v", containerID, err)
+			return err
+		}
+	}
 
-	task, err := container.NewTask(ctx, cio.LogFile(logPath))
+	task, err := container.NewTask(ctx, cio.LogFile(_runtime.logPath(containerID)))
 	if err != nil {
 		log.Printf("Failed to create task for container %s: %v", containerID, err)
 		return err
@@ -354,8 +290,102 @@ func (_runtime *ContainerdRuntime) InspectContainer(containerID string) (models.
 
 }
 
-// Events
-// SubscribeToEvents starts listening to containerd events and handles them.
+// ExecContainer runs a command in the container's running task, with the same environment and user as the task
+func (_runtime *ContainerdRuntime) ExecContainer(ctx context.Context, containerID string, args []string) (int, error) {
+	ctx = namespaces.WithNamespace(ctx, _runtime.cfg.Namespace)
+
+	container, err := _runtime.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return -1, err
+	}
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return -1, fmt.Errorf("container %s is not running: %w", containerID, err)
+	}
+
+	spec, err := container.Spec(ctx)
+	if err != nil {
+		return -1, err
+	}
+
+	processSpec := *spec.Process
+	processSpec.Args = args
+	processSpec.Terminal = false
+
+	execID := fmt.Sprintf("exec-%d", time.Now().UnixNano())
+	process, err := task.Exec(ctx, execID, &processSpec, cio.NullIO)
+	if err != nil {
+		return -1, err
+	}
+	defer func() {
+		// Cleaned up even after ctx is done
+		deleteCtx, deleteCancel := context.WithTimeout(namespaces.WithNamespace(context.Background(), _runtime.cfg.Namespace), 5*time.Second)
+		defer deleteCancel()
+		if _, err := process.Delete(deleteCtx, containerd.WithProcessKill); err != nil {
+			log.Printf("Failed to delete exec process %s in container %s: %v", execID, containerID, err)
+		}
+	}()
+
+	exitCh, err := process.Wait(ctx)
+	if err != nil {
+		return -1, err
+	}
+
+	if err := process.Start(ctx); err != nil {
+		return -1, err
+	}
+
+	select {
+	case status := <-exitCh:
+		exitCode, _, err := status.Result()
+		return int(exitCode), err
+	case <-ctx.Done():
+		return -1, fmt.Errorf("command did not exit: %w", ctx.Err())
+	}
+}
+
+// LogSize returns the size of the container's log file, 0 if it has not logged anything yet
+func (_runtime *ContainerdRuntime) LogSize(containerID string) (int64, error) {
+	info, err := os.Stat(_runtime.logPath(containerID))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+// ReadLog reads the container's log file from offset
+func (_runtime *ContainerdRuntime) ReadLog(containerID string, offset int64) ([]byte, error) {
+	file, err := os.Open(_runtime.logPath(containerID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(io.LimitReader(file, MaxLogRead))
+}
+
+func (_runtime *ContainerdRuntime) logPath(containerID string) string {
+	return _runtime.cfg.LogPath + _runtime.cfg.Namespace + "-" + containerID + ".log"
+}
+
+// Events streams task events for containers in the namespace
+func (_runtime *ContainerdRuntime) Events() <-chan RuntimeEvent {
+	return _runtime.events
+}
+
+// SubscribeToEvents starts listening to containerd events and translates them into runtime events.
 func (_runtime *ContainerdRuntime) SubscribeToEvents() {
 	ctx := namespaces.WithNamespace(context.Background(), _runtime.cfg.Namespace)
 
@@ -366,8 +396,13 @@ func (_runtime *ContainerdRuntime) SubscribeToEvents() {
 		for {
 			select {
 			case envelope := <-ch:
-				if err := _runtime.processEvent(envelope, _runtime.cfg.Namespace); err != nil {
+				event, ok, err := _runtime.processEvent(envelope)
+				if err != nil {
 					log.Printf("Error processing event: %v", err)
+					continue
+				}
+				if ok {
+					_runtime.events <- event
 				}
 
 			case e := <-errs:
@@ -377,41 +412,33 @@ func (_runtime *ContainerdRuntime) SubscribeToEvents() {
 	}()
 }
 
-func (_runtime *ContainerdRuntime) processEvent(envelope *events.Envelope, namespace string) error {
-	// MAKE SURE NAMESPACE IS CORRECT HERE
-
-	apiClient := api.NewApiWrapper(_runtime.cfg.ControlNodeIp)
+// processEvent converts a containerd task event, reporting false for events the runtime does not pass on
+func (_runtime *ContainerdRuntime) processEvent(envelope *events.Envelope) (RuntimeEvent, bool, error) {
 	//Should probably check namespace here
 	event, err := typeurl.UnmarshalAny(envelope.Event)
 	if err != nil {
-		return err
+		return RuntimeEvent{}, false, err
 	}
 
 	switch e := event.(type) {
 	case *eventstypes.TaskStart:
-		log.Printf("Task started: ContainerID=%s, PID=%d", e.ContainerID, e.Pid)
-		status := "running"
-		containerPatch := models.UpdateContainerRequest{Status: &status}
-		_, err := apiClient.UpdateContainer(e.ContainerID, containerPatch)
-		if err != nil {
-			log.Printf("Error updating container %s to status 'running': %v", e.ContainerID, err)
-		}
+		return RuntimeEvent{Type: RuntimeEventStart, ContainerID: e.ContainerID, Pid: e.Pid, Time: envelope.Timestamp}, true, nil
 
 	case *eventstypes.TaskDelete:
-		log.Printf("Task deleted: ContainerID=%s, PID=%d, ExitStatus=%d", e.ContainerID, e.Pid, e.ExitStatus)
-		status := "stopped"
-		containerPatch := models.UpdateContainerRequest{Status: &status}
-		_, err := apiClient.UpdateContainer(e.ContainerID, containerPatch)
-		if err != nil {
-			log.Printf("Error updating container %s to status 'stopped': %v", e.ContainerID, err)
+		return RuntimeEvent{Type: RuntimeEventDelete, ContainerID: e.ContainerID, Pid: e.Pid, Time: envelope.Timestamp}, true, nil
+
+	case *eventstypes.TaskExit:
+		// Exec'd processes exit too, only the container's own process exiting stops it
+		if e.ID != e.ContainerID {
+			return RuntimeEvent{}, false, nil
 		}
+		return RuntimeEvent{Type: RuntimeEventExit, ContainerID: e.ContainerID, Pid: e.Pid, ExitCode: int(e.ExitStatus), Time: e.ExitedAt.AsTime()}, true, nil
 
-	/* case *eventstypes.TaskExit:
-	log.Printf("Task exit: ContainerID=%s, PID=%d, ExitStatus=%d", e.ContainerID, e.Pid, e.ExitStatus) */ // Dont think we need this one
+	case *eventstypes.TaskOOM:
+		return RuntimeEvent{Type: RuntimeEventOOM, ContainerID: e.ContainerID, Time: envelope.Timestamp}, true, nil
 
 	default:
 		log.Printf("Unhandled event type: %s", envelope.Topic)
+		return RuntimeEvent{}, false, nil
 	}
-
-	return nil
 }
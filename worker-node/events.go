@@ -0,0 +1,47 @@
+package workernode
+
+import (
+	"log"
+	"time"
+
+	"0xKowalski1/container-orchestrator/models"
+)
+
+// ControlNodeClient is the part of the control node API the worker reports its containers through,
+// implemented by the api wrapper
+type ControlNodeClient interface {
+	UpdateContainer(containerID string, req models.UpdateContainerRequest) (*models.Container, error)
+	RecordEvent(req models.RecordContainerEventRequest) error
+}
+
+// EventRecorder records what happens to this node's containers in their history on the control node
+type EventRecorder struct {
+	controlNode ControlNodeClient
+	nodeID      string
+}
+
+func NewEventRecorder(controlNode ControlNodeClient, nodeID string) *EventRecorder {
+	return &EventRecorder{
+		controlNode: controlNode,
+		nodeID:      nodeID,
+	}
+}
+
+// Record sends an event to the control node. Events are best effort, failures are logged and never stop a sync.
+// A nil recorder drops every event.
+func (r *EventRecorder) Record(containerID, reason, message string) {
+	if r == nil {
+		return
+	}
+
+	err := r.controlNode.RecordEvent(models.RecordContainerEventRequest{
+		ContainerID: containerID,
+		Reason:      reason,
+		Message:     message,
+		Source:      r.nodeID,
+		Time:        time.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("Failed to record %s event for container %s: %v", reason, containerID, err)
+	}
+}
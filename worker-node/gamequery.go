@@ -0,0 +1,294 @@
+package workernode
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"0xKowalski1/container-orchestrator/models"
+)
+
+// maxMinecraftStatus caps the status response, it carries the server icon so can be a few hundred KB
+const maxMinecraftStatus = 1 << 21
+
+// minecraftFormatting matches the § codes Minecraft uses for colours and styles in descriptions
+var minecraftFormatting = regexp.MustCompile("§.")
+
+// queryMinecraft asks a Minecraft Java server for its status with the Server List Ping protocol, as the multiplayer
+// server list does. See https://wiki.vg/Server_List_Ping
+func queryMinecraft(ctx context.Context, addr string) (models.ServerInfo, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return models.ServerInfo{}, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return models.ServerInfo{}, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return models.ServerInfo{}, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Handshake asking for the status state, protocol version -1 as the client does when it does not know the server's
+	var handshake bytes.Buffer
+	writeVarInt(&handshake, 0x00)
+	writeVarInt(&handshake, -1)
+	writeVarInt(&handshake, int32(len(host)))
+	handshake.WriteString(host)
+	binary.Write(&handshake, binary.BigEndian, uint16(port))
+	writeVarInt(&handshake, 1)
+
+	var request bytes.Buffer
+	writeVarInt(&request, int32(handshake.Len()))
+	request.Write(handshake.Bytes())
+	request.Write([]byte{0x01, 0x00}) // Status request, an empty packet with ID 0
+
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		return models.ServerInfo{}, err
+	}
+
+	reader := bufio.NewReader(conn)
+	length, err := readVarInt(reader)
+	if err != nil {
+		return models.ServerInfo{}, fmt.Errorf("failed to read status response: %w", err)
+	}
+	if length <= 0 || length > maxMinecraftStatus {
+		return models.ServerInfo{}, fmt.Errorf("invalid status response length %d", length)
+	}
+
+	packet := bufio.NewReader(io.LimitReader(reader, int64(length)))
+	packetID, err := readVarInt(packet)
+	if err != nil {
+		return models.ServerInfo{}, err
+	}
+	if packetID != 0x00 {
+		return models.ServerInfo{}, fmt.Errorf("unexpected packet %#x in response to the status request", packetID)
+	}
+
+	statusLength, err := readVarInt(packet)
+	if err != nil {
+		return models.ServerInfo{}, err
+	}
+	if statusLength < 0 || statusLength > length {
+		return models.ServerInfo{}, fmt.Errorf("invalid status length %d", statusLength)
+	}
+
+	statusJSON := make([]byte, statusLength)
+	if _, err := io.ReadFull(packet, statusJSON); err != nil {
+		return models.ServerInfo{}, fmt.Errorf("failed to read status: %w", err)
+	}
+
+	var status struct {
+		Version struct {
+			Name string `json:"name"`
+		} `json:"version"`
+		Players struct {
+			Max    int `json:"max"`
+			Online int `json:"online"`
+		} `json:"players"`
+		Description json.RawMessage `json:"description"`
+	}
+	if err := json.Unmarshal(statusJSON, &status); err != nil {
+		return models.ServerInfo{}, fmt.Errorf("invalid status: %w", err)
+	}
+
+	return models.ServerInfo{
+		Players:    status.Players.Online,
+		MaxPlayers: status.Players.Max,
+		Version:    status.Version.Name,
+		MOTD:       minecraftFormatting.ReplaceAllString(chatText(status.Description), ""),
+	}, nil
+}
+
+// chatText flattens a Minecraft chat component, a plain string or an object with text and extra components
+func chatText(raw json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+
+	var component struct {
+		Text  string            `json:"text"`
+		Extra []json.RawMessage `json:"extra"`
+	}
+	if err := json.Unmarshal(raw, &component); err != nil {
+		return ""
+	}
+
+	var builder strings.Builder
+	builder.WriteString(component.Text)
+	for _, extra := range component.Extra {
+		builder.WriteString(chatText(extra))
+	}
+	return builder.String()
+}
+
+func writeVarInt(buf *bytes.Buffer, value int32) {
+	v := uint32(value)
+	for {
+		if v&^0x7F == 0 {
+			buf.WriteByte(byte(v))
+			return
+		}
+		buf.WriteByte(byte(v&0x7F | 0x80))
+		v >>= 7
+	}
+}
+
+func readVarInt(reader io.ByteReader) (int32, error) {
+	var value uint32
+	for i := 0; i < 5; i++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value |= uint32(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			return int32(value), nil
+		}
+	}
+	return 0, errors.New("varint is too long")
+}
+
+// a2sInfoRequest is an A2S_INFO query, servers that ask for a challenge want it sent again with the challenge appended
+var a2sInfoRequest = append([]byte{0xFF, 0xFF, 0xFF, 0xFF, 'T'}, "Source Engine Query\x00"...)
+
+// queryA2S asks a Source engine, or any Steam dedicated, server for its info with A2S_INFO.
+// See https://developer.valvesoftware.com/wiki/Server_queries#A2S_INFO
+func queryA2S(ctx context.Context, addr string) (models.ServerInfo, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return models.ServerInfo{}, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	request := a2sInfoRequest
+	reply := make([]byte, 1400) // Info replies fit in a single packet
+	for attempt := 0; attempt < 3; attempt++ {
+		if _, err := conn.Write(request); err != nil {
+			return models.ServerInfo{}, err
+		}
+
+		n, err := conn.Read(reply)
+		if err != nil {
+			return models.ServerInfo{}, fmt.Errorf("no reply: %w", err)
+		}
+		if n < 5 || !bytes.Equal(reply[:4], []byte{0xFF, 0xFF, 0xFF, 0xFF}) {
+			return models.ServerInfo{}, errors.New("reply is not a single packet A2S response")
+		}
+
+		switch reply[4] {
+		case 'A': // S2C_CHALLENGE
+			if n < 9 {
+				return models.ServerInfo{}, errors.New("short challenge")
+			}
+			request = append(append([]byte(nil), a2sInfoRequest...), reply[5:9]...)
+		case 'I':
+			return parseA2SInfo(reply[5:n])
+		default:
+			return models.ServerInfo{}, fmt.Errorf("unexpected A2S reply header %#x", reply[4])
+		}
+	}
+
+	return models.ServerInfo{}, errors.New("server kept sending challenges")
+}
+
+func parseA2SInfo(payload []byte) (models.ServerInfo, error) {
+	r := &a2sReader{data: payload}
+
+	r.byte() // Protocol version
+	name := r.string()
+	mapName := r.string()
+	r.string() // Folder
+	r.string() // Game
+	appID := r.uint16()
+	players := r.byte()
+	maxPlayers := r.byte()
+	r.byte() // Bots, already counted in players
+	r.byte() // Server type
+	r.byte() // Environment
+	r.byte() // Visibility
+	r.byte() // VAC
+	if appID == 2400 {
+		// The Ship adds its game mode, witnesses and duration
+		r.byte()
+		r.byte()
+		r.byte()
+	}
+	version := r.string()
+
+	if r.err != nil {
+		return models.ServerInfo{}, fmt.Errorf("invalid A2S_INFO reply: %w", r.err)
+	}
+
+	return models.ServerInfo{
+		Players:    int(players),
+		MaxPlayers: int(maxPlayers),
+		Version:    version,
+		MOTD:       name,
+		Map:        mapName,
+	}, nil
+}
+
+// a2sReader reads the fields of an A2S reply, after the first read past the end every read returns zero and err is set
+type a2sReader struct {
+	data []byte
+	err  error
+}
+
+func (r *a2sReader) byte() byte {
+	if r.err != nil || len(r.data) < 1 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *a2sReader) uint16() uint16 {
+	if r.err != nil || len(r.data) < 2 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.LittleEndian.Uint16(r.data)
+	r.data = r.data[2:]
+	return v
+}
+
+// string reads a null terminated string
+func (r *a2sReader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	end := bytes.IndexByte(r.data, 0)
+	if end < 0 {
+		r.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	s := string(r.data[:end])
+	r.data = r.data[end+1:]
+	return s
+}
@@ -0,0 +1,436 @@
+package workernode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"0xKowalski1/container-orchestrator/config"
+	"0xKowalski1/container-orchestrator/models"
+)
+
+// ContainerManager reconciles the containers on this node with their desired state through a Runtime, and reports
+// what happens to them back to the control node
+type ContainerManager struct {
+	cfg         *config.Config
+	runtime     Runtime
+	controlNode ControlNodeClient
+	events      *EventRecorder
+
+	oomKilled map[string]bool // Containers OOM killed since they last started, only touched by the event loop
+	restarts  *restartTracker
+	backoff   *syncBackoff
+	resync    chan struct{}
+
+	mu         sync.Mutex
+	desired    map[string]models.Container                     // Latest desired state of each container, restart policies are read from it
+	reported   map[string]map[string]models.ContainerCondition // ContainerID -> Type -> last condition sent to the control node
+	logOffsets map[string]int64                                // Where each container's log was when it was last started, log probes start there
+	serverInfo map[string]models.ServerInfo                    // Last server info sent for each running container
+
+	probeMu         sync.Mutex
+	probing         map[string]probeRun // ContainerID -> probes of its current run
+	probeGeneration uint64              // Last generation handed to a run
+	probeResults    chan probeResult    // Reported by the event loop so they are ordered with starts and exits
+}
+
+func NewContainerManager(cfg *config.Config, runtime Runtime, controlNode ControlNodeClient, events *EventRecorder) *ContainerManager {
+	cm := &ContainerManager{
+		cfg:         cfg,
+		runtime:     runtime,
+		controlNode: controlNode,
+		events:      events,
+
+		oomKilled:  make(map[string]bool),
+		resync:     make(chan struct{}, 1),
+		desired:    make(map[string]models.Container),
+		reported:   make(map[string]map[string]models.ContainerCondition),
+		logOffsets: make(map[string]int64),
+		serverInfo: make(map[string]models.ServerInfo),
+		probing:    make(map[string]probeRun),
+
+		probeResults: make(chan probeResult),
+	}
+	cm.restarts = newRestartTracker(cm.triggerResync)
+	cm.backoff = newSyncBackoff(cm.triggerResync)
+
+	return cm
+}
+
+// Resync fires when a container that is backing off is due to be restarted or retried, the caller should sync again
+func (cm *ContainerManager) Resync() <-chan struct{} {
+	return cm.resync
+}
+
+func (cm *ContainerManager) triggerResync() {
+	select {
+	case cm.resync <- struct{}{}:
+	default: // A resync is already pending
+	}
+}
+
+// SyncError reports the containers that failed to sync, every other container was still reconciled
+type SyncError struct {
+	Containers map[string]error // ContainerID -> why it failed
+}
+
+func (e *SyncError) Error() string {
+	containerIDs := make([]string, 0, len(e.Containers))
+	for containerID := range e.Containers {
+		containerIDs = append(containerIDs, containerID)
+	}
+	sort.Strings(containerIDs)
+
+	failures := make([]string, len(containerIDs))
+	for i, containerID := range containerIDs {
+		failures[i] = fmt.Sprintf("%s: %v", containerID, e.Containers[containerID])
+	}
+
+	return fmt.Sprintf("%d container(s) failed to sync: %s", len(failures), strings.Join(failures, "; "))
+}
+
+func (e *SyncError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Containers))
+	for _, err := range e.Containers {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// SyncContainers creates, starts, stops and removes containers to match the desired state. Each container is
+// reconciled on its own, failures are reported as conditions and retried with backoff, and returned as a *SyncError.
+func (cm *ContainerManager) SyncContainers(desiredContainers []models.Container) error {
+	return cm.SyncContainersExcept(desiredContainers, nil)
+}
+
+// SyncContainersExcept is SyncContainers leaving the skipped containers as they are, neither reconciled nor removed,
+// e.g. containers whose volume or network could not be set up. They are picked up again by a later sync.
+func (cm *ContainerManager) SyncContainersExcept(desiredContainers []models.Container, skip map[string]error) error {
+	desiredIDs := make(map[string]bool, len(desiredContainers))
+	running := make(map[string]bool, len(desiredContainers))
+
+	cm.mu.Lock()
+	cm.desired = make(map[string]models.Container, len(desiredContainers))
+	for _, c := range desiredContainers {
+		cm.desired[c.ID] = c
+		desiredIDs[c.ID] = true
+		running[c.ID] = c.DesiredStatus == "running"
+	}
+	for containerID := range cm.reported {
+		if !desiredIDs[containerID] {
+			delete(cm.reported, containerID)
+		}
+	}
+	for containerID := range cm.logOffsets {
+		if !desiredIDs[containerID] {
+			delete(cm.logOffsets, containerID)
+		}
+	}
+	for containerID := range cm.serverInfo {
+		if !desiredIDs[containerID] {
+			delete(cm.serverInfo, containerID)
+		}
+	}
+	cm.mu.Unlock()
+
+	cm.probeMu.Lock()
+	for containerID, run := range cm.probing {
+		if !desiredIDs[containerID] {
+			run.cancel()
+			delete(cm.probing, containerID)
+		}
+	}
+	cm.probeMu.Unlock()
+
+	// Stopping a container, or moving it off the node, resets its backoff
+	cm.restarts.forgetExcept(running)
+
+	// List actual containers
+	actualContainers, err := cm.runtime.ListContainers()
+	if err != nil {
+		log.Printf("Error listing containers: %v", err)
+		return err
+	}
+
+	// Map actual container IDs for easier lookup
+	actualMap := make(map[string]models.Container)
+	for _, c := range actualContainers {
+		ic, err := cm.runtime.InspectContainer(c.ID)
+		if err != nil {
+			log.Printf("Error inspecting container: %v", err)
+			ic = c
+		}
+		actualMap[c.ID] = ic
+	}
+
+	// Containers that left the node are retried until removed, so keep their backoff too
+	tracked := make(map[string]bool, len(desiredIDs)+len(actualMap))
+	for containerID := range desiredIDs {
+		tracked[containerID] = true
+	}
+	for containerID := range actualMap {
+		tracked[containerID] = true
+	}
+	cm.backoff.forgetExcept(tracked)
+
+	syncErr := &SyncError{Containers: make(map[string]error)}
+
+	for _, desiredContainer := range desiredContainers {
+		if _, skipped := skip[desiredContainer.ID]; skipped {
+			continue
+		}
+
+		actualContainer, exists := actualMap[desiredContainer.ID]
+		if err := cm.syncContainer(desiredContainer, actualContainer, exists); err != nil {
+			syncErr.Containers[desiredContainer.ID] = err
+		}
+	}
+
+	// Remove extra containers
+	for containerID, actualContainer := range actualMap {
+		if desiredIDs[containerID] {
+			continue
+		}
+		if err := cm.removeContainer(actualContainer); err != nil {
+			syncErr.Containers[containerID] = err
+		}
+	}
+
+	if len(syncErr.Containers) > 0 {
+		return syncErr
+	}
+	return nil
+}
+
+// syncContainer creates the container if it is missing and starts or stops it, reporting how that went as conditions
+func (cm *ContainerManager) syncContainer(desiredContainer models.Container, actualContainer models.Container, exists bool) error {
+	if err := cm.backoff.wait(desiredContainer.ID); err != nil {
+		return err
+	}
+
+	if !exists {
+		if _, err := cm.runtime.CreateContainer(desiredContainer); err != nil {
+			reason := models.ConditionReasonCreateFailed
+			if errors.Is(err, ErrImagePull) {
+				reason = models.ConditionReasonImagePullFailed
+			}
+			cm.reportCondition(desiredContainer.ID, models.ContainerConditionCreated, false, reason, err.Error())
+			return cm.backoff.failed(desiredContainer.ID, err)
+		}
+		cm.events.Record(desiredContainer.ID, models.EventReasonPulled, fmt.Sprintf("Pulled image %s", desiredContainer.Image))
+	}
+	cm.reportCondition(desiredContainer.ID, models.ContainerConditionCreated, true, models.ConditionReasonCreated, "")
+
+	err := cm.reconcileContainerState(desiredContainer, actualContainer)
+
+	// Held by its backoff or restart policy is where it should be for now, not a failure to retry
+	var held *heldError
+	if errors.As(err, &held) {
+		cm.reportCondition(desiredContainer.ID, models.ContainerConditionReconciled, false, held.reason, held.message)
+		cm.backoff.succeeded(desiredContainer.ID)
+		return nil
+	}
+
+	if err != nil {
+		reason := models.ConditionReasonStartFailed
+		if desiredContainer.DesiredStatus == "stopped" {
+			reason = models.ConditionReasonStopFailed
+		}
+		cm.reportCondition(desiredContainer.ID, models.ContainerConditionReconciled, false, reason, err.Error())
+		return cm.backoff.failed(desiredContainer.ID, err)
+	}
+	cm.reportCondition(desiredContainer.ID, models.ContainerConditionReconciled, true, models.ConditionReasonReconciled, "")
+
+	// Containers that were already running when the worker started have no start event to begin probing them
+	if desiredContainer.DesiredStatus == "running" && actualContainer.Status == "running" && !cm.isProbing(desiredContainer.ID) {
+		cm.startProbes(desiredContainer.ID)
+	}
+
+	cm.backoff.succeeded(desiredContainer.ID)
+	return nil
+}
+
+func (cm *ContainerManager) reconcileContainerState(desiredContainer models.Container, actualContainer models.Container) error {
+	switch desiredContainer.DesiredStatus {
+	case "running":
+		if actualContainer.Status != "running" {
+			// Containers that exited on their own wait out their backoff, or stay stopped if their restart policy says so
+			if err := cm.restarts.canStart(desiredContainer.ID); err != nil {
+				return err
+			}
+
+			// Log probes only look at what this run logs
+			logOffset, err := cm.runtime.LogSize(desiredContainer.ID)
+			if err != nil {
+				log.Printf("Failed to read log size of container %s: %v", desiredContainer.ID, err)
+			}
+			cm.mu.Lock()
+			cm.logOffsets[desiredContainer.ID] = logOffset
+			cm.mu.Unlock()
+
+			if err := cm.runtime.StartContainer(desiredContainer.ID); err != nil {
+				return fmt.Errorf("failed to start container: %w", err)
+			}
+		}
+	case "stopped":
+		// A container that was only just created has no task to stop
+		if actualContainer.Status != "stopped" && actualContainer.Status != "" {
+			if err := cm.runtime.StopContainer(desiredContainer.ID, desiredContainer.StopTimeout); err != nil {
+				return fmt.Errorf("failed to stop container: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeContainer stops and removes a container that is no longer on this node
+func (cm *ContainerManager) removeContainer(actualContainer models.Container) error {
+	if err := cm.backoff.wait(actualContainer.ID); err != nil {
+		return err
+	}
+
+	if actualContainer.Status == "running" {
+		if err := cm.runtime.StopContainer(actualContainer.ID, actualContainer.StopTimeout); err != nil {
+			return cm.backoff.failed(actualContainer.ID, fmt.Errorf("failed to stop container: %w", err))
+		}
+	}
+
+	if err := cm.runtime.RemoveContainer(actualContainer.ID); err != nil {
+		return cm.backoff.failed(actualContainer.ID, fmt.Errorf("failed to remove container: %w", err))
+	}
+
+	cm.backoff.succeeded(actualContainer.ID)
+	return nil
+}
+
+// reportCondition sends a condition to the control node if it changed since it was last sent
+func (cm *ContainerManager) reportCondition(containerID, conditionType string, status bool, reason, message string) {
+	condition := models.ContainerCondition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: time.Now().UTC(),
+	}
+
+	cm.mu.Lock()
+	reported, ok := cm.reported[containerID][conditionType]
+	cm.mu.Unlock()
+
+	if ok && reported.Status == status && reported.Reason == reason && reported.Message == message {
+		return
+	}
+
+	patch := models.UpdateContainerRequest{Conditions: []models.ContainerCondition{condition}}
+	if _, err := cm.controlNode.UpdateContainer(containerID, patch); err != nil {
+		log.Printf("Failed to report %s condition for container %s: %v", conditionType, containerID, err)
+		return // Sent again on the next sync
+	}
+
+	cm.mu.Lock()
+	if cm.reported[containerID] == nil {
+		cm.reported[containerID] = make(map[string]models.ContainerCondition)
+	}
+	cm.reported[containerID][conditionType] = condition
+	cm.mu.Unlock()
+}
+
+// Run handles the runtime's events until ctx is cancelled, reporting starts and exits and restarting crashed containers
+func (cm *ContainerManager) Run(ctx context.Context) {
+	runtimeEvents := cm.runtime.Events()
+
+	for {
+		select {
+		case event := <-runtimeEvents:
+			cm.handleEvent(event)
+		case result := <-cm.probeResults:
+			cm.handleProbeResult(result)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (cm *ContainerManager) handleEvent(event RuntimeEvent) {
+	switch event.Type {
+	case RuntimeEventStart:
+		log.Printf("Task started: ContainerID=%s, PID=%d", event.ContainerID, event.Pid)
+		delete(cm.oomKilled, event.ContainerID)
+
+		status := "running"
+		startedAt := event.Time.UTC()
+		cm.restarts.started(event.ContainerID, startedAt)
+		containerPatch := models.UpdateContainerRequest{Status: &status, StartedAt: &startedAt}
+		_, err := cm.controlNode.UpdateContainer(event.ContainerID, containerPatch)
+		if err != nil {
+			log.Printf("Error updating container %s to status 'running': %v", event.ContainerID, err)
+		}
+		cm.events.Record(event.ContainerID, models.EventReasonStarted, fmt.Sprintf("Started with PID %d", event.Pid))
+		cm.startProbes(event.ContainerID)
+
+	case RuntimeEventDelete:
+		log.Printf("Task deleted: ContainerID=%s, PID=%d", event.ContainerID, event.Pid)
+		status := "stopped"
+		containerPatch := models.UpdateContainerRequest{Status: &status}
+		_, err := cm.controlNode.UpdateContainer(event.ContainerID, containerPatch)
+		if err != nil {
+			log.Printf("Error updating container %s to status 'stopped': %v", event.ContainerID, err)
+		}
+
+	case RuntimeEventExit:
+		log.Printf("Task exit: ContainerID=%s, PID=%d, ExitStatus=%d", event.ContainerID, event.Pid, event.ExitCode)
+		cm.stopProbes(event.ContainerID)
+
+		// The control node clears the server info when it records the exit, the next run reports it afresh
+		cm.mu.Lock()
+		delete(cm.serverInfo, event.ContainerID)
+		cm.mu.Unlock()
+
+		// The OOM event arrives before the exit it causes
+		oomKilled := cm.oomKilled[event.ContainerID]
+		delete(cm.oomKilled, event.ContainerID)
+
+		status := "stopped"
+		exitCode := event.ExitCode
+		exitedAt := event.Time.UTC()
+		containerPatch := models.UpdateContainerRequest{Status: &status, ExitCode: &exitCode, ExitedAt: &exitedAt, OOMKilled: &oomKilled}
+		cm.events.Record(event.ContainerID, models.EventReasonExited, fmt.Sprintf("Exited with code %d", event.ExitCode))
+
+		// Containers stopped on purpose are not restarted, their desired status is already stopped or they left the node
+		cm.mu.Lock()
+		desired, ok := cm.desired[event.ContainerID]
+		cm.mu.Unlock()
+
+		if ok && desired.DesiredStatus == "running" {
+			decision := cm.restarts.exited(desired, exitCode, oomKilled)
+			switch {
+			case decision.limitReached:
+				cm.events.Record(event.ContainerID, models.EventReasonRestartLimitReached, fmt.Sprintf("Not restarting after %d restarts", desired.MaxRestarts))
+			case decision.delay > 0:
+				status = models.StatusCrashLoopBackOff
+				containerPatch.NextRestartAt = &decision.nextRestart
+				cm.events.Record(event.ContainerID, models.EventReasonBackOff, fmt.Sprintf("Back-off %s restarting failed container", decision.delay))
+			}
+		}
+
+		_, err := cm.controlNode.UpdateContainer(event.ContainerID, containerPatch)
+		if err != nil {
+			log.Printf("Error reporting exit of container %s: %v", event.ContainerID, err)
+		}
+
+		if ok {
+			cm.reportCondition(event.ContainerID, models.ContainerConditionReady, false, models.ConditionReasonNotRunning, "")
+		}
+
+	case RuntimeEventOOM:
+		log.Printf("Task OOM: ContainerID=%s", event.ContainerID)
+		cm.oomKilled[event.ContainerID] = true
+		cm.events.Record(event.ContainerID, models.EventReasonOOMKilled, "Killed for exceeding its memory limit")
+	}
+}
@@ -18,15 +18,19 @@ import (
 type NetworkingManager struct {
 	cfg       *config.Config
 	cmdRunner utils.CmdRunnerInterface
+	events    *EventRecorder
 }
 
-func NewNetworkingManager(cfg *config.Config, cmdRunner utils.CmdRunnerInterface) *NetworkingManager {
+func NewNetworkingManager(cfg *config.Config, cmdRunner utils.CmdRunnerInterface, events *EventRecorder) *NetworkingManager {
 	return &NetworkingManager{
 		cfg:       cfg,
 		cmdRunner: cmdRunner,
+		events:    events,
 	}
 }
 
+// SyncNetworking sets up and cleans up container networks to match the desired containers. A network that cannot be
+// set up fails only its own container, returned in a *SyncError so the caller can leave that container alone.
 func (nm *NetworkingManager) SyncNetworking(desiredContainers []models.Container) error {
 	actualNamespaces, err := nm.ListNetworkNamespaces()
 	if err != nil {
@@ -43,13 +47,15 @@ func (nm *NetworkingManager) SyncNetworking(desiredContainers []models.Container
 		actualMap[namespace] = true
 	}
 
+	syncErr := &SyncError{Containers: make(map[string]error)}
+
 	for containerID, container := range desiredMap {
 		if !actualMap[containerID] {
 			err := nm.SetupContainerNetwork(containerID, container.Ports)
 			if err != nil {
-				return fmt.Errorf("Failed to setup container network: %v", err)
+				nm.events.Record(containerID, models.EventReasonNetworkSetupFailed, err.Error())
+				syncErr.Containers[containerID] = fmt.Errorf("failed to setup container network: %w", err)
 			}
-
 		}
 	}
 
@@ -57,11 +63,14 @@ func (nm *NetworkingManager) SyncNetworking(desiredContainers []models.Container
 		if _, desired := desiredMap[namespace]; !desired {
 			err := nm.CleanupContainerNetwork(namespace)
 			if err != nil {
-				return fmt.Errorf("Failed to cleanup container network: %v", err)
+				syncErr.Containers[namespace] = fmt.Errorf("failed to cleanup container network: %w", err)
 			}
 		}
 	}
 
+	if len(syncErr.Containers) > 0 {
+		return syncErr
+	}
 	return nil
 }
 
@@ -0,0 +1,437 @@
+package workernode
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"0xKowalski1/container-orchestrator/models"
+)
+
+type probeKind string
+
+const (
+	probeReadiness probeKind = "Readiness"
+	probeLiveness  probeKind = "Liveness"
+)
+
+// probeRun is the probing of one run of a container, identified by its generation
+type probeRun struct {
+	cancel     context.CancelFunc
+	generation uint64
+}
+
+// probeResult is something a probe wants reported for a run. Results are reported by the event loop, in order with
+// the container's starts and exits, and dropped if their run has ended by then.
+type probeResult struct {
+	containerID string
+	generation  uint64
+
+	condition  *models.ContainerCondition // Ready or Live changing
+	unhealthy  string                     // Message of an Unhealthy event to record, empty for none
+	serverInfo *models.ServerInfo         // What a game server answered to its query probe
+}
+
+// startProbes starts probing a container that just started, replacing any probes from its previous run.
+// A container without a readiness probe is Ready straight away.
+func (cm *ContainerManager) startProbes(containerID string) {
+	cm.mu.Lock()
+	container, desired := cm.desired[containerID]
+	logOffset := cm.logOffsets[containerID]
+	cm.mu.Unlock()
+
+	if !desired {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cm.probeMu.Lock()
+	if run, ok := cm.probing[containerID]; ok {
+		run.cancel()
+	}
+	cm.probeGeneration++
+	run := probeRun{cancel: cancel, generation: cm.probeGeneration}
+	cm.probing[containerID] = run
+	cm.probeMu.Unlock()
+
+	ready := models.ContainerCondition{Type: models.ContainerConditionReady, Status: true, Reason: models.ConditionReasonStarted}
+	if container.ReadinessProbe != nil {
+		ready = models.ContainerCondition{Type: models.ContainerConditionReady, Status: false, Reason: models.ConditionReasonStarting}
+	}
+
+	// This can be called from the event loop, so the first result is sent from here rather than waited on
+	go func() {
+		if !cm.sendProbeResult(ctx, probeResult{containerID: containerID, generation: run.generation, condition: &ready}) {
+			return
+		}
+
+		if container.ReadinessProbe != nil {
+			go cm.runProbe(ctx, container, run.generation, probeReadiness, *container.ReadinessProbe, logOffset)
+		}
+
+		if container.LivenessProbe != nil {
+			go cm.runProbe(ctx, container, run.generation, probeLiveness, *container.LivenessProbe, logOffset)
+		}
+	}()
+}
+
+// stopProbes stops probing a container, once it returns no more probe results are reported for the run
+func (cm *ContainerManager) stopProbes(containerID string) {
+	cm.probeMu.Lock()
+	defer cm.probeMu.Unlock()
+
+	if run, ok := cm.probing[containerID]; ok {
+		run.cancel()
+		delete(cm.probing, containerID)
+	}
+}
+
+func (cm *ContainerManager) isProbing(containerID string) bool {
+	cm.probeMu.Lock()
+	defer cm.probeMu.Unlock()
+
+	_, ok := cm.probing[containerID]
+	return ok
+}
+
+// runProbe checks the container every period until ctx is cancelled, reporting when the probe starts passing or
+// failing. A failing liveness probe stops the container, its restart policy decides what happens next.
+func (cm *ContainerManager) runProbe(ctx context.Context, container models.Container, generation uint64, kind probeKind, probe models.Probe, logOffset int64) {
+	check := cm.newProbeCheck(container, generation, probe, logOffset)
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(probe.InitialDelay()):
+	}
+
+	ticker := time.NewTicker(probe.Period())
+	defer ticker.Stop()
+
+	conditionType := models.ContainerConditionReady
+	if kind == probeLiveness {
+		conditionType = models.ContainerConditionLive
+	}
+
+	// Readiness was reported as failing when the container started, liveness is reported from the first result
+	reported := kind == probeReadiness
+	passing := false
+
+	var successes, failures int
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, probe.Timeout())
+		err := check(checkCtx)
+		cancel()
+
+		if err == nil {
+			failures = 0
+			successes++
+			if successes >= probe.Successes() && (!reported || !passing) {
+				reported, passing = true, true
+				cm.sendProbeResult(ctx, probeResult{
+					containerID: container.ID,
+					generation:  generation,
+					condition:   &models.ContainerCondition{Type: conditionType, Status: true, Reason: models.ConditionReasonProbeSucceeded},
+				})
+			}
+		} else {
+			successes = 0
+			failures++
+			if failures >= probe.Failures() && (!reported || passing) {
+				reported, passing = true, false
+				sent := cm.sendProbeResult(ctx, probeResult{
+					containerID: container.ID,
+					generation:  generation,
+					condition:   &models.ContainerCondition{Type: conditionType, Status: false, Reason: models.ConditionReasonProbeFailed, Message: err.Error()},
+					unhealthy:   fmt.Sprintf("%s probe failed: %v", kind, err),
+				})
+				if !sent {
+					return
+				}
+
+				if kind == probeLiveness {
+					log.Printf("Liveness probe failed for container %s, stopping it: %v", container.ID, err)
+					cm.restarts.stoppingUnhealthy(container.ID)
+					if err := cm.runtime.StopContainer(container.ID, container.StopTimeout); err != nil {
+						log.Printf("Failed to stop unhealthy container %s: %v", container.ID, err)
+					}
+					return
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendProbeResult hands a result to the event loop, returning false if the run ended first
+func (cm *ContainerManager) sendProbeResult(ctx context.Context, result probeResult) bool {
+	// Both can be ready at once, a run that has ended must not win
+	if ctx.Err() != nil {
+		return false
+	}
+
+	select {
+	case cm.probeResults <- result:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// handleProbeResult reports a probe result from the event loop, unless the run it was probing has ended
+func (cm *ContainerManager) handleProbeResult(result probeResult) {
+	cm.probeMu.Lock()
+	run, ok := cm.probing[result.containerID]
+	cm.probeMu.Unlock()
+
+	if !ok || run.generation != result.generation {
+		return
+	}
+
+	if condition := result.condition; condition != nil {
+		cm.reportCondition(result.containerID, condition.Type, condition.Status, condition.Reason, condition.Message)
+	}
+
+	if result.unhealthy != "" {
+		cm.events.Record(result.containerID, models.EventReasonUnhealthy, result.unhealthy)
+	}
+
+	if result.serverInfo != nil {
+		cm.reportServerInfo(result.containerID, *result.serverInfo)
+	}
+}
+
+// reportServerInfo sends what a game server answered to its query probe if it changed since it was last sent
+func (cm *ContainerManager) reportServerInfo(containerID string, info models.ServerInfo) {
+	cm.mu.Lock()
+	reported, ok := cm.serverInfo[containerID]
+	cm.mu.Unlock()
+
+	if ok && reported == info {
+		return
+	}
+
+	if _, err := cm.controlNode.UpdateContainer(containerID, models.UpdateContainerRequest{ServerInfo: &info}); err != nil {
+		log.Printf("Failed to report server info for container %s: %v", containerID, err)
+		return // Sent again on the next check
+	}
+
+	cm.mu.Lock()
+	cm.serverInfo[containerID] = info
+	cm.mu.Unlock()
+}
+
+// newProbeCheck returns a function running the probe once, nil if it passed
+func (cm *ContainerManager) newProbeCheck(container models.Container, generation uint64, probe models.Probe, logOffset int64) func(ctx context.Context) error {
+	switch probe.Type {
+	case models.ProbeTypeTCP:
+		return func(ctx context.Context) error {
+			addr, err := cm.probeAddress(container, probe, "tcp")
+			if err != nil {
+				return err
+			}
+
+			var dialer net.Dialer
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}
+
+	case models.ProbeTypeUDP:
+		expect, err := regexp.Compile(probe.Expect)
+		if err != nil {
+			return invalidProbe(err)
+		}
+
+		return func(ctx context.Context) error {
+			addr, err := cm.probeAddress(container, probe, "udp")
+			if err != nil {
+				return err
+			}
+
+			var dialer net.Dialer
+			conn, err := dialer.DialContext(ctx, "udp", addr)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			if deadline, ok := ctx.Deadline(); ok {
+				conn.SetDeadline(deadline)
+			}
+
+			if _, err := conn.Write(probe.Send); err != nil {
+				return err
+			}
+
+			reply := make([]byte, 65535)
+			n, err := conn.Read(reply)
+			if err != nil {
+				return fmt.Errorf("no reply: %w", err)
+			}
+
+			if !expect.Match(reply[:n]) {
+				return fmt.Errorf("reply did not match %q", probe.Expect)
+			}
+			return nil
+		}
+
+	case models.ProbeTypeHTTP:
+		client := &http.Client{
+			// A redirect is a response, following it could probe something other than the container
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+
+		return func(ctx context.Context) error {
+			addr, err := cm.probeAddress(container, probe, "tcp")
+			if err != nil {
+				return err
+			}
+
+			path := probe.Path
+			if path == "" {
+				path = "/"
+			}
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+path, nil)
+			if err != nil {
+				return err
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+				return fmt.Errorf("GET %s returned %s", path, resp.Status)
+			}
+			return nil
+		}
+
+	case models.ProbeTypeMinecraft, models.ProbeTypeA2S:
+		query, protocol := queryMinecraft, "tcp"
+		if probe.Type == models.ProbeTypeA2S {
+			query, protocol = queryA2S, "udp"
+		}
+
+		return func(ctx context.Context) error {
+			addr, err := cm.probeAddress(container, probe, protocol)
+			if err != nil {
+				return err
+			}
+
+			info, err := query(ctx, addr)
+			if err != nil {
+				return err
+			}
+
+			cm.sendProbeResult(ctx, probeResult{containerID: container.ID, generation: generation, serverInfo: &info})
+			return nil
+		}
+
+	case models.ProbeTypeExec:
+		return func(ctx context.Context) error {
+			exitCode, err := cm.runtime.ExecContainer(ctx, container.ID, probe.Command)
+			if err != nil {
+				return err
+			}
+			if exitCode != 0 {
+				return fmt.Errorf("%v exited with code %d", probe.Command, exitCode)
+			}
+			return nil
+		}
+
+	case models.ProbeTypeLog:
+		pattern, err := regexp.Compile(probe.Pattern)
+		if err != nil {
+			return invalidProbe(err)
+		}
+
+		matcher := &logMatcher{runtime: cm.runtime, containerID: container.ID, pattern: pattern, offset: logOffset}
+		return func(ctx context.Context) error {
+			return matcher.check()
+		}
+	}
+
+	return invalidProbe(fmt.Errorf("unknown probe type %q", probe.Type))
+}
+
+func invalidProbe(err error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return fmt.Errorf("invalid probe: %w", err)
+	}
+}
+
+// probeAddress is the node address the probe's container port is mapped to
+func (cm *ContainerManager) probeAddress(container models.Container, probe models.Probe, protocol string) (string, error) {
+	hostPort := probe.HostPort(container.Ports, protocol)
+	if hostPort == 0 {
+		return "", fmt.Errorf("%s port %d is not mapped to a host port", protocol, probe.Port)
+	}
+
+	return net.JoinHostPort(cm.cfg.NodeIp, strconv.Itoa(hostPort)), nil
+}
+
+// logMatcher follows a container's log from where its current run started, passing once a line matches.
+// A server only logs that it finished loading once, so it keeps passing for the rest of the run.
+type logMatcher struct {
+	runtime     Runtime
+	containerID string
+	pattern     *regexp.Regexp
+
+	offset  int64
+	partial []byte // Start of a line that has not finished being written
+	matched bool
+}
+
+func (m *logMatcher) check() error {
+	if m.matched {
+		return nil
+	}
+
+	for {
+		data, err := m.runtime.ReadLog(m.containerID, m.offset)
+		if err != nil {
+			return fmt.Errorf("failed to read logs: %w", err)
+		}
+		m.offset += int64(len(data))
+
+		lines := bytes.Split(append(m.partial, data...), []byte("\n"))
+		for _, line := range lines[:len(lines)-1] {
+			if m.pattern.Match(line) {
+				m.matched = true
+				return nil
+			}
+		}
+
+		// A line longer than a whole read is matched on what was read of it
+		m.partial = lines[len(lines)-1]
+		if len(m.partial) >= MaxLogRead {
+			if m.pattern.Match(m.partial) {
+				m.matched = true
+				return nil
+			}
+			m.partial = nil
+		}
+
+		if len(data) < MaxLogRead {
+			return fmt.Errorf("no line matching %q logged yet", m.pattern)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package workernode
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"0xKowalski1/container-orchestrator/models"
+)
+
+const (
+	restartMinBackoff = 10 * time.Second
+	restartMaxBackoff = 5 * time.Minute
+	restartResetAfter = 10 * time.Minute // A run lasting this long is no longer a crash loop, the backoff starts over
+)
+
+// restartTracker decides when containers that exited on their own are started again, backing off exponentially
+// while they keep crashing. Containers it knows nothing about may be started straight away.
+type restartTracker struct {
+	mu         sync.Mutex
+	containers map[string]*restartState
+	resync     func() // Called once a container is due to be restarted
+}
+
+type restartState struct {
+	startedAt   time.Time // Start of the current or last run
+	restarts    int       // Consecutive restarts without a run lasting restartResetAfter
+	nextRestart time.Time
+	held        string // Condition reason it is left stopped for, the restart policy or limit, empty if it may restart
+	unhealthy   bool   // Stopped for failing its liveness probe, the exit is a failure whatever its exit code
+	timer       *time.Timer
+}
+
+// restartDecision is what happens to a container after it exits on its own, a zero decision with no limit reached
+// means it restarts straight away or its policy leaves it stopped
+type restartDecision struct {
+	delay        time.Duration
+	nextRestart  time.Time
+	limitReached bool
+}
+
+func newRestartTracker(resync func()) *restartTracker {
+	return &restartTracker{
+		containers: make(map[string]*restartState),
+		resync:     resync,
+	}
+}
+
+func (rt *restartTracker) state(containerID string) *restartState {
+	state, ok := rt.containers[containerID]
+	if !ok {
+		state = &restartState{}
+		rt.containers[containerID] = state
+	}
+	return state
+}
+
+// started records the start of a new run
+func (rt *restartTracker) started(containerID string, at time.Time) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	state := rt.state(containerID)
+	state.startedAt = at
+	state.held = ""
+	state.unhealthy = false
+}
+
+// stoppingUnhealthy records that the worker is stopping the container for failing its liveness probe. A server that
+// exits cleanly on SIGTERM would otherwise look like it completed and never be restarted under OnFailure.
+func (rt *restartTracker) stoppingUnhealthy(containerID string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.state(containerID).unhealthy = true
+}
+
+// exited applies the container's restart policy after its process exits, arming a resync for when it is due
+func (rt *restartTracker) exited(container models.Container, exitCode int, oomKilled bool) restartDecision {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	now := time.Now()
+	state := rt.state(container.ID)
+	if state.timer != nil {
+		state.timer.Stop()
+		state.timer = nil
+	}
+
+	unhealthy := state.unhealthy
+	state.unhealthy = false
+
+	switch container.RestartPolicy {
+	case models.RestartPolicyNever:
+		state.held = models.ConditionReasonRestartPolicy
+		return restartDecision{}
+	case models.RestartPolicyOnFailure:
+		if exitCode == 0 && !oomKilled && !unhealthy {
+			state.held = models.ConditionReasonRestartPolicy
+			return restartDecision{}
+		}
+	}
+
+	if !state.startedAt.IsZero() && now.Sub(state.startedAt) >= restartResetAfter {
+		state.restarts = 0
+	}
+
+	if container.MaxRestarts > 0 && state.restarts >= container.MaxRestarts {
+		state.held = models.ConditionReasonRestartLimit
+		return restartDecision{limitReached: true}
+	}
+
+	// The first restart is immediate, then 10s, 20s, 40s... up to restartMaxBackoff
+	var delay time.Duration
+	if state.restarts > 0 {
+		delay = restartMinBackoff
+		for i := 1; i < state.restarts && delay < restartMaxBackoff; i++ {
+			delay *= 2
+		}
+		delay = min(delay, restartMaxBackoff)
+	}
+
+	state.restarts++
+	state.nextRestart = now.Add(delay)
+	state.timer = time.AfterFunc(delay, rt.resync)
+
+	return restartDecision{delay: delay, nextRestart: state.nextRestart}
+}
+
+// heldError means a container was left stopped on purpose rather than failing to start
+type heldError struct {
+	reason  string // Condition reason, BackOff or why it is held
+	message string
+}
+
+func (e *heldError) Error() string {
+	return e.message
+}
+
+// canStart returns nil if the container may be started now, otherwise a heldError saying why it is backing off or held stopped
+func (rt *restartTracker) canStart(containerID string) error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	state, ok := rt.containers[containerID]
+	if !ok {
+		return nil
+	}
+
+	switch {
+	case state.held == models.ConditionReasonRestartPolicy:
+		return &heldError{reason: state.held, message: "Left stopped by its restart policy"}
+	case state.held == models.ConditionReasonRestartLimit:
+		return &heldError{reason: state.held, message: fmt.Sprintf("Left stopped after %d restarts", state.restarts)}
+	case time.Now().Before(state.nextRestart):
+		return &heldError{reason: models.ConditionReasonBackOff, message: fmt.Sprintf("Restarting at %s", state.nextRestart.UTC().Format(time.RFC3339))}
+	}
+
+	return nil
+}
+
+// forgetExcept drops the crash loop history of every container not in keep, they were stopped on purpose or left this node
+func (rt *restartTracker) forgetExcept(keep map[string]bool) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	for containerID, state := range rt.containers {
+		if keep[containerID] {
+			continue
+		}
+		if state.timer != nil {
+			state.timer.Stop()
+		}
+		delete(rt.containers, containerID)
+	}
+}
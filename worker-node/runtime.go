@@ -0,0 +1,56 @@
+package workernode
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"0xKowalski1/container-orchestrator/models"
+)
+
+// ErrImagePull is returned when a container's image cannot be pulled
+var ErrImagePull = errors.New("failed to pull image")
+
+// MaxLogRead caps how much of a log ReadLog returns at once
+const MaxLogRead = 1 << 20
+
+// Runtime runs containers on this node. ContainerdRuntime is the real one, tests use an in-memory fake.
+type Runtime interface {
+	// CreateContainer pulls the image and creates the container without starting it
+	CreateContainer(containerSpec models.Container) (models.Container, error)
+	StartContainer(containerID string) error
+	// StopContainer asks the container to stop, killing it once timeout seconds have passed
+	StopContainer(containerID string, timeout int) error
+	// RemoveContainer removes a stopped container
+	RemoveContainer(containerID string) error
+	ListContainers() ([]models.Container, error)
+	// InspectContainer returns the container with its current status, running or stopped
+	InspectContainer(containerID string) (models.Container, error)
+	// ExecContainer runs a command inside the running container, returning its exit code once it exits. The command
+	// is killed once ctx is done.
+	ExecContainer(ctx context.Context, containerID string, args []string) (int, error)
+	// LogSize returns the length of the container's log, which every run appends to
+	LogSize(containerID string) (int64, error)
+	// ReadLog returns the container's log from offset up to at most MaxLogRead bytes, nothing if offset is at the end
+	ReadLog(containerID string, offset int64) ([]byte, error)
+	// Events streams what happens to containers' processes, in the order it happens
+	Events() <-chan RuntimeEvent
+}
+
+type RuntimeEventType string
+
+const (
+	RuntimeEventStart  RuntimeEventType = "Start"
+	RuntimeEventExit   RuntimeEventType = "Exit" // The container's own process exited, exec'd processes are not reported
+	RuntimeEventOOM    RuntimeEventType = "OOM"  // Sent before the exit it causes
+	RuntimeEventDelete RuntimeEventType = "Delete"
+)
+
+// RuntimeEvent is a change to a container's process
+type RuntimeEvent struct {
+	Type        RuntimeEventType
+	ContainerID string
+	Pid         uint32
+	ExitCode    int // Exit events only
+	Time        time.Time
+}
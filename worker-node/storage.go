@@ -15,16 +15,20 @@ type StorageManager struct {
 	cfg       *config.Config
 	fileOps   utils.FileOpsInterface
 	cmdRunner utils.CmdRunnerInterface
+	events    *EventRecorder
 }
 
-func NewStorageManager(cfg *config.Config, fileOps utils.FileOpsInterface, cmdRunner utils.CmdRunnerInterface) *StorageManager {
+func NewStorageManager(cfg *config.Config, fileOps utils.FileOpsInterface, cmdRunner utils.CmdRunnerInterface, events *EventRecorder) *StorageManager {
 	return &StorageManager{
 		cfg:       cfg,
 		fileOps:   fileOps,
 		cmdRunner: cmdRunner,
+		events:    events,
 	}
 }
 
+// SyncStorage creates and removes volumes to match the desired containers. A volume that cannot be created fails only
+// its own container, returned in a *SyncError so the caller can leave that container alone.
 func (sm *StorageManager) SyncStorage(desiredContainers []models.Container) error {
 	actualVolumes, err := sm.ListVolumes()
 	if err != nil {
@@ -42,12 +46,18 @@ func (sm *StorageManager) SyncStorage(desiredContainers []models.Container) erro
 		desiredMap[volume.ID] = volume
 	}
 
+	syncErr := &SyncError{Containers: make(map[string]error)}
+
 	// Create volumes that are in the desired state but not in the actual state
 	for volumeID, volume := range desiredMap {
 		if _, exists := actualMap[volumeID]; !exists {
 			if _, err := sm.CreateVolume(volume.ID, volume.SizeLimit); err != nil {
 				log.Printf("failed to create volume %s: %v", volumeID, err)
+				sm.events.Record(volumeID, models.EventReasonVolumeCreateFailed, err.Error())
+				syncErr.Containers[volumeID] = fmt.Errorf("failed to create volume: %w", err)
+				continue
 			}
+			sm.events.Record(volumeID, models.EventReasonVolumeCreated, fmt.Sprintf("Created %dGB volume", volume.SizeLimit))
 		}
 	}
 
@@ -60,7 +70,9 @@ func (sm *StorageManager) SyncStorage(desiredContainers []models.Container) erro
 		}
 	}
 
-	// probably want to return a list of errors and unschedule/retry those containers
+	if len(syncErr.Containers) > 0 {
+		return syncErr
+	}
 	return nil
 }
 